@@ -0,0 +1,335 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/path"
+)
+
+// readBatch reads the manifest and tar from a batch request. The tar is
+// streamed from the body so it has to be the last part. Requests with just
+// a tar body have an empty manifest.
+func readBatch(req *http.Request) (*delancey.BatchManifest, io.Reader, error) {
+	manifest := new(delancey.BatchManifest)
+	reader, err := req.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return manifest, req.Body, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return manifest, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch part.FormName() {
+		case "manifest":
+			decoder := json.NewDecoder(part)
+			err = decoder.Decode(manifest)
+			if err != nil {
+				return nil, nil, err
+			}
+		case "tar":
+			return manifest, part, nil
+		}
+	}
+}
+
+// batchTx applies changes to a root. Replaced paths are moved to a backup
+// directory so the changes can be rolled back.
+type batchTx struct {
+	root    string
+	backups string
+	undo    []func() error
+	applied []string
+}
+
+// newBatchTx creates a transaction for the root. The backup directory is
+// next to the root so paths can be renamed into it.
+func newBatchTx(root string) (*batchTx, error) {
+	backups, err := ioutil.TempDir(filepath.Dir(root), "."+filepath.Base(root)+"-backup-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &batchTx{root: root, backups: backups}, nil
+}
+
+// backup moves the path to the backup directory if it exists, and restores
+// it when rolling back.
+func (tx *batchTx) backup(fullPath string) error {
+	_, err := os.Lstat(fullPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	backupPath := filepath.Join(tx.backups, strconv.Itoa(len(tx.undo)))
+	err = os.Rename(fullPath, backupPath)
+	if err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		err := os.RemoveAll(fullPath)
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(backupPath, fullPath)
+	})
+	return nil
+}
+
+// mkdirAll creates the directory and its parents, removing the created
+// directories when rolling back.
+func (tx *batchTx) mkdirAll(dir string) error {
+	created := ""
+	for current := dir; current != tx.root; current = filepath.Dir(current) {
+		_, err := os.Lstat(current)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		created = current
+	}
+	if created == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return os.RemoveAll(created)
+	})
+	return nil
+}
+
+// move renames a path, replacing the destination.
+func (tx *batchTx) move(from, to string) error {
+	err := tx.mkdirAll(filepath.Dir(to))
+	if err == nil {
+		err = tx.backup(to)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+
+	tx.undo = append(tx.undo, func() error {
+		return os.Rename(to, from)
+	})
+	return nil
+}
+
+// remove deletes the relative path.
+func (tx *batchTx) remove(rel string) error {
+	fullPath, err := resolveParentPath(tx.root, path.RelSystem(rel))
+	if err != nil {
+		return err
+	}
+
+	err = tx.backup(fullPath)
+	if err != nil {
+		return &delancey.BatchError{Path: rel, Err: err}
+	}
+
+	tx.applied = append(tx.applied, rel)
+	return nil
+}
+
+// rename moves a relative path, symlinks aren't followed.
+func (tx *batchTx) rename(rename *delancey.Rename) error {
+	from, err := resolveParentPath(tx.root, path.RelSystem(rename.From))
+	if err != nil {
+		return err
+	}
+
+	to, err := resolveParentPath(tx.root, path.RelSystem(rename.To))
+	if err != nil {
+		return err
+	}
+
+	err = tx.move(from, to)
+	if err != nil {
+		return &delancey.BatchError{Path: rename.From, Err: err}
+	}
+
+	tx.applied = append(tx.applied, rename.To)
+	return nil
+}
+
+// put moves the paths in the staging directory into the root. Directories
+// that already exist are merged, everything else replaces the existing
+// path.
+func (tx *batchTx) put(staging string) error {
+	return filepath.Walk(staging, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(staging, full)
+		if err != nil || rel == "." {
+			return err
+		}
+		relUnix := filepath.ToSlash(rel)
+
+		fullPath, err := resolveParentPath(tx.root, rel)
+		if err != nil {
+			return err
+		}
+
+		// Merge into an existing directory, its permissions are kept since
+		// parents may not be in the tar.
+		existing, err := os.Lstat(fullPath)
+		if err == nil && existing.IsDir() && info.IsDir() {
+			return nil
+		}
+
+		err = tx.move(full, fullPath)
+		if err != nil {
+			return &delancey.BatchError{Path: relUnix, Err: err}
+		}
+		tx.applied = append(tx.applied, relUnix)
+		if !info.IsDir() {
+			return nil
+		}
+
+		// The directory was moved with its contents.
+		err = filepath.Walk(fullPath, func(child string, info os.FileInfo, err error) error {
+			if err != nil || child == fullPath {
+				return err
+			}
+
+			childRel, err := filepath.Rel(tx.root, child)
+			tx.applied = append(tx.applied, filepath.ToSlash(childRel))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return filepath.SkipDir
+	})
+}
+
+// rollback undoes the changes in reverse order.
+func (tx *batchTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		err := tx.undo[i]()
+		if err != nil {
+			log.Println("Failed to roll back batch in", tx.root, err)
+		}
+	}
+	tx.undo = nil
+	tx.applied = nil
+	os.RemoveAll(tx.backups)
+}
+
+// commit removes the backups.
+func (tx *batchTx) commit() {
+	os.RemoveAll(tx.backups)
+}
+
+// applyBatch applies a batch to the root all or nothing. The tar is staged
+// first, then the deletes, renames and staged paths are applied in order.
+// If anything fails the changes are rolled back. Rejected paths are returned
+// as PathErrors, and a path that fails to be applied as a BatchError.
+func applyBatch(root string, manifest *delancey.BatchManifest, contents io.Reader, ignores *delancey.Matcher) ([]string, error) {
+	staging, err := ioutil.TempDir(filepath.Dir(root), "."+filepath.Base(root)+"-batch-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	// Check the paths before anything is changed.
+	var rejected PathErrors
+	if contents != nil {
+		err = untar(contents, staging, ignores)
+		if pathErrs, ok := err.(PathErrors); ok {
+			rejected = append(rejected, pathErrs...)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for _, rel := range manifest.Deletes {
+		_, err = resolveParentPath(root, path.RelSystem(rel))
+		if pe, ok := err.(*PathError); ok {
+			rejected = append(rejected, pe)
+		}
+	}
+	for _, rename := range manifest.Renames {
+		for _, rel := range []string{rename.From, rename.To} {
+			_, err = resolveParentPath(root, path.RelSystem(rel))
+			if pe, ok := err.(*PathError); ok {
+				rejected = append(rejected, pe)
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		return nil, rejected
+	}
+
+	err = os.MkdirAll(root, os.ModePerm|os.ModeDir)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := newBatchTx(root)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rel := range manifest.Deletes {
+		err = tx.remove(rel)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		for _, rename := range manifest.Renames {
+			err = tx.rename(rename)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.put(staging)
+	}
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+
+	tx.commit()
+	return tx.applied, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	stdtar "archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// treeContents lists the paths and file contents in a tree.
+func treeContents(t *testing.T, root string) map[string]string {
+	contents := make(map[string]string)
+	err := filepath.Walk(root, func(full string, info os.FileInfo, err error) error {
+		if err != nil || full == root {
+			return err
+		}
+
+		rel, _ := filepath.Rel(root, full)
+		if info.Mode().IsRegular() {
+			data, err := ioutil.ReadFile(full)
+			contents[rel] = string(data)
+			return err
+		}
+
+		contents[rel] = info.Mode().String()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return contents
+}
+
+func newBatchRoot(t *testing.T) string {
+	root, _ := newTestRoot(t)
+	for name, data := range map[string]string{"a": "a", "b": "b", "dir/c": "c"} {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+		if err == nil {
+			err = ioutil.WriteFile(full, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestApplyBatch(t *testing.T) {
+	root := newBatchRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	applied, err := applyBatch(root, &delancey.BatchManifest{
+		Deletes: []string{"a"},
+		Renames: []*delancey.Rename{{From: "b", To: "dir/b"}},
+	}, newTestTar(t, []tarEntry{
+		{name: "dir/c", typ: stdtar.TypeReg, body: "updated"},
+		{name: "new/d", typ: stdtar.TypeReg, body: "d"},
+	}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(applied)
+	expected := []string{"a", "dir/b", "dir/c", "new", "new/d"}
+	if !reflect.DeepEqual(applied, expected) {
+		t.Error("Applied paths aren't as expected", applied)
+	}
+
+	contents := treeContents(t, root)
+	if contents["dir/b"] != "b" || contents["dir/c"] != "updated" || contents["new/d"] != "d" {
+		t.Error("Contents aren't as expected", contents)
+	}
+	if _, ok := contents["a"]; ok {
+		t.Error("a should've been deleted")
+	}
+}
+
+func TestApplyBatchRollback(t *testing.T) {
+	root := newBatchRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+	before := treeContents(t, root)
+
+	// The rename fails after the delete was applied.
+	_, err := applyBatch(root, &delancey.BatchManifest{
+		Deletes: []string{"a", "dir"},
+		Renames: []*delancey.Rename{{From: "b", To: "new/b"}, {From: "missing", To: "c"}},
+	}, newTestTar(t, []tarEntry{
+		{name: "new/d", typ: stdtar.TypeReg, body: "d"},
+	}), nil)
+	batchErr, ok := err.(*delancey.BatchError)
+	if !ok || batchErr.Path != "missing" {
+		t.Fatal("Expected batch error for missing got", err)
+	}
+
+	if after := treeContents(t, root); !reflect.DeepEqual(before, after) {
+		t.Error("Tree wasn't rolled back", after)
+	}
+
+	// Only the root and the test's outside directory should be left.
+	files, err := ioutil.ReadDir(filepath.Dir(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Error("Staging and backup directories weren't removed")
+	}
+}
+
+func TestApplyBatchRejected(t *testing.T) {
+	root := newBatchRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+	before := treeContents(t, root)
+
+	_, err := applyBatch(root, &delancey.BatchManifest{
+		Deletes: []string{"a", "../outside"},
+	}, newTestTar(t, []tarEntry{
+		{name: "../escape", typ: stdtar.TypeReg, body: "bad"},
+	}), nil)
+	rejected, ok := err.(PathErrors)
+	if !ok || len(rejected) != 2 {
+		t.Fatal("Expected 2 rejected paths got", err)
+	}
+
+	if after := treeContents(t, root); !reflect.DeepEqual(before, after) {
+		t.Error("Tree shouldn't have changed", after)
+	}
+}
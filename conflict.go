@@ -0,0 +1,101 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// checkPreconditions checks the path against the expected hash and mtime
+// from an update. The current version of the path is returned, it's nil if
+// the path doesn't exist. If neither is expected any version matches.
+func checkPreconditions(fullPath, rel, prevHash, prevModTime string) (*delancey.ManifestEntry, bool, error) {
+	if prevHash == "" && prevModTime == "" {
+		return nil, true, nil
+	}
+
+	var modTime int64
+	var err error
+	if prevModTime != "" {
+		modTime, err = strconv.ParseInt(prevModTime, 10, 64)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	current, err := delancey.NewManifestEntry(fullPath, rel, info)
+	if err != nil || current == nil {
+		return current, false, err
+	}
+
+	if prevHash != "" && current.Hash != prevHash {
+		return current, false, nil
+	}
+	if prevModTime != "" && current.ModTime.UnixNano() != modTime {
+		return current, false, nil
+	}
+
+	return current, true, nil
+}
+
+// pathLocks holds a lock for each path being changed, so a paths
+// preconditions can't change between checking them and writing it. The
+// zero value is ready to use.
+type pathLocks struct {
+	locks map[string]*pathLock
+	mutex sync.Mutex
+}
+
+// pathLock is a paths lock, refs counts the requests holding or waiting for
+// it so it's removed once unused.
+type pathLock struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+// Lock locks the path.
+func (pl *pathLocks) Lock(fullPath string) {
+	pl.mutex.Lock()
+	if pl.locks == nil {
+		pl.locks = make(map[string]*pathLock)
+	}
+	lock, ok := pl.locks[fullPath]
+	if !ok {
+		lock = new(pathLock)
+		pl.locks[fullPath] = lock
+	}
+	lock.refs++
+	pl.mutex.Unlock()
+
+	lock.mutex.Lock()
+}
+
+// Unlock unlocks the path.
+func (pl *pathLocks) Unlock(fullPath string) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+
+	lock, ok := pl.locks[fullPath]
+	if !ok {
+		return
+	}
+	lock.mutex.Unlock()
+
+	lock.refs--
+	if lock.refs <= 0 {
+		delete(pl.locks, fullPath)
+	}
+}
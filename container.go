@@ -4,11 +4,13 @@ package main
 
 import (
 	"encoding/json"
-	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"sort"
+	"sync"
 
+	"github.com/Bowery/delancey/delancey"
 	"github.com/Bowery/gopackages/schemas"
 )
 
@@ -16,12 +18,31 @@ var (
 	storedContainerPath = filepath.Join(boweryDir, "agent_container.json")
 	containersDir       = filepath.Join(boweryDir, "containers")
 	sshDir              = filepath.Join(boweryDir, "ssh")
-	currentContainer    *Container
+	containers          = NewContainerStore()
 )
 
+// States a container may be in.
+const (
+	ContainerCreating = "creating"
+	ContainerRunning  = "running"
+	ContainerStopped  = "stopped"
+)
+
+// Seconds to wait for a container to stop before it's killed.
+const stopTimeout = 10
+
 // Container wraps a schemas container to provide methods on it.
 type Container struct {
 	*schemas.Container
+	State  string           `json:"state"`
+	Config *ContainerConfig `json:"config,omitempty"`
+
+	// Batches and uploads hold the write lock so they can be rolled back,
+	// single path changes hold the read lock.
+	pathsMutex sync.RWMutex
+
+	// Held from checking a paths preconditions until it's written.
+	pathLocks pathLocks
 }
 
 // NewContainer creates the paths for the given container.
@@ -32,7 +53,7 @@ func NewContainer(container *schemas.Container) (*Container, error) {
 	}
 
 	sshPath := filepath.Join(sshDir, container.ID)
-	if err := os.MkdirAll(root, os.ModePerm|os.ModeDir); err != nil {
+	if err := os.MkdirAll(sshPath, os.ModePerm|os.ModeDir); err != nil {
 		return nil, err
 	}
 
@@ -41,38 +62,203 @@ func NewContainer(container *schemas.Container) (*Container, error) {
 	return &Container{Container: container}, nil
 }
 
-// LoadContainer reads the stored container info and creates it in memory.
-func LoadContainer() (*Container, error) {
+// Save saves the container info, along with the rest of the containers on
+// the agent, to the FS.
+func (container *Container) Save() error {
+	return containers.Save()
+}
+
+// Public creates a copy of the container info without the private fields.
+func (container *Container) Public() *schemas.Container {
+	containerCopy := *container.Container
+	containerCopy.SSHPath = ""
+	containerCopy.LocalPath = ""
+	containerCopy.User = ""
+	containerCopy.Password = ""
+
+	return &containerCopy
+}
+
+// DeleteDocker removes the runtime container for the container and it's
+// image.
+func (container *Container) DeleteDocker() error {
+	// Inspect to get the containers image.
+	info, err := ContainerRuntime.Inspect(container.DockerID)
+	if err != nil {
+		return err
+	}
+
+	err = ContainerRuntime.Remove(container.DockerID)
+	if err != nil {
+		return err
+	}
+
+	return ContainerRuntime.RemoveImage(info.Image)
+}
+
+// StopDocker stops the runtime container for the container.
+func (container *Container) StopDocker() error {
+	return ContainerRuntime.Stop(container.DockerID, stopTimeout)
+}
+
+// StartDocker starts the runtime container for the container using the
+// config it was created with.
+func (container *Container) StartDocker() error {
+	// Containers created by older agents didn't store their config.
+	if container.Config == nil {
+		container.Config = container.NewDockerConfig()
+	}
+
+	return ContainerRuntime.Start(container.Config, container.DockerID)
+}
+
+// NewDockerConfig creates the config used to run the Docker container, which
+// mounts the containers paths.
+func (container *Container) NewDockerConfig() *ContainerConfig {
+	return &ContainerConfig{
+		Volumes: map[string]string{
+			container.RemotePath: container.ContainerPath,
+			container.SSHPath:    "/root/.ssh",
+		},
+		NetworkMode: "host",
+		Privileged:  true,
+	}
+}
+
+// Delete deletes the containers paths.
+func (container *Container) DeletePaths() error {
+	err := os.RemoveAll(container.RemotePath)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(container.SSHPath)
+}
+
+// ContainerStore holds the containers on the agent keyed by their ID. The
+// containers states are guarded by the stores mutex.
+type ContainerStore struct {
+	containers map[string]*Container
+	mutex      sync.RWMutex
+}
+
+// NewContainerStore creates an empty container store.
+func NewContainerStore() *ContainerStore {
+	return &ContainerStore{containers: make(map[string]*Container)}
+}
+
+// Get retrieves the container with the given ID, nil is returned if it
+// doesn't exist.
+func (store *ContainerStore) Get(id string) *Container {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.containers[id]
+}
+
+// List retrieves all the containers sorted by their ID.
+func (store *ContainerStore) List() []*Container {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	list := make([]*Container, 0, len(store.containers))
+	for _, container := range store.containers {
+		list = append(list, container)
+	}
+	sort.Sort(containersByID(list))
+
+	return list
+}
+
+// Add adds a container to the store, if a container with the same ID exists
+// ErrInUse is returned.
+func (store *ContainerStore) Add(container *Container) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if _, ok := store.containers[container.ID]; ok {
+		return delancey.ErrInUse
+	}
+
+	store.containers[container.ID] = container
+	return nil
+}
+
+// Remove removes the container with the given ID from the store.
+func (store *ContainerStore) Remove(id string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.containers, id)
+}
+
+// SetState sets the state of a container in the store.
+func (store *ContainerStore) SetState(container *Container, state string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	container.State = state
+}
+
+// Load reads the stored containers info and creates them in memory.
+func (store *ContainerStore) Load() error {
 	file, err := os.Open(storedContainerPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, nil
+			return nil
 		}
 
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	var containers []*Container
+	var list []*Container
 	decoder := json.NewDecoder(file)
-	err = decoder.Decode(&containers)
+	err = decoder.Decode(&list)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	container := containers[0] // Will always be available.
-	if container != nil {
-		container, err = NewContainer(container.Container)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.containers = make(map[string]*Container)
+
+	for _, container := range list {
+		// Older agents stored null when no container existed.
+		if container == nil || container.Container == nil {
+			continue
+		}
+
+		loaded, err := NewContainer(container.Container)
+		if err != nil {
+			return err
+		}
+		loaded.State = container.State
+		loaded.Config = container.Config
+
+		store.containers[loaded.ID] = loaded
 	}
 
-	return container, err
+	return nil
 }
 
-// Save saves the container info to the FS.
-func (container *Container) Save() error {
-	// Use slice so loading can capture null, rather than the zero value.
-	containers := []*Container{container}
-	dat, err := json.MarshalIndent(containers, "", "  ")
+// Save saves the containers info to the FS. Containers that are still being
+// created are skipped since they can't be recovered. The store is locked
+// while saving so concurrent saves don't interleave, and the info is written
+// to a temporary file first so a failed save doesn't corrupt it.
+func (store *ContainerStore) Save() error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	list := make([]*Container, 0, len(store.containers))
+	for _, container := range store.containers {
+		if container.State != ContainerCreating {
+			list = append(list, container)
+		}
+	}
+	sort.Sort(containersByID(list))
+
+	dat, err := json.MarshalIndent(list, "", "  ")
 	if err != nil {
 		return err
 	}
@@ -82,39 +268,34 @@ func (container *Container) Save() error {
 		return err
 	}
 
-	file, err := os.OpenFile(storedContainerPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	file, err := ioutil.TempFile(boweryDir, filepath.Base(storedContainerPath))
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = io.Copy(file, strings.NewReader(string(dat)))
-	return err
-}
-
-// DeleteContainer removes the Docker container for the container and it's
-// image.
-func (container *Container) DeleteDocker() error {
-	// Inspect to get the containers image.
-	dcontainer, err := DockerClient.Inspect(container.DockerID)
+	_, err = file.Write(dat)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
+		os.Remove(file.Name())
 		return err
 	}
 
-	err = DockerClient.Remove(container.DockerID)
+	err = os.Rename(file.Name(), storedContainerPath)
 	if err != nil {
-		return err
+		os.Remove(file.Name())
 	}
 
-	return DockerClient.RemoveImage(dcontainer.Image)
+	return err
 }
 
-// Delete deletes the containers paths.
-func (container *Container) DeletePaths() error {
-	err := os.RemoveAll(container.RemotePath)
-	if err != nil {
-		return err
-	}
+// containersByID implements sort.Interface to sort containers by their ID.
+type containersByID []*Container
 
-	return os.RemoveAll(container.SSHPath)
-}
+func (c containersByID) Len() int           { return len(c) }
+func (c containersByID) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c containersByID) Less(i, j int) bool { return c[i].ID < c[j].ID }
@@ -2,10 +2,13 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/Bowery/delancey/delancey"
 	"github.com/Bowery/gopackages/schemas"
 )
 
@@ -22,11 +25,16 @@ func TestNewContainer(t *testing.T) {
 	if Ccontainer.RemotePath != filepath.Join(containersDir, Ccontainer.ID) {
 		t.Error("Container path isn't as expected.")
 	}
+
+	info, err := os.Stat(Ccontainer.SSHPath)
+	if err != nil || !info.IsDir() {
+		t.Error("SSH path should've been created")
+	}
 }
 
-func TestSaveContainerNoContainer(t *testing.T) {
-	currentContainer = nil
-	err := currentContainer.Save()
+func TestSaveContainersNoContainers(t *testing.T) {
+	containers = NewContainerStore()
+	err := containers.Save()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -41,21 +49,36 @@ func TestSaveContainerNoContainer(t *testing.T) {
 	}
 }
 
-func TestLoadContainerNoContainer(t *testing.T) {
-	var err error
-	currentContainer, err = LoadContainer()
+func TestLoadContainersNoContainers(t *testing.T) {
+	containers = NewContainerStore()
+	err := containers.Load()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if currentContainer != nil {
-		t.Error("currentContainer should be nil but isn't.")
+	if len(containers.List()) != 0 {
+		t.Error("containers should be empty but isn't.")
 	}
 }
 
-func TestSaveContainerSuccessful(t *testing.T) {
-	currentContainer = &Container{Container: Ccontainer}
-	err := currentContainer.Save()
+func TestAddContainerInUse(t *testing.T) {
+	containers = NewContainerStore()
+	err := containers.Add(&Container{Container: Ccontainer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = containers.Add(&Container{Container: Ccontainer})
+	if err != delancey.ErrInUse {
+		t.Error("Adding a container twice should've failed with ErrInUse.")
+	}
+}
+
+func TestSaveContainersSuccessful(t *testing.T) {
+	containers = NewContainerStore()
+	containers.Add(&Container{Container: Ccontainer, Config: &ContainerConfig{NetworkMode: "host"}})
+	containers.Add(&Container{Container: &schemas.Container{ID: "some-other-id"}})
+	err := containers.Save()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,21 +93,58 @@ func TestSaveContainerSuccessful(t *testing.T) {
 	}
 }
 
-func TestLoadContainer(t *testing.T) {
-	container, err := LoadContainer()
+func TestSaveContainersConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := containers.Save()
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	file, err := os.Open(storedContainerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var list []*Container
+	err = json.NewDecoder(file).Decode(&list)
+	if err != nil || len(list) != 2 {
+		t.Error("Concurrent saves should've written the containers once", err)
+	}
+}
+
+func TestLoadContainers(t *testing.T) {
+	containers = NewContainerStore()
+	err := containers.Load()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if len(containers.List()) != 2 {
+		t.Error("Both saved containers should've been loaded.")
+	}
+
+	container := containers.Get(Ccontainer.ID)
 	if container == nil {
-		t.Error("currentContainer shouldn't be nil but is.")
+		t.Fatal("container shouldn't be nil but is.")
 	}
 
 	if container.ID != Ccontainer.ID {
-		t.Error("currentContainers ID doesn't match what was set.")
+		t.Error("containers ID doesn't match what was set.")
+	}
+
+	if container.Config == nil || container.Config.NetworkMode != "host" {
+		t.Error("containers config wasn't loaded.")
 	}
 
-	currentContainer = nil
+	containers = NewContainerStore()
 	os.RemoveAll(storedContainerPath)
 	os.RemoveAll(containersDir)
 }
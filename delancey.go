@@ -7,33 +7,37 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 
 	"github.com/Bowery/gopackages/config"
-	"github.com/Bowery/gopackages/docker"
 	"github.com/Bowery/gopackages/util"
 	"github.com/Bowery/gopackages/web"
-	loggly "github.com/segmentio/go-loggly"
-	"github.com/timonv/pusher"
 )
 
 // Runtime info and clients.
 var (
-	agentHost, _ = util.GetHost()
-	logClient    = loggly.New(config.LogglyKey, "agent")
-	pusherC      *pusher.Client
-	DockerClient *docker.Client
-	dockerAddr   string
-	Env          string
-	VERSION      string // This is set when release_agent.sh is ran.
+	agentHost, _     = util.GetHost()
+	ContainerRuntime Runtime
+	Env              string
+	ignoreList       []string
+	VERSION          string // This is set when release_agent.sh is ran.
 )
 
 func main() {
 	var err error
 	ver := false
+	dockerAddr := ""
+	publishers := ""
+	webhook := ""
+	ignores := ""
+	origins := ""
 	runtime.GOMAXPROCS(1)
-	pusherC = pusher.NewClient(config.PusherAppID, config.PusherKey, config.PusherSecret)
 	flag.StringVar(&dockerAddr, "docker", "unix:///var/run/docker.sock", "Set a custom endpoint for your local Docker service")
 	flag.StringVar(&Env, "env", "production", "If you want to run the agent in development mode uses different ports")
+	flag.StringVar(&publishers, "publishers", "pusher,loggly", "Comma separated list of where to publish events(pusher, loggly, webhook, stdout, none)")
+	flag.StringVar(&webhook, "webhook", "", "URL to POST events to when using the webhook publisher")
+	flag.StringVar(&ignores, "ignore", ".git/", "Comma separated list of patterns to ignore when extracting uploads")
+	flag.StringVar(&origins, "origins", "", "Comma separated list of origins allowed to open terminals besides the agents host")
 	flag.BoolVar(&ver, "version", false, "Print the version")
 	flag.Parse()
 	if ver {
@@ -41,25 +45,37 @@ func main() {
 		os.Exit(0)
 	}
 
+	if ignores != "" {
+		ignoreList = strings.Split(ignores, ",")
+	}
+	if origins != "" {
+		allowedOrigins = strings.Split(origins, ",")
+	}
+
+	publisher, err = NewPublisher(publishers, webhook)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	fmt.Println("Starting up Delancey with Docker at", dockerAddr)
-	DockerClient, err = docker.NewClient(dockerAddr)
+	ContainerRuntime, err = NewDockerRuntime(dockerAddr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	err = DockerClient.PullImage(config.DockerBaseImage+":latest", nil)
+	err = ContainerRuntime.Pull(config.DockerBaseImage+":latest", nil)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	currentContainer, _ = LoadContainer()
+	containers.Load()
 
-	go logClient.Info("agent starting", map[string]interface{}{
+	sendLog(logInfo, "agent starting", map[string]interface{}{
 		"version": VERSION,
 		"arch":    runtime.GOARCH,
 		"os":      runtime.GOOS,
-		"ip":      agentHost,
 	})
 
 	port := config.DelanceyProdPort
@@ -74,9 +90,7 @@ func main() {
 
 	err = server.ListenAndServe()
 	if err != nil {
-		go logClient.Error(err.Error(), map[string]interface{}{
-			"ip": agentHost,
-		})
+		sendLog(logError, err.Error(), nil)
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -0,0 +1,172 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Bowery/gopackages/config"
+	"github.com/gorilla/websocket"
+)
+
+// ClientHeader is the header requests send the clients ID in, so the
+// changes a client writes aren't streamed back to it.
+const ClientHeader = "Delancey-Client"
+
+// Client sends requests to Delancey instances. The zero value sends requests
+// over HTTP to the production port using http.DefaultClient.
+type Client struct {
+	// Scheme is the scheme used for requests, http or https.
+	Scheme string
+
+	// Port is used for addresses that don't include a port, the production
+	// port is used if it's empty.
+	Port string
+
+	// HTTPClient sends the requests, its transport is also used for terminal
+	// sessions. If it's nil http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Username and Password are sent using basic auth if either is set.
+	Username string
+	Password string
+
+	// Timeout limits how long requests that aren't streamed may take,
+	// including reading their responses and any retries. Zero means no
+	// limit.
+	Timeout time.Duration
+
+	// Retry is the policy idempotent requests are retried with. If it's nil
+	// requests aren't retried.
+	Retry *RetryPolicy
+
+	// ID identifies the client to instances, changes it writes aren't sent
+	// to its remote watchers. If it's empty a random ID is used.
+	ID string
+
+	id     string
+	idOnce sync.Once
+}
+
+// DefaultClient is the client used by the package level functions.
+var DefaultClient = new(Client)
+
+// DevClient is a client for instances running in development mode.
+var DevClient = &Client{Port: config.DelanceyDevPort}
+
+// hostPort gets the host and port for an instance's address, the clients
+// port is used unless the address includes one.
+func (c *Client) hostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	port := c.Port
+	if port == "" {
+		port = config.DelanceyProdPort
+	}
+
+	return net.JoinHostPort(addr, port)
+}
+
+// url gets the URL for an endpoint on the instance at the address.
+func (c *Client) url(addr, endpoint string) string {
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + c.hostPort(addr) + endpoint
+}
+
+// httpClient gets the HTTP client to send requests with.
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+
+	return http.DefaultClient
+}
+
+// clientID gets the ID sent with the clients requests.
+func (c *Client) clientID() string {
+	c.idOnce.Do(func() {
+		c.id = c.ID
+		if c.id == "" {
+			c.id, _ = newIdempotencyKey()
+		}
+	})
+
+	return c.id
+}
+
+// timeout limits the context by the clients timeout. The cancel func has to
+// be called once the response is read.
+func (c *Client) timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, c.Timeout)
+}
+
+// newRequest creates a request for an endpoint on the instance at the
+// address, auth is included if set.
+func (c *Client) newRequest(ctx context.Context, method, addr, endpoint string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.url(addr, endpoint), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(ClientHeader, c.clientID())
+
+	if c.Username != "" || c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	return req, nil
+}
+
+// do sends a request to an endpoint on the instance at the address. The
+// content type is set if given.
+func (c *Client) do(ctx context.Context, method, addr, endpoint string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, addr, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return c.httpClient().Do(req)
+}
+
+// dialWebSocket opens a WebSocket to an endpoint on the instance at the
+// address. The HTTP clients TLS config and proxy are used if it has them.
+func (c *Client) dialWebSocket(ctx context.Context, addr, endpoint string) (*websocket.Conn, *http.Response, error) {
+	dialer := *websocket.DefaultDialer
+	if transport, ok := c.httpClient().Transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+		dialer.Proxy = transport.Proxy
+	}
+
+	scheme := "ws"
+	if c.Scheme == "https" {
+		scheme = "wss"
+	}
+
+	header := make(http.Header)
+	header.Set(ClientHeader, c.clientID())
+	if c.Username != "" || c.Password != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		header.Set("Authorization", "Basic "+auth)
+	}
+
+	return dialer.DialContext(ctx, scheme+"://"+c.hostPort(addr)+endpoint, header)
+}
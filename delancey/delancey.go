@@ -3,19 +3,21 @@
 package delancey
 
 import (
+	stdtar "archive/tar"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"mime/multipart"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/Bowery/gopackages/config"
 	"github.com/Bowery/gopackages/path"
 	"github.com/Bowery/gopackages/requests"
 	"github.com/Bowery/gopackages/schemas"
@@ -33,10 +35,22 @@ const (
 	BatchFinishStatus  = "batch-finish"
 )
 
+// Job statuses that are used for background work.
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
 // Errors that may occur.
 var (
 	ErrInUse    = errors.New("This Delancey instance is in use")
 	ErrNotInUse = errors.New("This Delancey instance is not in use")
+	ErrNoJob    = errors.New("The job doesn't exist on this Delancey instance")
+
+	ErrNoSession   = errors.New("The session doesn't exist on this Delancey instance")
+	ErrSequenceGap = errors.New("Updates before this one in the session never arrived")
+	ErrConflict    = errors.New("The path isn't the expected version on this Delancey instance")
 )
 
 // BatchError is used when the batch update encounters an error but
@@ -50,40 +64,121 @@ func (be *BatchError) Error() string {
 	return be.Err.Error()
 }
 
-// Download retrieves the containers contents on the instance.
-func Download(container *schemas.Container) (io.Reader, error) {
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	res, err := http.Get("http://" + addr)
+// BatchErrors is used when a batch update fails, it contains the paths that
+// failed. Batches are applied all or nothing so no paths were updated.
+type BatchErrors []*BatchError
+
+func (be BatchErrors) Error() string {
+	if len(be) == 1 {
+		return be[0].Path + ": " + be[0].Error()
+	}
+
+	return strconv.Itoa(len(be)) + " paths failed to update, first " + be[0].Path + ": " + be[0].Error()
+}
+
+// BatchFailure describes a path that failed in a batch update.
+type BatchFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// BatchRes is the response for a batch update, it lists the paths applied
+// or the paths that failed.
+type BatchRes struct {
+	*requests.Res
+	Applied []string        `json:"applied"`
+	Failed  []*BatchFailure `json:"failed"`
+}
+
+// Job describes work an instance is doing in the background. Container is
+// set once a create job succeeds.
+type Job struct {
+	ID        string             `json:"id"`
+	Status    string             `json:"status"`
+	Step      string             `json:"step"`
+	Progress  float64            `json:"progress"`
+	Container *schemas.Container `json:"container,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// JobRes is the response for retrieving a job.
+type JobRes struct {
+	*requests.Res
+	Job *Job `json:"job"`
+}
+
+// ContainersRes is the response for listing the containers on an instance.
+type ContainersRes struct {
+	*requests.Res
+	Containers []*schemas.Container `json:"containers"`
+}
+
+// List is a wrapper around DefaultClient.List.
+func List(addr string) ([]*schemas.Container, error) {
+	return DefaultClient.List(context.Background(), addr)
+}
+
+// List retrieves the containers on the instance at the given address.
+func (c *Client) List(ctx context.Context, addr string) ([]*schemas.Container, error) {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "GET", addr, "/containers", nil, "", "")
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
-	// Decode failure response.
-	if res.StatusCode != http.StatusOK {
-		resData := new(requests.Res)
-		decoder := json.NewDecoder(res.Body)
-		err = decoder.Decode(resData)
-		if err != nil {
-			return nil, err
-		}
-
-		// If the error matches return var.
-		if resData.Error() == ErrNotInUse.Error() {
-			err = ErrNotInUse
-		}
-
+	containersRes := new(ContainersRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(containersRes)
+	if err != nil {
 		return nil, err
 	}
 
-	body := new(bytes.Buffer)
-	_, err = io.Copy(body, res.Body)
-	return body, err
+	if containersRes.Status != requests.StatusSuccess {
+		return nil, containersRes
+	}
+
+	return containersRes.Containers, nil
 }
 
-// Create creates the given container on the instance using a dockerfile
-// as the base if given.
+// Create is a wrapper around DefaultClient.Create.
 func Create(container *schemas.Container, dockerfile string) error {
+	return DefaultClient.Create(context.Background(), container, dockerfile)
+}
+
+// Create creates the given container on the instance using a dockerfile
+// as the base if given, and waits for the creation to complete.
+func (c *Client) Create(ctx context.Context, container *schemas.Container, dockerfile string) error {
+	job, err := c.StartCreate(ctx, container, dockerfile)
+	if err != nil {
+		return err
+	}
+
+	job, err = c.WaitJob(ctx, container.Address, job.ID, time.Second)
+	if err != nil {
+		return err
+	}
+
+	container.DockerID = job.Container.DockerID
+	container.RemotePath = job.Container.RemotePath
+	container.SSHPath = job.Container.SSHPath
+	container.ContainerPath = job.Container.ContainerPath
+	container.User = job.Container.User
+	container.Password = job.Container.Password
+	return nil
+}
+
+// StartCreate is a wrapper around DefaultClient.StartCreate.
+func StartCreate(container *schemas.Container, dockerfile string) (*Job, error) {
+	return DefaultClient.StartCreate(context.Background(), container, dockerfile)
+}
+
+// StartCreate starts creating the given container on the instance using a
+// dockerfile as the base if given. The job returned can be given to WaitJob
+// to wait for the creation to complete.
+func (c *Client) StartCreate(ctx context.Context, container *schemas.Container, dockerfile string) (*Job, error) {
 	var body bytes.Buffer
 	reqContainer := &requests.DockerfileContainerReq{
 		Container:  container,
@@ -93,50 +188,119 @@ func Create(container *schemas.Container, dockerfile string) error {
 	encoder := json.NewEncoder(&body)
 	err := encoder.Encode(reqContainer)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	res, err := http.Post("http://"+addr, "application/json", &body)
+	// The key lets retries return the same job instead of failing since the
+	// container is in use.
+	key, err := newIdempotencyKey()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "POST", container.Address, "/containers", body.Bytes(), "application/json", key)
+	if err != nil {
+		return nil, err
 	}
 	defer res.Body.Close()
 
-	containerRes := new(requests.ContainerRes)
+	jobRes := new(JobRes)
 	decoder := json.NewDecoder(res.Body)
-	err = decoder.Decode(containerRes)
+	err = decoder.Decode(jobRes)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if containerRes.Status != requests.StatusCreated {
+	if jobRes.Status != requests.StatusCreated {
 		// If the error matches return var.
-		if containerRes.Error() == ErrInUse.Error() {
-			return ErrInUse
+		if jobRes.Error() == ErrInUse.Error() {
+			return nil, ErrInUse
 		}
 
-		return containerRes
+		return nil, jobRes
 	}
 
-	container.DockerID = containerRes.Container.DockerID
-	container.RemotePath = containerRes.Container.RemotePath
-	container.SSHPath = containerRes.Container.SSHPath
-	container.ContainerPath = containerRes.Container.ContainerPath
-	container.User = containerRes.Container.User
-	container.Password = containerRes.Container.Password
-	return nil
+	return jobRes.Job, nil
 }
 
-// Upload uploads the given reader to the instance.
-func Upload(container *schemas.Container, contents io.Reader) error {
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("PUT", "http://"+addr, contents)
+// GetJob is a wrapper around DefaultClient.GetJob.
+func GetJob(addr, id string) (*Job, error) {
+	return DefaultClient.GetJob(context.Background(), addr, id)
+}
+
+// GetJob retrieves a job from the instance at the given address.
+func (c *Client) GetJob(ctx context.Context, addr, id string) (*Job, error) {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "GET", addr, "/jobs/"+id, nil, "", "")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	jobRes := new(JobRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(jobRes)
+	if err != nil {
+		return nil, err
+	}
+
+	if jobRes.Status != requests.StatusSuccess {
+		// If the error matches return var.
+		if jobRes.Error() == ErrNoJob.Error() {
+			return nil, ErrNoJob
+		}
+
+		return nil, jobRes
+	}
+
+	return jobRes.Job, nil
+}
+
+// WaitJob is a wrapper around DefaultClient.WaitJob.
+func WaitJob(addr, id string, interval time.Duration) (*Job, error) {
+	return DefaultClient.WaitJob(context.Background(), addr, id, interval)
+}
+
+// WaitJob polls a job on the instance at the given address every interval
+// until it completes. If the job fails its error is returned.
+func (c *Client) WaitJob(ctx context.Context, addr, id string, interval time.Duration) (*Job, error) {
+	for {
+		job, err := c.GetJob(ctx, addr, id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch job.Status {
+		case JobSucceeded:
+			return job, nil
+		case JobFailed:
+			return job, errors.New(job.Error)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+}
+
+// Upload is a wrapper around DefaultClient.Upload.
+func Upload(container *schemas.Container, contents io.Reader) error {
+	return DefaultClient.Upload(context.Background(), container, contents)
+}
+
+// Upload uploads the given reader to the instance.
+func (c *Client) Upload(ctx context.Context, container *schemas.Container, contents io.Reader) error {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := c.do(ctx, "PUT", container.Address, "/containers/"+container.ID, contents, "")
 	if err != nil {
 		return err
 	}
@@ -161,38 +325,158 @@ func Upload(container *schemas.Container, contents io.Reader) error {
 	return nil
 }
 
-// Update updates the given path to the instance.
+// UploadDir is a wrapper around DefaultClient.UploadDir.
+func UploadDir(container *schemas.Container, dir string) error {
+	return DefaultClient.UploadDir(context.Background(), container, dir)
+}
+
+// UploadDir uploads the contents of a directory to the instance, skipping
+// the paths ignored by its ignore files.
+func (c *Client) UploadDir(ctx context.Context, container *schemas.Container, dir string) error {
+	contents, err := TarDir(dir)
+	if err != nil {
+		return err
+	}
+
+	return c.Upload(ctx, container, contents)
+}
+
+// ConflictError is used when an update's preconditions fail. Current is
+// the version of the path on the instance, it's nil if the path doesn't
+// exist.
+type ConflictError struct {
+	Path    string
+	Current *ManifestEntry
+}
+
+func (ce *ConflictError) Error() string {
+	return ce.Path + ": " + ErrConflict.Error()
+}
+
+// ServerError is used when an instance fails with a 5xx status, the request
+// may succeed if it's sent again. Err is the failure response.
+type ServerError struct {
+	StatusCode int
+	Err        error
+}
+
+func (se *ServerError) Error() string {
+	return se.Err.Error()
+}
+
+// serverError wraps a failure response in a ServerError if its status is
+// 5xx.
+func serverError(res *http.Response, err error) error {
+	if res.StatusCode < 500 {
+		return err
+	}
+
+	return &ServerError{StatusCode: res.StatusCode, Err: err}
+}
+
+// UpdateRes is the response for an update, Current is set on conflicts.
+type UpdateRes struct {
+	*requests.Res
+	Current *ManifestEntry `json:"current"`
+}
+
+// UpdateOptions are extra options for an update. If Session is set the
+// update is applied in order of Seq with the other updates in the session.
+// If PrevHash or PrevModTime are set the update is only applied if the
+// path on the instance matches them, otherwise a ConflictError is
+// returned.
+type UpdateOptions struct {
+	Session     string
+	Seq         uint64
+	PrevHash    string
+	PrevModTime time.Time
+}
+
+// Update is a wrapper around DefaultClient.Update.
 func Update(container *schemas.Container, full, name, status string) error {
+	return DefaultClient.Update(context.Background(), container, full, name, status)
+}
+
+// Update updates the given path to the instance.
+func (c *Client) Update(ctx context.Context, container *schemas.Container, full, name, status string) error {
+	return c.UpdateWithOptions(ctx, container, full, name, status, nil)
+}
+
+// UpdateWithOptions is a wrapper around DefaultClient.UpdateWithOptions.
+func UpdateWithOptions(container *schemas.Container, full, name, status string, opts *UpdateOptions) error {
+	return DefaultClient.UpdateWithOptions(context.Background(), container, full, name, status, opts)
+}
+
+// UpdateWithOptions updates the given path to the instance using the
+// options. The update is retried using the clients retry policy.
+func (c *Client) UpdateWithOptions(ctx context.Context, container *schemas.Container, full, name, status string, opts *UpdateOptions) error {
+	if opts == nil {
+		opts = new(UpdateOptions)
+	}
+
+	body, writer, err := newUpdateBody(full, name, status, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Session != "" {
+		err = writeSessionFields(writer, opts.Session, opts.Seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.sendUpdate(ctx, container, name, body, writer)
+}
+
+// newUpdateBody writes an updates fields and file to a multipart body. The
+// session fields aren't written and the writer isn't closed, so they can be
+// added once the update is ready to send.
+func newUpdateBody(full, name, status string, opts *UpdateOptions) (*bytes.Buffer, *multipart.Writer, error) {
 	var body bytes.Buffer
 	writer := multipart.NewWriter(&body)
 
 	err := writer.WriteField("type", status)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	fields := make(map[string]string)
+	if opts.PrevHash != "" {
+		fields["prevhash"] = opts.PrevHash
+	}
+	if !opts.PrevModTime.IsZero() {
+		fields["prevmtime"] = strconv.FormatInt(opts.PrevModTime.UnixNano(), 10)
+	}
+	for key, value := range fields {
+		err = writer.WriteField(key, value)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	err = writer.WriteField("path", path.RelUnix(name))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// Attach file if update/create status.
 	if status == UpdateStatus || status == CreateStatus {
 		file, err := os.Open(full)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		defer file.Close()
 
 		stat, err := file.Stat()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		// Add the files permissions from stats mode.
 		err = writer.WriteField("mode", strconv.FormatUint(uint64(stat.Mode().Perm()), 10))
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		// Get the file type from stat.
@@ -202,80 +486,156 @@ func Update(container *schemas.Container, full, name, status string) error {
 		}
 		err = writer.WriteField("pathtype", pathType)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 
 		// Add the contents if it's a directory.
 		if pathType == "file" {
 			part, err := writer.CreateFormFile("file", "upload")
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 
 			_, err = io.Copy(part, file)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
 	}
 
-	err = writer.Close()
+	return &body, writer, nil
+}
+
+// writeSessionFields writes the session and sequence number of an update.
+func writeSessionFields(writer *multipart.Writer, session string, seq uint64) error {
+	err := writer.WriteField("session", session)
 	if err != nil {
 		return err
 	}
 
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("PATCH", "http://"+addr, &body)
+	return writer.WriteField("seq", strconv.FormatUint(seq, 10))
+}
+
+// sendUpdate closes an updates body and sends it to the instance.
+func (c *Client) sendUpdate(ctx context.Context, container *schemas.Container, name string, body *bytes.Buffer, writer *multipart.Writer) error {
+	err := writer.Close()
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	res, err := http.DefaultClient.Do(req)
+	// The key lets a retry get the result of an update that was applied,
+	// instead of failing its preconditions against itself.
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "PATCH", container.Address, "/containers/"+container.ID, body.Bytes(), writer.FormDataContentType(), key)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	resData := new(requests.Res)
+	resData := new(UpdateRes)
 	decoder := json.NewDecoder(res.Body)
 	err = decoder.Decode(resData)
 	if err != nil {
-		return err
+		return serverError(res, err)
 	}
 
 	if resData.Status != requests.StatusUpdated {
 		// If the error matches return var.
-		if resData.Error() == ErrNotInUse.Error() {
+		switch resData.Error() {
+		case ErrNotInUse.Error():
 			return ErrNotInUse
+		case ErrNoSession.Error():
+			return ErrNoSession
+		case ErrSequenceGap.Error():
+			return ErrSequenceGap
+		case ErrConflict.Error():
+			return &ConflictError{Path: path.RelUnix(name), Current: resData.Current}
 		}
 
-		return resData
+		return serverError(res, resData)
 	}
 
 	return nil
 }
 
-// BatchUpdate updates a list of paths to the instance. Only update/create
-// events should be included.
+// BatchManifest lists the paths deleted and renamed in a batch update. The
+// paths are relative using forward slashes.
+type BatchManifest struct {
+	Deletes []string  `json:"deletes,omitempty"`
+	Renames []*Rename `json:"renames,omitempty"`
+}
+
+// Rename describes a path moved in a batch update.
+type Rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// BatchUpdate is a wrapper around DefaultClient.BatchUpdate.
 func BatchUpdate(container *schemas.Container, paths map[string]string, errorChan chan error) error {
-	body, gzipWriter, tarWriter := tar.NewTarGZ()
+	return DefaultClient.BatchUpdate(context.Background(), container, paths, errorChan)
+}
+
+// BatchUpdate updates a list of paths to the instance. The paths map full
+// paths to their relative path.
+func (c *Client) BatchUpdate(ctx context.Context, container *schemas.Container, paths map[string]string, errorChan chan error) error {
+	return c.BatchUpdateWithManifest(ctx, container, paths, nil, errorChan)
+}
+
+// BatchUpdateWithManifest is a wrapper around
+// DefaultClient.BatchUpdateWithManifest.
+func BatchUpdateWithManifest(container *schemas.Container, paths map[string]string, manifest *BatchManifest, errorChan chan error) error {
+	return DefaultClient.BatchUpdateWithManifest(context.Background(), container, paths, manifest, errorChan)
+}
+
+// BatchUpdateWithManifest updates a list of paths to the instance. The paths
+// map full paths to their relative path, and the manifest holds the deletes
+// and renames if any. Deletes are applied first, then renames, and finally the
+// paths are written. The batch is applied all or nothing, if it fails the
+// paths that failed are returned as BatchErrors. Paths ignored by the
+// ignore files in their trees root are skipped, and symlinks are sent as
+// symlinks. The batch is retried using the clients retry policy.
+func (c *Client) BatchUpdateWithManifest(ctx context.Context, container *schemas.Container, paths map[string]string, manifest *BatchManifest, errorChan chan error) error {
+	if manifest == nil {
+		manifest = new(BatchManifest)
+	}
+	contents, gzipWriter, tarWriter := tar.NewTarGZ()
+	ignores := make(map[string]*Matcher)
 
 	for full, rel := range paths {
+		ignored, err := batchIgnored(ignores, full, rel)
+		if err != nil {
+			return err
+		}
+		if ignored {
+			continue
+		}
+
 		info, err := os.Lstat(full)
 		if err != nil {
 			if os.IsNotExist(err) {
-				errorChan <- &BatchError{Path: full, Err: err}
+				if errorChan != nil {
+					errorChan <- &BatchError{Path: full, Err: err}
+				}
 				continue
 			}
 
 			return err
 		}
 
-		err = tar.WritePath(tarWriter, info, full, rel)
+		err = writeTarPath(tarWriter, info, full, rel)
 		if err != nil {
 			if os.IsNotExist(err) {
-				errorChan <- &BatchError{Path: full, Err: err}
+				if errorChan != nil {
+					errorChan <- &BatchError{Path: full, Err: err}
+				}
 				continue
 			}
 
@@ -285,46 +645,139 @@ func BatchUpdate(container *schemas.Container, paths map[string]string, errorCha
 	tarWriter.Close()
 	gzipWriter.Close()
 
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("PATCH", "http://"+addr+"/batch", body)
+	// The manifest has to come before the tar so it can be streamed.
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteField("manifest", string(manifestJSON))
+	if err != nil {
+		return err
+	}
+
+	part, err := writer.CreateFormFile("tar", "batch.tar.gz")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(part, contents)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	// The key lets a retry get the result of a batch that was applied.
+	key, err := newIdempotencyKey()
 	if err != nil {
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "PATCH", container.Address, "/containers/"+container.ID+"/batch", body.Bytes(), writer.FormDataContentType(), key)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	resData := new(requests.Res)
+	batchRes := new(BatchRes)
 	decoder := json.NewDecoder(res.Body)
-	err = decoder.Decode(resData)
+	err = decoder.Decode(batchRes)
 	if err != nil {
-		return err
+		return serverError(res, err)
 	}
 
-	if resData.Status != requests.StatusUpdated {
+	if batchRes.Status != requests.StatusUpdated {
 		// If the error matches return var.
-		if resData.Error() == ErrNotInUse.Error() {
+		if batchRes.Error() == ErrNotInUse.Error() {
 			return ErrNotInUse
 		}
 
-		return resData
+		if len(batchRes.Failed) > 0 {
+			batchErrs := make(BatchErrors, 0, len(batchRes.Failed))
+			for _, failure := range batchRes.Failed {
+				batchErrs = append(batchErrs, &BatchError{Path: failure.Path, Err: errors.New(failure.Error)})
+			}
+
+			return batchErrs
+		}
+
+		return serverError(res, batchRes)
 	}
 
 	return nil
 }
 
-// Save commits and pushes the current container on the instance.
+// writeTarPath writes a path to a tar, symlinks are written with their
+// target.
+func writeTarPath(tarWriter *stdtar.Writer, info os.FileInfo, full, rel string) error {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return tar.WritePath(tarWriter, info, full, rel)
+	}
+
+	target, err := os.Readlink(full)
+	if err != nil {
+		return err
+	}
+
+	header, err := stdtar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(rel)
+
+	return tarWriter.WriteHeader(header)
+}
+
+// batchIgnored checks if a path in a batch is ignored. The trees root is
+// found by removing the relative path, and its ignores are cached.
+func batchIgnored(ignores map[string]*Matcher, full, rel string) (bool, error) {
+	full = filepath.Clean(full)
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	root := strings.TrimSuffix(full, filepath.FromSlash(rel))
+	if root == full || !strings.HasSuffix(root, string(filepath.Separator)) {
+		return false, nil
+	}
+
+	matcher, ok := ignores[root]
+	if !ok {
+		var err error
+		matcher, err = LoadIgnores(root)
+		if err != nil {
+			return false, err
+		}
+		ignores[root] = matcher
+	}
+
+	info, err := os.Lstat(full)
+	isDir := err == nil && info.IsDir()
+	return matcher.MatchParents(rel, isDir), nil
+}
+
+// Save is a wrapper around DefaultClient.Save.
 func Save(container *schemas.Container) error {
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("PUT", "http://"+addr+"/containers", nil)
+	return DefaultClient.Save(context.Background(), container)
+}
+
+// Save commits and pushes the container on the instance.
+func (c *Client) Save(ctx context.Context, container *schemas.Container) error {
+	key, err := newIdempotencyKey()
 	if err != nil {
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "PUT", container.Address, "/containers/"+container.ID+"/save", nil, "", key)
 	if err != nil {
 		return err
 	}
@@ -349,15 +802,78 @@ func Save(container *schemas.Container) error {
 	return nil
 }
 
-// Delete removes the container from the instance.
-func Delete(container *schemas.Container) error {
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("DELETE", "http://"+addr, nil)
+// Stop is a wrapper around DefaultClient.Stop.
+func Stop(container *schemas.Container) error {
+	return DefaultClient.Stop(context.Background(), container)
+}
+
+// Stop stops the container on the instance, its state is kept so it can
+// be started again.
+func (c *Client) Stop(ctx context.Context, container *schemas.Container) error {
+	return c.lifecycle(ctx, container, "stop")
+}
+
+// Start is a wrapper around DefaultClient.Start.
+func Start(container *schemas.Container) error {
+	return DefaultClient.Start(context.Background(), container)
+}
+
+// Start starts the stopped container on the instance.
+func (c *Client) Start(ctx context.Context, container *schemas.Container) error {
+	return c.lifecycle(ctx, container, "start")
+}
+
+// Restart is a wrapper around DefaultClient.Restart.
+func Restart(container *schemas.Container) error {
+	return DefaultClient.Restart(context.Background(), container)
+}
+
+// Restart stops and starts the container on the instance.
+func (c *Client) Restart(ctx context.Context, container *schemas.Container) error {
+	return c.lifecycle(ctx, container, "restart")
+}
+
+// lifecycle sends a lifecycle action for the container to the instance.
+func (c *Client) lifecycle(ctx context.Context, container *schemas.Container, action string) error {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.do(ctx, "POST", container.Address, "/containers/"+container.ID+"/"+action, nil, "")
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
-	res, err := http.DefaultClient.Do(req)
+	resData := new(requests.Res)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		return err
+	}
+
+	if resData.Status != requests.StatusUpdated {
+		// If the error matches return var.
+		if resData.Error() == ErrNotInUse.Error() {
+			return ErrNotInUse
+		}
+
+		return resData
+	}
+
+	return nil
+}
+
+// Delete is a wrapper around DefaultClient.Delete.
+func Delete(container *schemas.Container) error {
+	return DefaultClient.Delete(context.Background(), container)
+}
+
+// Delete removes the container from the instance.
+func (c *Client) Delete(ctx context.Context, container *schemas.Container) error {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.do(ctx, "DELETE", container.Address, "/containers/"+container.ID, nil, "")
 	if err != nil {
 		return err
 	}
@@ -382,20 +898,22 @@ func Delete(container *schemas.Container) error {
 	return nil
 }
 
-// UploadSSH sends the .ssh directory to the container
+// UploadSSH is a wrapper around DefaultClient.UploadSSH.
 func UploadSSH(container *schemas.Container, path string) error {
-	contents, err := tar.Tar(path, []string{})
-	if err != nil {
-		return err
-	}
+	return DefaultClient.UploadSSH(context.Background(), container, path)
+}
 
-	addr := net.JoinHostPort(container.Address, config.DelanceyProdPort)
-	req, err := http.NewRequest("PUT", "http://"+addr+"/ssh", contents)
+// UploadSSH sends the .ssh directory to the container
+func (c *Client) UploadSSH(ctx context.Context, container *schemas.Container, path string) error {
+	contents, err := TarDir(path)
 	if err != nil {
 		return err
 	}
 
-	res, err := http.DefaultClient.Do(req)
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.do(ctx, "PUT", container.Address, "/containers/"+container.ID+"/ssh", contents, "")
 	if err != nil {
 		return err
 	}
@@ -420,12 +938,20 @@ func UploadSSH(container *schemas.Container, path string) error {
 	return nil
 }
 
-// Health checks if a delancey instance is running.
+// Health is a wrapper around DefaultClient.Health.
 func Health(addr string, timeout time.Duration) error {
-	client := &http.Client{Timeout: timeout}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	addr = net.JoinHostPort(addr, config.DelanceyProdPort)
-	res, err := client.Get("http://" + addr + "/healthz")
+	return DefaultClient.Health(ctx, addr)
+}
+
+// Health checks if a delancey instance is running.
+func (c *Client) Health(ctx context.Context, addr string) error {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.do(ctx, "GET", addr, "/healthz", nil, "")
 	if err != nil {
 		return err
 	}
@@ -438,10 +964,18 @@ func Health(addr string, timeout time.Duration) error {
 	return nil
 }
 
-// PullImage tells a delancey instance to pull an image.
+// PullImage is a wrapper around DefaultClient.PullImage.
 func PullImage(addr, image string) error {
-	addr = net.JoinHostPort(addr, config.DelanceyProdPort)
-	res, err := http.PostForm("http://"+addr+"/_/pull", url.Values{"image": {image}})
+	return DefaultClient.PullImage(context.Background(), addr, image)
+}
+
+// PullImage tells a delancey instance to pull an image.
+func (c *Client) PullImage(ctx context.Context, addr, image string) error {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	form := url.Values{"image": {image}}
+	res, err := c.do(ctx, "POST", addr, "/_/pull", strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
 	if err != nil {
 		return err
 	}
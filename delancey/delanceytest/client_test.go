@@ -0,0 +1,129 @@
+// Copyright 2014 Bowery, Inc.
+
+package delanceytest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// newBlockingServer starts a server that doesn't respond until the request
+// is canceled.
+func newBlockingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+}
+
+func TestClientOptions(t *testing.T) {
+	var (
+		path     string
+		username string
+		password string
+	)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		username, password, _ = req.BasicAuth()
+		rw.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &delancey.Client{
+		Scheme:     "https",
+		Port:       port,
+		HTTPClient: server.Client(),
+		Username:   "some-user",
+		Password:   "some-password",
+	}
+
+	// The address doesn't include the port, so the clients is used.
+	err = client.Health(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if path != "/healthz" || username != "some-user" || password != "some-password" {
+		t.Error("Request wasn't sent with the clients options", path, username, password)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := newBlockingServer()
+	defer server.Close()
+
+	client := &delancey.Client{Timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_, err := client.List(context.Background(), server.Listener.Addr().String())
+	if err != context.DeadlineExceeded {
+		t.Error("Expected the request to time out got", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Request should've stopped once the timeout passed")
+	}
+}
+
+func TestClientContextCanceled(t *testing.T) {
+	server := newBlockingServer()
+	defer server.Close()
+	addr := server.Listener.Addr().String()
+
+	// Retries stop once the context is canceled too.
+	client := &delancey.Client{Retry: delancey.DefaultRetryPolicy}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := client.List(ctx, addr)
+	if err != context.Canceled {
+		t.Error("Expected the request to be canceled got", err)
+	}
+
+	_, err = client.ResumeSession(ctx, &schemas.Container{ID: "some-id", Address: addr}, "some-session")
+	if err != context.Canceled {
+		t.Error("Expected the session request to be canceled got", err)
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	var clientID string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		clientID = req.Header.Get(delancey.ClientHeader)
+		rw.Header().Set("Content-Type", "text/event-stream")
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+
+	client := &delancey.Client{ID: "some-client"}
+	stream, err := client.Subscribe(context.Background(), server.Listener.Addr().String(), "some-channel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientID != "some-client" {
+		t.Error("Subscription should've been sent with the clients ID, got", clientID)
+	}
+
+	// Closing again doesn't panic.
+	err = stream.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+
+	for range stream.Events {
+	}
+}
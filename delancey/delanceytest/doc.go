@@ -0,0 +1,3 @@
+// Package delanceytest provides an in-memory Delancey instance for testing
+// code that uses the delancey package.
+package delanceytest
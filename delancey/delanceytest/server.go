@@ -0,0 +1,810 @@
+// Copyright 2014 Bowery, Inc.
+
+package delanceytest
+
+import (
+	stdtar "archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/path"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/mux"
+)
+
+// RenameStatus is the status of updates recording a rename in a batch.
+const RenameStatus = "rename"
+
+// ErrPath is used when an update has a path outside of the containers tree.
+var ErrPath = errors.New("The path is outside of the containers tree")
+
+// Update is an update received by the server. Path is relative using
+// forward slashes, From is the old path of a rename. Batch is set if the
+// update was part of a batch.
+type Update struct {
+	Container string
+	Status    string
+	Path      string
+	From      string
+	Batch     bool
+}
+
+// Failure makes requests to a route fail. Method and Route match the
+// request, Route is the agents route template like "/containers/{id}". If
+// Err is ErrInUse, ErrNotInUse or ErrNoJob the request fails like it does
+// on an instance, otherwise it fails with Status, or a 500 if it's not set.
+// If Drop is set the request is applied but the connection is closed
+// before the response is sent. Times is how many requests fail, 0 fails
+// every request.
+type Failure struct {
+	Method string
+	Route  string
+	Status int
+	Err    error
+	Drop   bool
+	Times  int
+}
+
+// Server is an in-memory Delancey instance. Containers are stored in a
+// temporary directory and the updates received are recorded. Like an
+// instance, requests with an idempotency key that succeeded get the same
+// response when they're sent again.
+type Server struct {
+	*httptest.Server
+	Dir        string
+	containers map[string]*schemas.Container
+	jobs       map[string]*delancey.Job
+	updates    []*Update
+	failures   []*Failure
+	results    map[string]*httptest.ResponseRecorder
+	changes    map[string][]chan *delancey.Event
+	nextID     int
+	mutex      sync.Mutex
+}
+
+// NewServer starts a server, Close has to be called to stop it and remove
+// its directory.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		Dir:        dir,
+		containers: make(map[string]*schemas.Container),
+		jobs:       make(map[string]*delancey.Job),
+		results:    make(map[string]*httptest.ResponseRecorder),
+		changes:    make(map[string][]chan *delancey.Event),
+	}
+
+	router := mux.NewRouter()
+	server.handle(router, "GET", "/healthz", server.healthzHandler)
+	server.handle(router, "GET", "/containers", server.listHandler)
+	server.handle(router, "POST", "/containers", server.createHandler)
+	server.handle(router, "PUT", "/containers/{id}", server.uploadHandler)
+	server.handle(router, "PATCH", "/containers/{id}", server.updateHandler)
+	server.handle(router, "DELETE", "/containers/{id}", server.deleteHandler)
+	server.handle(router, "PATCH", "/containers/{id}/batch", server.batchHandler)
+	server.handle(router, "GET", "/containers/{id}/manifest", server.manifestHandler)
+	server.handle(router, "GET", "/containers/{id}/changes", server.changesHandler)
+	server.handle(router, "PUT", "/containers/{id}/save", server.updatedHandler)
+	server.handle(router, "PUT", "/containers/{id}/ssh", server.sshHandler)
+	server.handle(router, "POST", "/containers/{id}/stop", server.updatedHandler)
+	server.handle(router, "POST", "/containers/{id}/start", server.updatedHandler)
+	server.handle(router, "POST", "/containers/{id}/restart", server.updatedHandler)
+	server.handle(router, "GET", "/jobs/{id}", server.jobHandler)
+	server.handle(router, "POST", "/_/pull", server.pullHandler)
+	server.Server = httptest.NewServer(router)
+
+	return server, nil
+}
+
+// Close stops the server and removes its directory.
+func (s *Server) Close() error {
+	s.Server.Close()
+	return os.RemoveAll(s.Dir)
+}
+
+// Address gets the address clients use to reach the server.
+func (s *Server) Address() string {
+	return s.Listener.Addr().String()
+}
+
+// NewContainer creates a container to create on the server, its address is
+// the servers.
+func (s *Server) NewContainer(id string) *schemas.Container {
+	return &schemas.Container{ID: id, Address: s.Address()}
+}
+
+// AddContainer adds a container to the server as if it were created. The
+// container is updated with the servers address and its path.
+func (s *Server) AddContainer(container *schemas.Container) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.add(container)
+}
+
+// Container retrieves a container on the server, nil is returned if it
+// doesn't exist.
+func (s *Server) Container(id string) *schemas.Container {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.containers[id]
+}
+
+// Path gets the full path for a path in a containers tree on the server.
+func (s *Server) Path(id, rel string) string {
+	return filepath.Join(s.Dir, id, path.RelSystem(rel))
+}
+
+// Updates retrieves the updates received in the order they were applied.
+func (s *Server) Updates() []*Update {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]*Update{}, s.updates...)
+}
+
+// ClearUpdates forgets the updates received.
+func (s *Server) ClearUpdates() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.updates = nil
+}
+
+// SendChange sends a change to the clients watching a containers changes.
+func (s *Server) SendChange(id string, change *delancey.RemoteChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	s.SendEvent(id, &delancey.Event{Name: delancey.ChangeEvent, Data: string(data)})
+	return nil
+}
+
+// SendEvent sends an event to the clients watching a containers changes. If
+// it's a ResyncEvent the streams end after it like on an instance.
+func (s *Server) SendEvent(id string, event *delancey.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, events := range s.changes[id] {
+		events <- event
+		if event.Name == delancey.ResyncEvent {
+			close(events)
+		}
+	}
+	if event.Name == delancey.ResyncEvent {
+		delete(s.changes, id)
+	}
+}
+
+// Fail makes the requests matching the failure fail.
+func (s *Server) Fail(failure *Failure) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failures = append(s.failures, failure)
+}
+
+// ClearFailures removes the failures, so requests succeed again.
+func (s *Server) ClearFailures() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failures = nil
+}
+
+// handle adds a route to the router, requests to it fail if a failure
+// matches.
+func (s *Server) handle(router *mux.Router, method, route string, handler http.HandlerFunc) {
+	router.HandleFunc(route, func(rw http.ResponseWriter, req *http.Request) {
+		failure := s.failure(method, route)
+		if failure == nil {
+			s.serve(rw, req, handler)
+			return
+		}
+
+		if failure.Drop {
+			s.serve(httptest.NewRecorder(), req, handler)
+
+			hijacker, ok := rw.(http.Hijacker)
+			if !ok {
+				return
+			}
+			conn, _, err := hijacker.Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+
+		status := failure.Status
+		switch failure.Err {
+		case delancey.ErrInUse, delancey.ErrNotInUse, delancey.ErrNoJob:
+			status = http.StatusBadRequest
+		}
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+
+		msg := http.StatusText(status)
+		if failure.Err != nil {
+			msg = failure.Err.Error()
+		}
+		renderJSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  msg,
+		})
+	}).Methods(method)
+}
+
+// serve runs the handler for a request. If the request has an idempotency
+// key that already succeeded the response is sent again instead.
+func (s *Server) serve(rw http.ResponseWriter, req *http.Request, handler http.HandlerFunc) {
+	key := req.Header.Get(delancey.IdempotencyKeyHeader)
+	if key == "" {
+		handler(rw, req)
+		return
+	}
+	key = req.Method + " " + req.URL.Path + " " + key
+
+	s.mutex.Lock()
+	result, ok := s.results[key]
+	s.mutex.Unlock()
+	if !ok {
+		result = httptest.NewRecorder()
+		handler(result, req)
+
+		if result.Code >= 200 && result.Code < 300 {
+			s.mutex.Lock()
+			s.results[key] = result
+			s.mutex.Unlock()
+		}
+	}
+
+	for name, values := range result.Header() {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(result.Code)
+	rw.Write(result.Body.Bytes())
+}
+
+// failure finds the failure for a request, counting it against the
+// failures times.
+func (s *Server) failure(method, route string) *Failure {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, failure := range s.failures {
+		if failure.Method != method || failure.Route != route {
+			continue
+		}
+
+		if failure.Times > 0 {
+			failure.Times--
+			if failure.Times == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+
+		return failure
+	}
+
+	return nil
+}
+
+// add adds a container, ErrInUse is returned if it already exists.
+func (s *Server) add(container *schemas.Container) error {
+	if _, ok := s.containers[container.ID]; ok {
+		return delancey.ErrInUse
+	}
+
+	root := filepath.Join(s.Dir, container.ID)
+	err := os.MkdirAll(root, os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	s.nextID++
+	container.Address = s.Address()
+	container.RemotePath = root
+	container.DockerID = "container-" + strconv.Itoa(s.nextID)
+	s.containers[container.ID] = container
+	return nil
+}
+
+// get retrieves the container for a request.
+func (s *Server) get(req *http.Request) *schemas.Container {
+	return s.Container(mux.Vars(req)["id"])
+}
+
+// record adds updates to the ones received.
+func (s *Server) record(updates ...*Update) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.updates = append(s.updates, updates...)
+}
+
+// GET /healthz, Check the server is running.
+func (s *Server) healthzHandler(rw http.ResponseWriter, req *http.Request) {
+	io.WriteString(rw, "ok")
+}
+
+// GET /containers, List the containers.
+func (s *Server) listHandler(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	list := make([]*schemas.Container, 0, len(s.containers))
+	for _, container := range s.containers {
+		list = append(list, container)
+	}
+	s.mutex.Unlock()
+
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusSuccess,
+		"containers": list,
+	})
+}
+
+// POST /containers, Create a container. The job returned has already
+// succeeded.
+func (s *Server) createHandler(rw http.ResponseWriter, req *http.Request) {
+	containerReq := new(requests.DockerfileContainerReq)
+	err := json.NewDecoder(req.Body).Decode(containerReq)
+	if err != nil {
+		renderError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mutex.Lock()
+	err = s.add(containerReq.Container)
+	if err != nil {
+		s.mutex.Unlock()
+		renderError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	job := &delancey.Job{
+		ID:        "job-" + strconv.Itoa(s.nextID),
+		Status:    delancey.JobSucceeded,
+		Progress:  1,
+		Container: containerReq.Container,
+	}
+	s.jobs[job.ID] = job
+	s.mutex.Unlock()
+
+	renderJSON(rw, http.StatusAccepted, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"job":    job,
+	})
+}
+
+// GET /jobs/{id}, Retrieve a job.
+func (s *Server) jobHandler(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	job, ok := s.jobs[mux.Vars(req)["id"]]
+	s.mutex.Unlock()
+	if !ok {
+		renderError(rw, http.StatusNotFound, delancey.ErrNoJob)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"job":    job,
+	})
+}
+
+// PUT /containers/{id}, Upload the containers tree as a gzipped tar.
+func (s *Server) uploadHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	_, err := untar(req.Body, container.RemotePath)
+	if err != nil {
+		renderError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// PATCH /containers/{id}, Update a single path.
+func (s *Server) updateHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+	typ := req.FormValue("type")
+	rel := req.FormValue("path")
+	if typ == "" || rel == "" {
+		renderError(rw, http.StatusBadRequest, errors.New("Missing form fields."))
+		return
+	}
+
+	full, err := resolve(container.RemotePath, rel)
+	if err != nil {
+		renderError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if typ == delancey.DeleteStatus {
+		err = os.RemoveAll(full)
+	} else {
+		mode, _ := strconv.ParseUint(req.FormValue("mode"), 10, 32)
+		err = writeUpload(req, full, req.FormValue("pathtype"), os.FileMode(mode))
+	}
+	if err != nil {
+		renderError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	s.record(&Update{Container: container.ID, Status: typ, Path: path.RelUnix(rel)})
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// PATCH /containers/{id}/batch, Update a batch of paths. Deletes are
+// applied first, then renames, and finally the paths in the tar.
+func (s *Server) batchHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	manifest := new(delancey.BatchManifest)
+	if data := req.FormValue("manifest"); data != "" {
+		err := json.Unmarshal([]byte(data), manifest)
+		if err != nil {
+			renderError(rw, http.StatusBadRequest, err)
+			return
+		}
+	}
+	updates := make([]*Update, 0)
+
+	for _, rel := range manifest.Deletes {
+		full, err := resolve(container.RemotePath, rel)
+		if err == nil {
+			err = os.RemoveAll(full)
+		}
+		if err != nil {
+			renderBatchError(rw, rel, err)
+			return
+		}
+
+		updates = append(updates, &Update{Status: delancey.DeleteStatus, Path: rel})
+	}
+
+	for _, rename := range manifest.Renames {
+		from, err := resolve(container.RemotePath, rename.From)
+		if err != nil {
+			renderBatchError(rw, rename.From, err)
+			return
+		}
+		to, err := resolve(container.RemotePath, rename.To)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(to), os.ModePerm|os.ModeDir)
+		}
+		if err == nil {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			renderBatchError(rw, rename.To, err)
+			return
+		}
+
+		updates = append(updates, &Update{Status: RenameStatus, Path: rename.To, From: rename.From})
+	}
+
+	applied := make([]string, 0)
+	file, _, err := req.FormFile("tar")
+	if err == nil {
+		defer file.Close()
+
+		applied, err = untar(file, container.RemotePath)
+		if err != nil {
+			renderError(rw, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	for _, rel := range applied {
+		updates = append(updates, &Update{Status: delancey.UpdateStatus, Path: rel})
+	}
+
+	for _, update := range updates {
+		update.Container = container.ID
+		update.Batch = true
+	}
+	s.record(updates...)
+
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"applied": applied,
+		"failed":  []*delancey.BatchFailure{},
+	})
+}
+
+// GET /containers/{id}/manifest, Retrieve the manifest of the containers
+// tree.
+func (s *Server) manifestHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	manifest, err := delancey.BuildManifest(container.RemotePath)
+	if err != nil {
+		renderError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusSuccess,
+		"manifest": manifest,
+	})
+}
+
+// DELETE /containers/{id}, Remove a container and its tree.
+func (s *Server) deleteHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	s.mutex.Lock()
+	delete(s.containers, container.ID)
+	s.mutex.Unlock()
+
+	err := os.RemoveAll(container.RemotePath)
+	if err != nil {
+		renderError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusRemoved,
+	})
+}
+
+// PUT /containers/{id}/ssh, Accept the containers ssh directory.
+func (s *Server) sshHandler(rw http.ResponseWriter, req *http.Request) {
+	if s.get(req) == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// GET /containers/{id}/changes, Stream the changes sent with SendChange.
+func (s *Server) changesHandler(rw http.ResponseWriter, req *http.Request) {
+	container := s.get(req)
+	if container == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		renderError(rw, http.StatusInternalServerError, errors.New("Streaming isn't supported"))
+		return
+	}
+
+	// Events are buffered so senders don't wait on the client.
+	events := make(chan *delancey.Event, 64)
+	s.mutex.Lock()
+	s.changes[container.ID] = append(s.changes[container.ID], events)
+	s.mutex.Unlock()
+	defer s.unsubscribe(container.ID, events)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			fmt.Fprintf(rw, "event: %s\n", event.Name)
+			for _, line := range strings.Split(event.Data, "\n") {
+				fmt.Fprintf(rw, "data: %s\n", line)
+			}
+			fmt.Fprint(rw, "\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// unsubscribe stops sending changes to a stream, if it's still open.
+func (s *Server) unsubscribe(id string, events chan *delancey.Event) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	streams := s.changes[id]
+	for i, stream := range streams {
+		if stream == events {
+			s.changes[id] = append(streams[:i], streams[i+1:]...)
+			break
+		}
+	}
+}
+
+// updatedHandler responds to saves and lifecycle actions, they don't change
+// anything on the server.
+func (s *Server) updatedHandler(rw http.ResponseWriter, req *http.Request) {
+	if s.get(req) == nil {
+		renderError(rw, http.StatusBadRequest, delancey.ErrNotInUse)
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// POST /_/pull, Pull an image.
+func (s *Server) pullHandler(rw http.ResponseWriter, req *http.Request) {
+	if req.FormValue("image") == "" {
+		renderError(rw, http.StatusBadRequest, errors.New("Image query param required"))
+		return
+	}
+
+	renderJSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusSuccess,
+	})
+}
+
+// writeUpload writes the path from an update request.
+func writeUpload(req *http.Request, full, pathType string, mode os.FileMode) error {
+	if pathType == "dir" {
+		return os.MkdirAll(full, mode|os.ModeDir)
+	}
+
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	dest, err := os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	_, err = io.Copy(dest, file)
+	return err
+}
+
+// untar extracts a gzipped tar to the root, the paths extracted are
+// returned.
+func untar(r io.Reader, root string) ([]string, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := stdtar.NewReader(gzipReader)
+	extracted := make([]string, 0)
+
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				return extracted, nil
+			}
+
+			return nil, err
+		}
+		rel := strings.TrimPrefix(header.Name, "./")
+		full, err := resolve(root, rel)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+		if err != nil {
+			return nil, err
+		}
+		info := header.FileInfo()
+
+		switch header.Typeflag {
+		case stdtar.TypeDir:
+			err = os.MkdirAll(full, info.Mode()|os.ModeDir)
+		case stdtar.TypeSymlink:
+			os.RemoveAll(full)
+			err = os.Symlink(header.Linkname, full)
+		case stdtar.TypeReg, stdtar.TypeRegA:
+			var dest *os.File
+			dest, err = os.OpenFile(full, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+			if err == nil {
+				_, err = io.Copy(dest, tarReader)
+				dest.Close()
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		extracted = append(extracted, strings.TrimSuffix(path.RelUnix(rel), "/"))
+	}
+}
+
+// resolve gets the full path for a relative path in the root, ErrPath is
+// returned if it's outside of the root.
+func resolve(root, rel string) (string, error) {
+	rel = filepath.Clean(path.RelSystem(rel))
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrPath
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// renderJSON writes a JSON response.
+func renderJSON(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(body)
+}
+
+// renderError writes a failed response with the error.
+func renderError(rw http.ResponseWriter, status int, err error) {
+	renderJSON(rw, status, map[string]string{
+		"status": requests.StatusFailed,
+		"error":  err.Error(),
+	})
+}
+
+// renderBatchError writes a failed batch response with the path that
+// failed.
+func renderBatchError(rw http.ResponseWriter, rel string, err error) {
+	renderJSON(rw, http.StatusBadRequest, map[string]interface{}{
+		"status": requests.StatusFailed,
+		"error":  err.Error(),
+		"failed": []*delancey.BatchFailure{{Path: rel, Error: err.Error()}},
+	})
+}
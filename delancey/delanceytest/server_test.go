@@ -0,0 +1,730 @@
+// Copyright 2014 Bowery, Inc.
+package delanceytest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+func TestCreateAndUpdate(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = delancey.Create(container, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = delancey.Create(server.NewContainer("some-id"), "")
+	if err != delancey.ErrInUse {
+		t.Error("Creating the container again should've failed with ErrInUse")
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	full := filepath.Join(dir, "file")
+
+	err = ioutil.WriteFile(full, []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = delancey.Update(container, full, "file", delancey.CreateStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(server.Path(container.ID, "file"))
+	if err != nil || string(contents) != "contents" {
+		t.Error("Updated file should've been written to the containers tree")
+	}
+
+	updates := server.Updates()
+	if len(updates) != 1 || updates[0].Path != "file" || updates[0].Status != delancey.CreateStatus {
+		t.Error("Update wasn't recorded")
+	}
+}
+
+func TestBatchUpdate(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(server.Path(container.ID, "old"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	full := filepath.Join(dir, "new")
+
+	err = ioutil.WriteFile(full, []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = delancey.BatchUpdateWithManifest(container, map[string]string{full: "new"},
+		&delancey.BatchManifest{Deletes: []string{"old"}}, make(chan error, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(server.Path(container.ID, "old")); !os.IsNotExist(err) {
+		t.Error("Deleted path should've been removed")
+	}
+
+	updates := server.Updates()
+	if len(updates) != 2 || updates[0].Status != delancey.DeleteStatus || updates[1].Path != "new" ||
+		!updates[1].Batch {
+		t.Error("Batch updates weren't recorded in the order they were applied")
+	}
+}
+
+func TestFail(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Fail(&Failure{Method: "PUT", Route: "/containers/{id}/save", Err: delancey.ErrNotInUse, Times: 1})
+	err = delancey.Save(container)
+	if err != delancey.ErrNotInUse {
+		t.Error("Save should've failed with ErrNotInUse")
+	}
+
+	err = delancey.Save(container)
+	if err != nil {
+		t.Error("Save should've succeeded after the failure was used")
+	}
+
+	server.Fail(&Failure{Method: "DELETE", Route: "/containers/{id}"})
+	err = delancey.Delete(container)
+	if err == nil {
+		t.Error("Delete should've failed but didn't")
+	}
+
+	server.ClearFailures()
+	err = delancey.Delete(container)
+	if err != nil {
+		t.Error("Delete should've succeeded after clearing the failures")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	full := filepath.Join(dir, "file")
+
+	err = ioutil.WriteFile(full, []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Status: http.StatusServiceUnavailable, Times: 1})
+	err = delancey.Update(container, full, "file", delancey.CreateStatus)
+	if err == nil {
+		t.Error("Update should've failed without a retry policy")
+	}
+
+	client := &delancey.Client{Retry: &delancey.RetryPolicy{Retries: 2, Delay: time.Millisecond}}
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Status: http.StatusServiceUnavailable, Times: 2})
+	err = client.Update(context.Background(), container, full, "file", delancey.CreateStatus)
+	if err != nil {
+		t.Error("Update should've succeeded after retrying", err)
+	}
+
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Status: http.StatusServiceUnavailable, Times: 3})
+	err = client.Update(context.Background(), container, full, "file", delancey.CreateStatus)
+	if err == nil {
+		t.Error("Update should've failed once the retries ran out")
+	}
+}
+
+func TestIdempotentCreate(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The first create is applied but its response is lost, so the retry
+	// has to get the original job instead of ErrInUse.
+	client := &delancey.Client{Retry: &delancey.RetryPolicy{Retries: 2, Delay: time.Millisecond}}
+	server.Fail(&Failure{Method: "POST", Route: "/containers", Drop: true, Times: 1})
+	err = client.Create(context.Background(), server.NewContainer("some-id"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.Container("some-id") == nil {
+		t.Error("Container should've been created")
+	}
+
+	server.Fail(&Failure{Method: "PUT", Route: "/containers/{id}/save", Drop: true, Times: 1})
+	err = client.Save(context.Background(), server.Container("some-id"))
+	if err != nil {
+		t.Error("Save should've succeeded after retrying", err)
+	}
+}
+
+func TestIdempotentUpdate(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	full := filepath.Join(dir, "file")
+
+	err = ioutil.WriteFile(full, []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first update is applied but its response is lost, so the retry
+	// has to get its result instead of applying it again.
+	client := &delancey.Client{Retry: &delancey.RetryPolicy{Retries: 2, Delay: time.Millisecond}}
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Drop: true, Times: 1})
+	err = client.Update(context.Background(), container, full, "file", delancey.CreateStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updates := server.Updates(); len(updates) != 1 {
+		t.Error("Update should've been applied once, applied", len(updates))
+	}
+}
+
+func TestBatchUpdateUncleanPaths(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{delancey.IgnoreFile: "ignored\n", "ignored": "ignored", "new": "new"}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Missing paths are skipped without an error channel.
+	paths := map[string]string{
+		dir + "/./ignored":         "ignored",
+		dir + "//new":              "new",
+		filepath.Join(dir, "gone"): "gone",
+	}
+	err = delancey.BatchUpdate(container, paths, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := server.Updates()
+	if len(updates) != 1 || updates[0].Path != "new" {
+		t.Error("Only the path that isn't ignored should've been updated", updates)
+	}
+}
+
+func TestSyncSkipsIgnored(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.MkdirAll(filepath.Join(dir, "node_modules", "dep"), os.ModePerm|os.ModeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		delancey.IgnoreFile: "node_modules\n",
+		"file":              "contents",
+		filepath.Join("node_modules", "dep", "file"): "dep",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = delancey.Sync(container, dir, make(chan error, len(files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	synced := false
+	for _, update := range server.Updates() {
+		if update.Path == "file" {
+			synced = true
+		}
+		if strings.HasPrefix(update.Path, "node_modules") {
+			t.Error("Ignored path was synced", update.Path)
+		}
+	}
+	if !synced {
+		t.Error("File should've been synced")
+	}
+}
+
+func TestWatchRemoteRejectsEscapes(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local")
+	outside := filepath.Join(dir, "outside")
+	for _, path := range []string{local, outside} {
+		err = os.MkdirAll(path, os.ModePerm|os.ModeDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A local symlink pointing outside of the tree.
+	err = os.Symlink(outside, filepath.Join(local, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorChan := make(chan error, 10)
+	watcher, err := delancey.WatchRemote(container, local, errorChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	symlink := &delancey.ManifestEntry{Type: delancey.SymlinkType}
+	file := &delancey.ManifestEntry{Type: delancey.FileType, Mode: 0644, ModTime: time.Now()}
+	cases := []struct {
+		change   *delancey.RemoteChange
+		expected error
+	}{
+		{&delancey.RemoteChange{Path: "abs", Entry: symlink, Linkname: outside}, delancey.ErrChangeLink},
+		{&delancey.RemoteChange{Path: "up", Entry: symlink, Linkname: "../outside"}, delancey.ErrChangeLink},
+		{&delancey.RemoteChange{Path: "l", Entry: symlink, Linkname: "."}, nil},
+		{&delancey.RemoteChange{Path: "esc", Entry: symlink, Linkname: "l/.."}, delancey.ErrChangeLink},
+		{&delancey.RemoteChange{Path: "out/file", Entry: file, Contents: []byte("contents")}, delancey.ErrChangePath},
+		{&delancey.RemoteChange{Path: "out", Deleted: true}, nil},
+	}
+
+	for _, c := range cases {
+		err = server.SendChange(container.ID, c.change)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.expected == nil {
+			continue
+		}
+
+		select {
+		case err := <-errorChan:
+			batchErr, ok := err.(*delancey.BatchError)
+			if !ok || batchErr.Path != c.change.Path || batchErr.Err != c.expected {
+				t.Error("Change", c.change.Path, "should've been rejected with", c.expected, "got", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Change", c.change.Path, "wasn't rejected")
+		}
+	}
+
+	// Wait for the last change to be applied.
+	deadline := time.Now().Add(5 * time.Second)
+	for !watcher.Applied("out", nil) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, rel := range []string{"abs", "up", "esc"} {
+		if _, err := os.Lstat(filepath.Join(local, rel)); !os.IsNotExist(err) {
+			t.Error("Rejected symlink", rel, "shouldn't have been created")
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(local, "l")); err != nil {
+		t.Error("Symlink inside of the tree should've been created")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Error("File shouldn't have been written outside of the tree")
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Error("Deleting the symlink shouldn't remove its target")
+	}
+}
+
+func TestWatchRemoteResync(t *testing.T) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	errorChan := make(chan error, 10)
+	watcher, err := delancey.WatchRemote(container, dir, errorChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	server.SendEvent(container.ID, &delancey.Event{Name: delancey.ResyncEvent})
+	select {
+	case err := <-errorChan:
+		if err != delancey.ErrChangesMissed {
+			t.Error("Expected missed changes got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Missed changes weren't reported")
+	}
+}
+
+// newWatchedServer starts a server with a container and a local directory
+// for watcher tests.
+func newWatchedServer(t *testing.T) (*Server, *schemas.Container, string) {
+	server, err := NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := server.NewContainer("some-id")
+	err = server.AddContainer(container)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "delanceytest")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	return server, container, dir
+}
+
+// waitForUpdate waits for an update to the path to be received.
+func waitForUpdate(t *testing.T, server *Server, rel string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, update := range server.Updates() {
+			if update.Path == rel {
+				return
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("Update to", rel, "wasn't received")
+}
+
+func TestWatcherCoalesces(t *testing.T) {
+	server, container, dir := newWatchedServer(t)
+	defer server.Close()
+	defer os.RemoveAll(dir)
+
+	watcher, err := delancey.NewWatcher(container, dir, &delancey.WatcherOptions{Delay: 200 * time.Millisecond}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		waitForUpdate(t, server, name)
+	}
+
+	updates := server.Updates()
+	if len(updates) != len(names) {
+		t.Fatal("Each path should've been sent once", len(updates))
+	}
+	for _, update := range updates {
+		if !update.Batch || update.Status != delancey.UpdateStatus {
+			t.Error("Burst of changes should've been sent as a batch", update.Path)
+		}
+	}
+}
+
+func TestWatcherDropsCreatedAndDeleted(t *testing.T) {
+	server, container, dir := newWatchedServer(t)
+	defer server.Close()
+	defer os.RemoveAll(dir)
+
+	opts := &delancey.WatcherOptions{Delay: 200 * time.Millisecond}
+	watcher, err := delancey.NewWatcher(container, dir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if opts.Retries != 0 || opts.RetryDelay != 0 {
+		t.Error("Watcher shouldn't have changed the options")
+	}
+
+	temp := filepath.Join(dir, "temp")
+	err = ioutil.WriteFile(temp, []byte("temp"), 0644)
+	if err == nil {
+		err = os.Remove(temp)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, "keep"), []byte("keep"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForUpdate(t, server, "keep")
+	time.Sleep(2 * opts.Delay)
+
+	for _, update := range server.Updates() {
+		if update.Path == "temp" {
+			t.Error("Path created and deleted before the send shouldn't be sent", update.Status)
+		}
+	}
+
+	// Closing again is safe.
+	watcher.Close()
+}
+
+func TestWatcherRetries(t *testing.T) {
+	server, container, dir := newWatchedServer(t)
+	defer server.Close()
+	defer os.RemoveAll(dir)
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Status: http.StatusServiceUnavailable, Times: 1})
+
+	// The client doesn't retry, so only the watcher does.
+	client := new(delancey.Client)
+	errorChan := make(chan error, 1)
+	watcher, err := client.NewWatcher(context.Background(), container, dir, &delancey.WatcherOptions{
+		Delay:      50 * time.Millisecond,
+		RetryDelay: 10 * time.Millisecond,
+	}, errorChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForUpdate(t, server, "file")
+
+	select {
+	case err := <-errorChan:
+		t.Error("Retried update shouldn't have reported an error", err)
+	default:
+	}
+}
+
+func TestWatcherNoRetryOnBadRequest(t *testing.T) {
+	server, container, dir := newWatchedServer(t)
+	defer server.Close()
+	defer os.RemoveAll(dir)
+	server.Fail(&Failure{Method: "PATCH", Route: "/containers/{id}", Status: http.StatusBadRequest, Times: 1})
+
+	client := new(delancey.Client)
+	errorChan := make(chan error, 1)
+	watcher, err := client.NewWatcher(context.Background(), container, dir, &delancey.WatcherOptions{
+		Delay:      50 * time.Millisecond,
+		RetryDelay: 10 * time.Millisecond,
+	}, errorChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errorChan:
+		if _, ok := err.(*delancey.ServerError); ok {
+			t.Error("Bad request shouldn't be a server error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Bad request should've been reported")
+	}
+
+	for _, update := range server.Updates() {
+		if update.Path == "file" {
+			t.Error("Bad request shouldn't have been retried")
+		}
+	}
+}
+
+func TestWatcherSkipsRemote(t *testing.T) {
+	server, container, dir := newWatchedServer(t)
+	defer server.Close()
+	defer os.RemoveAll(dir)
+
+	remote, err := delancey.WatchRemote(container, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	opts := &delancey.WatcherOptions{Delay: 100 * time.Millisecond, Remote: remote}
+	watcher, err := delancey.NewWatcher(container, dir, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	contents := []byte("remote")
+	sum := sha256.Sum256(contents)
+	err = server.SendChange(container.ID, &delancey.RemoteChange{
+		Path: "remote",
+		Entry: &delancey.ManifestEntry{
+			Path:    "remote",
+			Type:    delancey.FileType,
+			Size:    int64(len(contents)),
+			Mode:    0644,
+			ModTime: time.Now(),
+			Hash:    hex.EncodeToString(sum[:]),
+		},
+		Contents: contents,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the change to be applied before making a local one.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(filepath.Join(dir, "remote")); err == nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "local"), []byte("local"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForUpdate(t, server, "local")
+	time.Sleep(2 * opts.Delay)
+
+	for _, update := range server.Updates() {
+		if update.Path == "remote" {
+			t.Error("Change applied by the remote watcher shouldn't be sent back")
+		}
+	}
+}
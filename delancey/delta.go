@@ -0,0 +1,561 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/Bowery/gopackages/path"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// Block size limits for signatures, the size is picked based on the files
+// size so large files don't have huge signatures.
+const (
+	MinBlockSize = 2 << 10
+	MaxBlockSize = 64 << 10
+)
+
+// Delta operations, a delta is a stream of operations ending with
+// deltaEnd.
+const (
+	deltaEnd     = 0
+	deltaCopy    = 1
+	deltaLiteral = 2
+
+	// Max size of literal data in a single operation.
+	maxLiteral = 64 << 10
+)
+
+// Errors that may occur when transferring deltas.
+var (
+	ErrDeltaBase    = errors.New("The file changed on this Delancey instance since its signature was retrieved")
+	ErrInvalidDelta = errors.New("The delta is invalid")
+)
+
+// BlockSignature contains the checksums for a single block of a file.
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+// Signature describes the blocks of a file so a delta can be created
+// against it. Hash is the hex SHA-256 of the whole file.
+type Signature struct {
+	BlockSize int               `json:"blocksize"`
+	Size      int64             `json:"size"`
+	Hash      string            `json:"sha256"`
+	Blocks    []*BlockSignature `json:"blocks"`
+}
+
+// SignatureRes is the response for retrieving a files signature.
+type SignatureRes struct {
+	*requests.Res
+	Signature *Signature `json:"signature"`
+}
+
+// BlockSize gets the block size to use for a file of the given size.
+func BlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	if blockSize < MinBlockSize {
+		return MinBlockSize
+	}
+	if blockSize > MaxBlockSize {
+		return MaxBlockSize
+	}
+
+	return blockSize
+}
+
+// NewSignature creates the signature for the contents of a reader.
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, ErrInvalidDelta
+	}
+	sig := &Signature{BlockSize: blockSize, Blocks: make([]*BlockSignature, 0)}
+	fileHash := sha256.New()
+	r = io.TeeReader(r, fileHash)
+	block := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			sig.Size += int64(n)
+			sig.Blocks = append(sig.Blocks, &BlockSignature{
+				Weak:   weakSum(block[:n]),
+				Strong: strongSum(block[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sig.Hash = hex.EncodeToString(fileHash.Sum(nil))
+	return sig, nil
+}
+
+// weakSum computes the rolling checksum of a block.
+func weakSum(block []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+
+	return (a & 0xffff) | (b << 16)
+}
+
+// strongSum computes the strong checksum of a block.
+func strongSum(blocks ...[]byte) string {
+	hash := sha256.New()
+	for _, block := range blocks {
+		hash.Write(block)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// deltaWriter writes delta operations, merging consecutive copies.
+type deltaWriter struct {
+	writer    *bufio.Writer
+	literal   []byte
+	copyStart int
+	copyCount int
+}
+
+// copyBlock adds a copy of a block from the base.
+func (dw *deltaWriter) copyBlock(index int) error {
+	err := dw.flushLiteral()
+	if err != nil {
+		return err
+	}
+
+	if dw.copyCount > 0 && dw.copyStart+dw.copyCount == index {
+		dw.copyCount++
+		return nil
+	}
+
+	err = dw.flushCopy()
+	if err != nil {
+		return err
+	}
+	dw.copyStart = index
+	dw.copyCount = 1
+	return nil
+}
+
+// addLiteral adds a literal byte.
+func (dw *deltaWriter) addLiteral(c byte) error {
+	err := dw.flushCopy()
+	if err != nil {
+		return err
+	}
+
+	dw.literal = append(dw.literal, c)
+	if len(dw.literal) >= maxLiteral {
+		return dw.flushLiteral()
+	}
+
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyCount <= 0 {
+		return nil
+	}
+
+	var op [9]byte
+	op[0] = deltaCopy
+	binary.BigEndian.PutUint32(op[1:5], uint32(dw.copyStart))
+	binary.BigEndian.PutUint32(op[5:], uint32(dw.copyCount))
+	dw.copyCount = 0
+	_, err := dw.writer.Write(op[:])
+	return err
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.literal) <= 0 {
+		return nil
+	}
+
+	var op [5]byte
+	op[0] = deltaLiteral
+	binary.BigEndian.PutUint32(op[1:], uint32(len(dw.literal)))
+	_, err := dw.writer.Write(op[:])
+	if err == nil {
+		_, err = dw.writer.Write(dw.literal)
+	}
+	dw.literal = dw.literal[:0]
+	return err
+}
+
+// Close writes the remaining operations and the end of the delta.
+func (dw *deltaWriter) Close() error {
+	err := dw.flushCopy()
+	if err == nil {
+		err = dw.flushLiteral()
+	}
+	if err == nil {
+		err = dw.writer.WriteByte(deltaEnd)
+	}
+	if err != nil {
+		return err
+	}
+
+	return dw.writer.Flush()
+}
+
+// WriteDelta writes the delta between the file described by the signature
+// and the contents of the reader. Blocks that exist in the signature are
+// sent as copies, everything else is sent as literal data.
+func WriteDelta(w io.Writer, sig *Signature, r io.Reader) error {
+	if sig.BlockSize <= 0 {
+		return ErrInvalidDelta
+	}
+	blockSize := sig.BlockSize
+	dw := &deltaWriter{writer: bufio.NewWriter(w), literal: make([]byte, 0, maxLiteral)}
+	reader := bufio.NewReader(r)
+
+	// Index the blocks by their weak checksum.
+	blocks := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+
+	// The window is a ring buffer of the bytes being checked, start is the
+	// oldest byte.
+	window := make([]byte, blockSize)
+	start := 0
+	n, err := io.ReadFull(reader, window)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	window = window[:n]
+	eof := n < blockSize
+	weak := weakSum(window)
+	a, b := weak&0xffff, weak>>16
+
+	for len(window) > 0 {
+		// Check for a matching block.
+		if index, ok := matchBlock(sig, blocks, weak, window, start); ok {
+			err = dw.copyBlock(index)
+			if err != nil {
+				return err
+			}
+
+			window = window[:cap(window)]
+			start = 0
+			if eof {
+				window = window[:0]
+				break
+			}
+
+			n, err = io.ReadFull(reader, window)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			window = window[:n]
+			eof = n < blockSize
+			weak = weakSum(window)
+			a, b = weak&0xffff, weak>>16
+			continue
+		}
+
+		// No match, the oldest byte is literal and the window rolls forward.
+		if !eof {
+			in, err := reader.ReadByte()
+			if err == nil {
+				out := window[start]
+				err = dw.addLiteral(out)
+				if err != nil {
+					return err
+				}
+
+				window[start] = in
+				start = (start + 1) % len(window)
+				a = (a - uint32(out) + uint32(in)) & 0xffff
+				b = (b - uint32(len(window))*uint32(out) + a) & 0xffff
+				weak = a | (b << 16)
+				continue
+			}
+			if err != io.EOF {
+				return err
+			}
+			eof = true
+		}
+
+		// At the end the window can only shrink, so the short last block is
+		// the only one that can still match.
+		tail := make([]byte, 0, len(window))
+		tail = append(tail, window[start:]...)
+		tail = append(tail, window[:start]...)
+		keep := 0
+		if len(sig.Blocks) > 0 {
+			keep = int(blockLength(sig, len(sig.Blocks)-1))
+		}
+		if keep >= len(tail) {
+			keep = 0
+		}
+
+		for _, c := range tail[:len(tail)-keep] {
+			err = dw.addLiteral(c)
+			if err != nil {
+				return err
+			}
+		}
+		window = tail[len(tail)-keep:]
+		start = 0
+		weak = weakSum(window)
+	}
+
+	return dw.Close()
+}
+
+// matchBlock finds the block matching the window.
+func matchBlock(sig *Signature, blocks map[uint32][]int, weak uint32, window []byte, start int) (int, bool) {
+	indexes, ok := blocks[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := ""
+	for _, index := range indexes {
+		if blockLength(sig, index) != int64(len(window)) {
+			continue
+		}
+
+		if strong == "" {
+			strong = strongSum(window[start:], window[:start])
+		}
+		if sig.Blocks[index].Strong == strong {
+			return index, true
+		}
+	}
+
+	return 0, false
+}
+
+// blockLength gets the length of a block, the last block may be short.
+func blockLength(sig *Signature, index int) int64 {
+	offset := int64(index) * int64(sig.BlockSize)
+	if offset+int64(sig.BlockSize) > sig.Size {
+		return sig.Size - offset
+	}
+
+	return int64(sig.BlockSize)
+}
+
+// ApplyDelta reconstructs a file by applying the delta to the base file
+// the signature was created from, writing the result to w.
+func ApplyDelta(w io.Writer, base io.ReaderAt, sig *Signature, delta io.Reader) error {
+	reader := bufio.NewReader(delta)
+	var header [8]byte
+
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = ErrInvalidDelta
+			}
+
+			return err
+		}
+
+		switch op {
+		case deltaEnd:
+			return nil
+		case deltaCopy:
+			_, err = io.ReadFull(reader, header[:8])
+			if err != nil {
+				return ErrInvalidDelta
+			}
+			index := int(binary.BigEndian.Uint32(header[:4]))
+			count := int(binary.BigEndian.Uint32(header[4:8]))
+			if count <= 0 || index+count > len(sig.Blocks) {
+				return ErrInvalidDelta
+			}
+
+			offset := int64(index) * int64(sig.BlockSize)
+			length := blockLength(sig, index+count-1) + int64(count-1)*int64(sig.BlockSize)
+			_, err = io.Copy(w, io.NewSectionReader(base, offset, length))
+			if err != nil {
+				return err
+			}
+		case deltaLiteral:
+			_, err = io.ReadFull(reader, header[:4])
+			if err != nil {
+				return ErrInvalidDelta
+			}
+			length := int64(binary.BigEndian.Uint32(header[:4]))
+			if length > maxLiteral {
+				return ErrInvalidDelta
+			}
+
+			n, err := io.CopyN(w, reader, length)
+			if err != nil {
+				if n < length {
+					return ErrInvalidDelta
+				}
+
+				return err
+			}
+		default:
+			return ErrInvalidDelta
+		}
+	}
+}
+
+// GetSignature is a wrapper around DefaultClient.GetSignature.
+func GetSignature(container *schemas.Container, name string) (*Signature, error) {
+	return DefaultClient.GetSignature(context.Background(), container, name)
+}
+
+// GetSignature retrieves the signature of a path in the container. If the
+// path doesn't exist an empty signature is returned.
+func (c *Client) GetSignature(ctx context.Context, container *schemas.Container, name string) (*Signature, error) {
+	query := url.Values{}
+	query.Set("path", path.RelUnix(name))
+
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "GET", container.Address, "/containers/"+container.ID+"/signature?"+query.Encode(), nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	signatureRes := new(SignatureRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(signatureRes)
+	if err != nil {
+		return nil, err
+	}
+
+	if signatureRes.Status != requests.StatusSuccess {
+		// If the error matches return var.
+		if signatureRes.Error() == ErrNotInUse.Error() {
+			return nil, ErrNotInUse
+		}
+
+		return nil, signatureRes
+	}
+
+	return signatureRes.Signature, nil
+}
+
+// UpdateDelta is a wrapper around DefaultClient.UpdateDelta.
+func UpdateDelta(container *schemas.Container, full, name string) error {
+	return DefaultClient.UpdateDelta(context.Background(), container, full, name)
+}
+
+// UpdateDelta updates the given file to the instance by only sending the
+// blocks that differ from the instances copy. Paths that aren't regular
+// files are sent with Update, and if the instances copy changes during the
+// transfer the full file is sent instead.
+func (c *Client) UpdateDelta(ctx context.Context, container *schemas.Container, full, name string) error {
+	stat, err := os.Stat(full)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return c.Update(ctx, container, full, name, UpdateStatus)
+	}
+
+	sig, err := c.GetSignature(ctx, container, name)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"path": path.RelUnix(name),
+		"mode": strconv.FormatUint(uint64(stat.Mode().Perm()), 10),
+		"base": sig.Hash,
+	}
+	for key, value := range fields {
+		err = writer.WriteField(key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	part, err := writer.CreateFormFile("delta", "delta")
+	if err != nil {
+		return err
+	}
+
+	// The files hash is calculated while the delta is created so the
+	// instance can verify the reconstructed file.
+	fileHash := sha256.New()
+	err = WriteDelta(part, sig, io.TeeReader(file, fileHash))
+	if err != nil {
+		return err
+	}
+
+	err = writer.WriteField("hash", hex.EncodeToString(fileHash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.do(reqCtx, "PATCH", container.Address, "/containers/"+container.ID+"/delta", &body, writer.FormDataContentType())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	resData := new(requests.Res)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		return err
+	}
+
+	if resData.Status != requests.StatusUpdated {
+		// If the error matches return var.
+		switch resData.Error() {
+		case ErrNotInUse.Error():
+			return ErrNotInUse
+		case ErrDeltaBase.Error():
+			return c.Update(ctx, container, full, name, UpdateStatus)
+		}
+
+		return resData
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"testing"
+)
+
+// Block size used by the tests, small so the contents span many blocks.
+const testBlockSize = 16
+
+func TestNewSignature(t *testing.T) {
+	random := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	cases := []struct {
+		name     string
+		contents []byte
+		blocks   int
+	}{
+		{"empty", nil, 0},
+		{"single short block", random[:5], 1},
+		{"whole blocks", random[:64], 4},
+		{"short last block", random, 13},
+	}
+
+	for _, c := range cases {
+		sig, err := NewSignature(bytes.NewReader(c.contents), testBlockSize)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		sum := sha256.Sum256(c.contents)
+		if sig.Size != int64(len(c.contents)) || sig.Hash != hex.EncodeToString(sum[:]) {
+			t.Error(c.name, "signature doesn't describe the contents", sig.Size, sig.Hash)
+		}
+		if len(sig.Blocks) != c.blocks {
+			t.Fatal(c.name, "expected", c.blocks, "blocks got", len(sig.Blocks))
+		}
+
+		if c.blocks > 0 {
+			last := c.contents[(c.blocks-1)*testBlockSize:]
+			block := sig.Blocks[c.blocks-1]
+			if block.Weak != weakSum(last) || block.Strong != strongSum(last) {
+				t.Error(c.name, "last block checksums don't match its contents")
+			}
+		}
+	}
+
+	_, err := NewSignature(bytes.NewReader(random), 0)
+	if err != ErrInvalidDelta {
+		t.Error("Signature without a block size should've failed, got", err)
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := make([]byte, 200)
+	rand.New(rand.NewSource(2)).Read(base)
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	cases := []struct {
+		name     string
+		base     []byte
+		contents []byte
+		maxDelta int // Largest delta expected, zero if it isn't checked.
+	}{
+		{"identical", base, base, 20},
+		{"insertion", base, join(base[:50], []byte("inserted"), base[50:]), 60},
+		{"insertion at the start", base, join([]byte("x"), base), 30},
+		{"appended", base, join(base, []byte("tail")), 30},
+		{"deletion", base, join(base[:40], base[90:]), 40},
+		{"deletion at the end", base, base[:150], 0},
+		{"shifted blocks", base, join(base[96:], base[:96]), 40},
+		{"shifted by bytes", base, join(base[3:], base[:3]), 0},
+		{"empty base", nil, base, 0},
+		{"empty contents", base, nil, 10},
+		{"short last block", base[:testBlockSize+5], join([]byte("ab"), base[:testBlockSize+5]), 30},
+		{"only short block", base[:5], base[:5], 20},
+	}
+
+	for _, c := range cases {
+		sig, err := NewSignature(bytes.NewReader(c.base), testBlockSize)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		var delta bytes.Buffer
+		err = WriteDelta(&delta, sig, bytes.NewReader(c.contents))
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if c.maxDelta > 0 && delta.Len() > c.maxDelta {
+			t.Error(c.name, "delta is larger than expected", delta.Len())
+		}
+
+		var result bytes.Buffer
+		err = ApplyDelta(&result, bytes.NewReader(c.base), sig, &delta)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if !bytes.Equal(result.Bytes(), c.contents) {
+			t.Error(c.name, "applied delta doesn't match the contents")
+		}
+	}
+}
+
+func TestApplyInvalidDelta(t *testing.T) {
+	base := make([]byte, 200)
+	rand.New(rand.NewSource(3)).Read(base)
+	sig, err := NewSignature(bytes.NewReader(base), testBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var valid bytes.Buffer
+	err = WriteDelta(&valid, sig, bytes.NewReader(append([]byte("literal"), base...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		delta []byte
+	}{
+		{"empty", nil},
+		{"missing end", valid.Bytes()[:valid.Len()-1]},
+		{"truncated literal", valid.Bytes()[:8]},
+		{"truncated copy", []byte{deltaCopy, 0, 0, 0}},
+		{"unknown operation", []byte{9, deltaEnd}},
+		{"copy past the blocks", []byte{deltaCopy, 0, 0, 0, 12, 0, 0, 0, 2, deltaEnd}},
+		{"copy of no blocks", []byte{deltaCopy, 0, 0, 0, 0, 0, 0, 0, 0, deltaEnd}},
+		{"literal too large", []byte{deltaLiteral, 0xff, 0xff, 0xff, 0xff, deltaEnd}},
+	}
+
+	for _, c := range cases {
+		var result bytes.Buffer
+		err = ApplyDelta(&result, bytes.NewReader(base), sig, bytes.NewReader(c.delta))
+		if err != ErrInvalidDelta {
+			t.Error(c.name, "should've failed with ErrInvalidDelta, got", err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Bowery/gopackages/path"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// How many times an interrupted download is resumed.
+const downloadRetries = 3
+
+// ErrDownloadChanged is used when an interrupted download can't be resumed
+// because the containers contents changed.
+var ErrDownloadChanged = errors.New("The container changed on this Delancey instance during the download")
+
+// DownloadOptions chooses which paths are downloaded. Path limits the
+// download to a subpath, but entries keep their paths relative to the
+// containers root. Include and Exclude are gitignore style patterns matched
+// against those paths, and if Include is given only matching paths and
+// their contents are downloaded. The containers ignore file is also used
+// to exclude paths unless NoIgnoreFile is set.
+type DownloadOptions struct {
+	Path         string
+	Include      []string
+	Exclude      []string
+	NoIgnoreFile bool
+}
+
+// Download is a wrapper around DefaultClient.Download.
+func Download(container *schemas.Container, opts *DownloadOptions) (io.ReadCloser, error) {
+	return DefaultClient.Download(context.Background(), container, opts)
+}
+
+// Download retrieves the containers contents on the instance as a gzipped
+// tar. The contents are streamed, and if the connection is interrupted the
+// download resumes where it left off as long as the contents haven't
+// changed. The returned reader must be closed.
+func (c *Client) Download(ctx context.Context, container *schemas.Container, opts *DownloadOptions) (io.ReadCloser, error) {
+	if opts == nil {
+		opts = new(DownloadOptions)
+	}
+	query := url.Values{}
+	if opts.Path != "" {
+		query.Set("path", path.RelUnix(opts.Path))
+	}
+	query["include"] = opts.Include
+	query["exclude"] = opts.Exclude
+	if opts.NoIgnoreFile {
+		query.Set("ignorefile", "false")
+	}
+
+	download := &downloadReader{
+		client:   c,
+		ctx:      ctx,
+		addr:     container.Address,
+		endpoint: "/containers/" + container.ID + "?" + query.Encode(),
+	}
+
+	err := download.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return download, nil
+}
+
+// downloadReader reads a download, resuming it using ranges if reading
+// fails.
+type downloadReader struct {
+	client   *Client
+	ctx      context.Context
+	addr     string
+	endpoint string
+	etag     string
+	offset   int64
+	retries  int
+	body     io.ReadCloser
+}
+
+// open requests the download from the current offset.
+func (dr *downloadReader) open() error {
+	req, err := dr.client.newRequest(dr.ctx, "GET", dr.addr, dr.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	if dr.offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(dr.offset, 10)+"-")
+		req.Header.Set("If-Range", dr.etag)
+	}
+
+	res, err := dr.client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK && dr.offset <= 0:
+		dr.etag = res.Header.Get("ETag")
+	case res.StatusCode == http.StatusPartialContent && dr.offset > 0:
+	case res.StatusCode == http.StatusOK:
+		// The full contents were sent so the range wasn't valid anymore.
+		res.Body.Close()
+		return ErrDownloadChanged
+	default:
+		// Decode failure response.
+		defer res.Body.Close()
+		resData := new(requests.Res)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(resData)
+		if err != nil {
+			return err
+		}
+
+		// If the error matches return var.
+		if resData.Error() == ErrNotInUse.Error() {
+			return ErrNotInUse
+		}
+
+		return resData
+	}
+
+	dr.body = res.Body
+	return nil
+}
+
+func (dr *downloadReader) Read(b []byte) (int, error) {
+	n, err := dr.body.Read(b)
+	dr.offset += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	// Resume if possible, otherwise return the read error.
+	if dr.etag == "" || dr.retries >= downloadRetries {
+		return n, err
+	}
+	dr.retries++
+	dr.body.Close()
+
+	resumeErr := dr.open()
+	if resumeErr != nil {
+		dr.body = errReadCloser{resumeErr}
+		return n, resumeErr
+	}
+
+	return n, nil
+}
+
+// Close closes the current response.
+func (dr *downloadReader) Close() error {
+	return dr.body.Close()
+}
+
+// errReadCloser always returns an error when read.
+type errReadCloser struct {
+	err error
+}
+
+func (erc errReadCloser) Read(b []byte) (int, error) {
+	return 0, erc.err
+}
+
+func (erc errReadCloser) Close() error {
+	return nil
+}
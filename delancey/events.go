@@ -0,0 +1,162 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Bowery/gopackages/requests"
+)
+
+// Event names that are sent on a channel. The lifecycle events have the
+// containers info as JSON for the data. ResyncEvent is the last event sent
+// to a stream that fell behind, events before it were missed. Log events
+// are sent on the agent channel with the level, message and fields as JSON.
+const (
+	ProgressEvent = "progress"
+	StepEvent     = "step"
+	CreatedEvent  = "created"
+	UpdatedEvent  = "updated"
+	SavedEvent    = "saved"
+	RemovedEvent  = "removed"
+	ChangeEvent   = "change"
+	ResyncEvent   = "resync"
+	LogEvent      = "log"
+)
+
+// Largest event that can be received, change events include file contents.
+const maxEventSize = 8 << 20
+
+// Event is a message sent on a channel. Progress events have data formatted
+// step:fraction, step events have the name of the step being run.
+type Event struct {
+	Name string `json:"name"`
+	Data string `json:"data"`
+}
+
+// EventStream is a subscription to the events sent on a channel.
+type EventStream struct {
+	Events    <-chan *Event
+	res       *http.Response
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	err       error
+}
+
+// Subscribe is a wrapper around DefaultClient.Subscribe.
+func Subscribe(addr, channel string) (*EventStream, error) {
+	return DefaultClient.Subscribe(context.Background(), addr, channel)
+}
+
+// Subscribe streams the events sent on a channel from the instance at the
+// given address. Container progress is sent on the channel container-<id>.
+func (c *Client) Subscribe(ctx context.Context, addr, channel string) (*EventStream, error) {
+	return c.subscribe(ctx, addr, "/events?channel="+url.QueryEscape(channel))
+}
+
+// subscribe streams the server-sent events from an endpoint on the instance
+// at the address.
+func (c *Client) subscribe(ctx context.Context, addr, endpoint string) (*EventStream, error) {
+	res, err := c.do(ctx, "GET", addr, endpoint, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode failure response.
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		resData := new(requests.Res)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(resData)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, resData
+	}
+
+	events := make(chan *Event)
+	stream := &EventStream{Events: events, res: res, done: make(chan struct{})}
+	go stream.read(events)
+
+	return stream, nil
+}
+
+// Close stops receiving events, the Events channel is closed afterwards.
+// Calling it again returns the first calls error.
+func (stream *EventStream) Close() error {
+	stream.closeOnce.Do(func() {
+		close(stream.done)
+		stream.closeErr = stream.res.Body.Close()
+	})
+
+	return stream.closeErr
+}
+
+// Err returns the error that ended the stream, it should be checked once the
+// Events channel is closed.
+func (stream *EventStream) Err() error {
+	return stream.err
+}
+
+// read parses the server-sent events from the response and sends them across
+// the events channel.
+func (stream *EventStream) read(events chan *Event) {
+	defer close(events)
+	event := new(Event)
+	data := make([]string, 0)
+	scanner := bufio.NewScanner(stream.res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventSize)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Blank lines dispatch the event.
+		if line == "" {
+			if event.Name != "" {
+				event.Data = strings.Join(data, "\n")
+				select {
+				case events <- event:
+				case <-stream.done:
+					return
+				}
+			}
+
+			event = new(Event)
+			data = make([]string, 0)
+			continue
+		}
+
+		// Lines starting with a colon are comments.
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			field = line[:i]
+			value = strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			event.Name = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+
+	// Errors caused by closing the stream aren't reported.
+	select {
+	case <-stream.done:
+	default:
+		stream.err = scanner.Err()
+	}
+}
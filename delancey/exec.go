@@ -0,0 +1,108 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// Output streams a command writes to.
+const (
+	StdoutStream = "stdout"
+	StderrStream = "stderr"
+)
+
+// ExecConfig describes a command to run in a container. If WorkingDir is
+// empty the containers path is used.
+type ExecConfig struct {
+	Cmd        []string `json:"cmd"`
+	Env        []string `json:"env"`
+	WorkingDir string   `json:"workingDir"`
+}
+
+// ExecOutput is a single message streamed while a command runs. The last
+// message has either the exit code or an error.
+type ExecOutput struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Exec is a wrapper around DefaultClient.Exec.
+func Exec(container *schemas.Container, exec *ExecConfig, stdout, stderr io.Writer) (int, error) {
+	return DefaultClient.Exec(context.Background(), container, exec, stdout, stderr)
+}
+
+// Exec runs a command in the container writing its output to stdout and
+// stderr as it's received. The exit code of the command is returned.
+func (c *Client) Exec(ctx context.Context, container *schemas.Container, exec *ExecConfig, stdout, stderr io.Writer) (int, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	err := encoder.Encode(exec)
+	if err != nil {
+		return -1, err
+	}
+
+	res, err := c.do(ctx, "POST", container.Address, "/containers/"+container.ID+"/exec", &body, "application/json")
+	if err != nil {
+		return -1, err
+	}
+	defer res.Body.Close()
+
+	// Decode failure response.
+	if res.StatusCode != http.StatusOK {
+		resData := new(requests.Res)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(resData)
+		if err != nil {
+			return -1, err
+		}
+
+		// If the error matches return var.
+		if resData.Error() == ErrNotInUse.Error() {
+			return -1, ErrNotInUse
+		}
+
+		return -1, resData
+	}
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		output := new(ExecOutput)
+		err = decoder.Decode(output)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+
+			return -1, err
+		}
+
+		if output.Error != "" {
+			return -1, errors.New(output.Error)
+		}
+
+		if output.ExitCode != nil {
+			return *output.ExitCode, nil
+		}
+
+		dest := stdout
+		if output.Stream == StderrStream {
+			dest = stderr
+		}
+
+		_, err = dest.Write(output.Data)
+		if err != nil {
+			return -1, err
+		}
+	}
+}
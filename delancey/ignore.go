@@ -0,0 +1,251 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Bowery/gopackages/tar"
+)
+
+// IgnoreFile is the name of the file listing paths to ignore, it's placed
+// in the root of the tree it applies to.
+const IgnoreFile = ".boweryignore"
+
+// IgnoreFiles are the ignore files used when sending a tree, in the order
+// they're applied.
+var IgnoreFiles = []string{".gitignore", IgnoreFile}
+
+// DefaultIgnores are patterns that are always ignored when sending a tree.
+var DefaultIgnores = []string{".git/"}
+
+// pattern is a single compiled pattern.
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher matches paths against a list of gitignore style patterns. Blank
+// lines and lines starting with # are skipped, a leading ! negates the
+// pattern, a trailing / only matches directories, and patterns without a
+// / match the name at any depth. The last matching pattern wins.
+type Matcher struct {
+	patterns []*pattern
+}
+
+// NewMatcher creates a matcher from a list of patterns.
+func NewMatcher(patterns []string) (*Matcher, error) {
+	matcher := &Matcher{patterns: make([]*pattern, 0, len(patterns))}
+
+	for _, line := range patterns {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pat := new(pattern)
+
+		if strings.HasPrefix(line, "!") {
+			pat.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			pat.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+
+		// Patterns with a slash are relative to the root.
+		prefix := "^(?:.*/)?"
+		if strings.Contains(line, "/") {
+			prefix = "^"
+			line = strings.TrimPrefix(line, "/")
+		}
+
+		re, err := regexp.Compile(prefix + globToRegexp(line) + "$")
+		if err != nil {
+			return nil, err
+		}
+		pat.re = re
+
+		matcher.patterns = append(matcher.patterns, pat)
+	}
+
+	return matcher, nil
+}
+
+// ReadIgnoreFile reads the patterns from an ignore file. A missing file has
+// no patterns.
+func ReadIgnoreFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	patterns := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+
+	return patterns, scanner.Err()
+}
+
+// LoadIgnores creates a matcher for the tree at the root from the default
+// patterns and the ignore files in the root. Ignore files in
+// subdirectories aren't used.
+func LoadIgnores(root string) (*Matcher, error) {
+	patterns := append([]string{}, DefaultIgnores...)
+
+	for _, name := range IgnoreFiles {
+		filePatterns, err := ReadIgnoreFile(filepath.Join(root, name))
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, filePatterns...)
+	}
+
+	return NewMatcher(patterns)
+}
+
+// TarDir creates a gzipped tar of the tree at the root, skipping the paths
+// ignored by the trees ignore files.
+func TarDir(root string) (io.Reader, error) {
+	ignores, err := LoadIgnores(root)
+	if err != nil {
+		return nil, err
+	}
+	body, gzipWriter, tarWriter := tar.NewTarGZ()
+
+	err = filepath.Walk(root, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, full)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if ignores.Match(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		return writeTarPath(tarWriter, info, full, rel)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return body, gzipWriter.Close()
+}
+
+// Match checks if the relative path matches. The path uses forward slashes.
+func (m *Matcher) Match(rel string, isDir bool) bool {
+	matched := false
+	for _, pat := range m.patterns {
+		if pat.negate == !matched || (pat.dirOnly && !isDir) {
+			continue
+		}
+
+		if pat.re.MatchString(rel) {
+			matched = !pat.negate
+		}
+	}
+
+	return matched
+}
+
+// MatchParents checks if the relative path or any of its parents match, so
+// matching a directory matches everything inside of it.
+func (m *Matcher) MatchParents(rel string, isDir bool) bool {
+	for i, c := range rel {
+		if c == '/' && m.Match(rel[:i], true) {
+			return true
+		}
+	}
+
+	return m.Match(rel, isDir)
+}
+
+// Empty checks if the matcher has no patterns.
+func (m *Matcher) Empty() bool {
+	return len(m.patterns) <= 0
+}
+
+// globToRegexp converts a glob to a regular expression. * and ? don't match
+// slashes, but ** matches any number of directories.
+func globToRegexp(glob string) string {
+	var re bytes.Buffer
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/" matches zero or more directories.
+					i++
+					re.WriteString("(?:.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+				continue
+			}
+
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return re.String()
+}
@@ -0,0 +1,99 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	cases := []struct {
+		glob string
+		re   string
+	}{
+		{"*.go", `[^/]*\.go`},
+		{"a?c", `a[^/]c`},
+		{"**/temp", `(?:.*/)?temp`},
+		{"a/**", `a/.*`},
+		{"a/**/b", `a/(?:.*/)?b`},
+		{"[!a]b", `[^a]b`},
+		{"[abc", `\[abc`},
+		{`\*`, `\*`},
+	}
+
+	for _, c := range cases {
+		if re := globToRegexp(c.glob); re != c.re {
+			t.Error(c.glob, "expected", c.re, "got", re)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	cases := []struct {
+		name     string
+		patterns []string
+		rel      string
+		isDir    bool
+		matched  bool
+	}{
+		{"name at any depth", []string{"*.log"}, "a/b/c.log", false, true},
+		{"name doesn't match a suffix", []string{"*.log"}, "c.log.txt", false, false},
+		{"leading slash anchors", []string{"/build"}, "build", true, true},
+		{"leading slash doesn't match nested", []string{"/build"}, "src/build", true, false},
+		{"slash anchors", []string{"docs/*.md"}, "docs/a.md", false, true},
+		{"slash doesn't match nested", []string{"docs/*.md"}, "x/docs/a.md", false, false},
+		{"star doesn't cross directories", []string{"docs/*.md"}, "docs/sub/a.md", false, false},
+		{"leading ** matches the root", []string{"**/temp"}, "temp", false, true},
+		{"leading ** matches nested", []string{"**/temp"}, "a/b/temp", false, true},
+		{"middle ** matches no directories", []string{"a/**/b"}, "a/b", false, true},
+		{"middle ** matches directories", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"middle ** is anchored", []string{"a/**/b"}, "b", false, false},
+		{"trailing ** matches inside", []string{"logs/**"}, "logs/a/b", false, true},
+		{"trailing ** doesn't match the directory", []string{"logs/**"}, "logs", true, false},
+		{"directory only matches directories", []string{"build/"}, "build", true, true},
+		{"directory only skips files", []string{"build/"}, "build", false, false},
+		{"directory only at any depth", []string{"build/"}, "a/build", true, true},
+		{"negation", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation leaves others", []string{"*.log", "!keep.log"}, "other.log", false, true},
+		{"last pattern wins", []string{"*.log", "!keep.log", "keep.log"}, "keep.log", false, true},
+		{"negation alone", []string{"!keep.log"}, "keep.log", false, false},
+		{"negated directory", []string{"*", "!src/"}, "src", true, false},
+		{"negated directory skips files", []string{"*", "!src/"}, "src", false, true},
+		{"comments are skipped", []string{"# comment"}, "# comment", false, false},
+		{"escaped comment", []string{`\#file`}, "#file", false, true},
+		{"trailing spaces are trimmed", []string{"a.txt  "}, "a.txt", false, true},
+	}
+
+	for _, c := range cases {
+		matcher, err := NewMatcher(c.patterns)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		if matcher.Match(c.rel, c.isDir) != c.matched {
+			t.Error(c.name, c.patterns, c.rel, "should match", c.matched)
+		}
+	}
+}
+
+func TestMatcherParents(t *testing.T) {
+	matcher, err := NewMatcher([]string{"build/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if matcher.Match("build/out/a.o", false) {
+		t.Error("Path inside a matched directory shouldn't match itself")
+	}
+	if !matcher.MatchParents("build/out/a.o", false) {
+		t.Error("Path inside a matched directory should match its parents")
+	}
+
+	empty, err := NewMatcher([]string{"", "# comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty.Empty() {
+		t.Error("Matcher without patterns should be empty")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrLinkOutside is used when a symlinks target isn't inside of the root.
+var ErrLinkOutside = errors.New("The symlink points outside of the root")
+
+// CheckLink checks that a symlink at the full path pointing at the target
+// stays inside of the root. The target is resolved from the symlinks real
+// parent directory following the symlinks already in the root, so it can't
+// escape by passing through another symlink.
+func CheckLink(root, full, target string) error {
+	target = filepath.FromSlash(target)
+	if target == "" || filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+		return ErrLinkOutside
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		return err
+	}
+
+	resolved, err := ResolveLinkTarget(dir, target)
+	if err != nil || !IsWithin(realRoot, resolved) {
+		return ErrLinkOutside
+	}
+
+	return nil
+}
+
+// ResolveLinkTarget resolves a symlink target relative to a directory. The
+// target isn't cleaned first since .. elements have to be applied after the
+// symlinks before them are followed. Elements past the part of the target
+// that exists are joined lexically.
+func ResolveLinkTarget(dir, target string) (string, error) {
+	elems := strings.Split(target, string(filepath.Separator))
+
+	for i := len(elems); i > 0; i-- {
+		prefix := dir + string(filepath.Separator) + strings.Join(elems[:i], string(filepath.Separator))
+		resolved, err := filepath.EvalSymlinks(prefix)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, elems[i:]...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+	}
+
+	return filepath.Join(append([]string{dir}, elems...)...), nil
+}
+
+// IsWithin checks if the path is inside of the root or is the root.
+func IsWithin(root, full string) bool {
+	rel, err := filepath.Rel(root, full)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
@@ -0,0 +1,71 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// LogsOptions chooses which logs are retrieved for a container. If Tail is
+// less than 1 all the lines are retrieved, and a zero Since retrieves logs
+// from the beginning.
+type LogsOptions struct {
+	Follow bool
+	Tail   int
+	Since  time.Time
+}
+
+// Logs is a wrapper around DefaultClient.Logs.
+func Logs(container *schemas.Container, opts *LogsOptions) (io.ReadCloser, error) {
+	return DefaultClient.Logs(context.Background(), container, opts)
+}
+
+// Logs retrieves the stdout and stderr logs of the container. If following,
+// the logs are streamed until the returned reader is closed.
+func (c *Client) Logs(ctx context.Context, container *schemas.Container, opts *LogsOptions) (io.ReadCloser, error) {
+	if opts == nil {
+		opts = new(LogsOptions)
+	}
+	query := url.Values{}
+	query.Set("follow", strconv.FormatBool(opts.Follow))
+	if opts.Tail > 0 {
+		query.Set("tail", strconv.Itoa(opts.Tail))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", strconv.FormatInt(opts.Since.Unix(), 10))
+	}
+
+	res, err := c.do(ctx, "GET", container.Address, "/containers/"+container.ID+"/logs?"+query.Encode(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Decode failure response.
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		resData := new(requests.Res)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(resData)
+		if err != nil {
+			return nil, err
+		}
+
+		// If the error matches return var.
+		if resData.Error() == ErrNotInUse.Error() {
+			return nil, ErrNotInUse
+		}
+
+		return nil, resData
+	}
+
+	return res.Body, nil
+}
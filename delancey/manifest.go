@@ -0,0 +1,274 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Bowery/gopackages/path"
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// Path types included in a manifest.
+const (
+	FileType    = "file"
+	DirType     = "dir"
+	SymlinkType = "symlink"
+)
+
+// ManifestEntry describes a single path in a containers tree. Path is
+// relative to the tree using forward slashes, and Hash is the hex SHA-256
+// of a files contents or a symlinks target.
+type ManifestEntry struct {
+	Path    string      `json:"path"`
+	Type    string      `json:"type"`
+	Size    int64       `json:"size"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Hash    string      `json:"sha256,omitempty"`
+}
+
+// Manifest is a list of entries for a tree, sorted by path.
+type Manifest []*ManifestEntry
+
+// Map returns the entries keyed by their path.
+func (m Manifest) Map() map[string]*ManifestEntry {
+	entries := make(map[string]*ManifestEntry, len(m))
+	for _, entry := range m {
+		entries[entry.Path] = entry
+	}
+
+	return entries
+}
+
+// ManifestRes is the response for retrieving a containers manifest.
+type ManifestRes struct {
+	*requests.Res
+	Manifest Manifest `json:"manifest"`
+}
+
+// BuildManifest walks the root and creates a manifest of its contents. Paths
+// other than files, directories and symlinks are skipped.
+func BuildManifest(root string) (Manifest, error) {
+	return BuildManifestIgnoring(root, nil)
+}
+
+// BuildManifestIgnoring creates a manifest like BuildManifest, but paths
+// matching the ignores aren't included and ignored directories aren't
+// walked.
+func BuildManifestIgnoring(root string, ignores *Matcher) (Manifest, error) {
+	manifest := make(Manifest, 0)
+
+	err := filepath.Walk(root, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, full)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		if ignores != nil && ignores.Match(filepath.ToSlash(rel), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		entry, err := NewManifestEntry(full, rel, info)
+		if err == nil && entry != nil {
+			manifest = append(manifest, entry)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// NewManifestEntry creates the manifest entry for a path from its stats. Nil
+// is returned for paths that aren't files, directories or symlinks.
+func NewManifestEntry(full, rel string, info os.FileInfo) (*ManifestEntry, error) {
+	entry := &ManifestEntry{
+		Path:    path.RelUnix(filepath.ToSlash(rel)),
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime().UTC(),
+	}
+
+	switch {
+	case info.IsDir():
+		entry.Type = DirType
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(full)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256([]byte(target))
+		entry.Type = SymlinkType
+		entry.Size = int64(len(target))
+		entry.Hash = hex.EncodeToString(sum[:])
+	case info.Mode().IsRegular():
+		hash, err := hashFile(full)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Type = FileType
+		entry.Size = info.Size()
+		entry.Hash = hash
+	default:
+		return nil, nil
+	}
+
+	return entry, nil
+}
+
+// hashFile gets the hex SHA-256 of a files contents.
+func hashFile(full string) (string, error) {
+	file, err := os.Open(full)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// GetManifest is a wrapper around DefaultClient.GetManifest.
+func GetManifest(container *schemas.Container) (Manifest, error) {
+	return DefaultClient.GetManifest(context.Background(), container)
+}
+
+// GetManifest retrieves the manifest of the containers tree on the instance.
+func (c *Client) GetManifest(ctx context.Context, container *schemas.Container) (Manifest, error) {
+	ctx, cancel := c.timeout(ctx)
+	defer cancel()
+
+	res, err := c.send(ctx, "GET", container.Address, "/containers/"+container.ID+"/manifest", nil, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	manifestRes := new(ManifestRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(manifestRes)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifestRes.Status != requests.StatusSuccess {
+		// If the error matches return var.
+		if manifestRes.Error() == ErrNotInUse.Error() {
+			return nil, ErrNotInUse
+		}
+
+		return nil, manifestRes
+	}
+
+	return manifestRes.Manifest, nil
+}
+
+// Sync is a wrapper around DefaultClient.Sync.
+func Sync(container *schemas.Container, local string, errorChan chan error) error {
+	return DefaultClient.Sync(context.Background(), container, local, errorChan)
+}
+
+// Sync updates the containers tree to match the local directory. The local
+// tree is diffed against the instances manifest, changed paths are sent
+// using BatchUpdateWithManifest, and paths that only exist on the instance
+// are deleted. Paths ignored by the local trees ignore files aren't
+// changed. Skipped paths are sent to the error channel like BatchUpdate.
+func (c *Client) Sync(ctx context.Context, container *schemas.Container, local string, errorChan chan error) error {
+	remote, err := c.GetManifest(ctx, container)
+	if err != nil {
+		return err
+	}
+
+	// Ignored paths are left alone on both sides, locally they aren't walked.
+	ignores, err := LoadIgnores(local)
+	if err != nil {
+		return err
+	}
+
+	current, err := BuildManifestIgnoring(local, ignores)
+	if err != nil {
+		return err
+	}
+	remoteEntries := remote.Map()
+	currentEntries := current.Map()
+
+	// Collect paths that are new or differ from the instance.
+	changed := make(map[string]string)
+	for _, entry := range current {
+		remoteEntry, ok := remoteEntries[entry.Path]
+		if ok && !entryChanged(entry, remoteEntry) {
+			continue
+		}
+
+		changed[filepath.Join(local, filepath.FromSlash(entry.Path))] = entry.Path
+	}
+
+	// Collect paths that no longer exist locally or changed type, only the
+	// top most path needs to be deleted since walking visits children
+	// directly after their parent.
+	deleted := make([]string, 0)
+	for _, entry := range remote {
+		if ignores.MatchParents(entry.Path, entry.Type == DirType) {
+			continue
+		}
+
+		currentEntry, ok := currentEntries[entry.Path]
+		if ok && currentEntry.Type == entry.Type {
+			continue
+		}
+
+		n := len(deleted)
+		if n > 0 && strings.HasPrefix(entry.Path, deleted[n-1]+"/") {
+			continue
+		}
+
+		deleted = append(deleted, entry.Path)
+	}
+
+	if len(changed) <= 0 && len(deleted) <= 0 {
+		return nil
+	}
+
+	// Deletes are applied first so a path changing type can be replaced.
+	return c.BatchUpdateWithManifest(ctx, container, changed, &BatchManifest{Deletes: deleted}, errorChan)
+}
+
+// entryChanged checks if a local entry differs from the remote entry.
+func entryChanged(local, remote *ManifestEntry) bool {
+	if local.Type != remote.Type {
+		return true
+	}
+
+	// Symlink permissions aren't meaningful on every platform.
+	if local.Type != SymlinkType && local.Mode != remote.Mode {
+		return true
+	}
+
+	return local.Size != remote.Size || local.Hash != remote.Hash
+}
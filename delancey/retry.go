@@ -0,0 +1,132 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// IdempotencyKeyHeader is the header requests that aren't idempotent send a
+// key in. If a request is sent again with the same key the instance returns
+// the result of the first one instead of applying it again.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy configures how requests are retried when the connection fails
+// or the instance is unavailable. Requests are retried Retries times,
+// waiting Delay before the first retry and doubling it after each one up to
+// MaxDelay. A zero MaxDelay doesn't limit the delay.
+//
+// Only idempotent requests are retried, and requests that aren't idempotent
+// like Create, Save and updates send an idempotency key so retrying them is
+// safe.
+type RetryPolicy struct {
+	Retries  int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is a retry policy suitable for most clients.
+var DefaultRetryPolicy = &RetryPolicy{
+	Retries:  3,
+	Delay:    250 * time.Millisecond,
+	MaxDelay: 5 * time.Second,
+}
+
+// backoff gets the delay before the given retry, starting at 0.
+func (rp *RetryPolicy) backoff(retry int) time.Duration {
+	delay := rp.Delay
+	for i := 0; i < retry && (rp.MaxDelay <= 0 || delay < rp.MaxDelay); i++ {
+		delay *= 2
+	}
+
+	if rp.MaxDelay > 0 && delay > rp.MaxDelay {
+		delay = rp.MaxDelay
+	}
+	return delay
+}
+
+// newIdempotencyKey creates a random idempotency key.
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key), nil
+}
+
+// retryable checks if a response status means the request didn't reach the
+// instance or it was unavailable.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// send sends an idempotent request to an endpoint on the instance at the
+// address, retrying it using the clients retry policy. The idempotency key
+// is sent if given. The response is read entirely so a connection dropped
+// while reading it is also retried.
+func (c *Client) send(ctx context.Context, method, addr, endpoint string, body []byte, contentType, key string) (*http.Response, error) {
+	policy := c.Retry
+	if policy == nil {
+		policy = new(RetryPolicy)
+	}
+
+	for retry := 0; ; retry++ {
+		res, err := c.sendOnce(ctx, method, addr, endpoint, body, contentType, key)
+		if err == nil && !retryable(res.StatusCode) {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if retry >= policy.Retries {
+			return res, err
+		}
+
+		select {
+		case <-time.After(policy.backoff(retry)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sendOnce sends a request and reads its response.
+func (c *Client) sendOnce(ctx context.Context, method, addr, endpoint string, body []byte, contentType, key string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, addr, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+
+	res, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	contents, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(contents))
+
+	return res, nil
+}
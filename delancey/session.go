@@ -0,0 +1,155 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// SessionRes is the response for retrieving a session.
+type SessionRes struct {
+	*requests.Res
+	Session string `json:"session"`
+	Last    uint64 `json:"last"`
+}
+
+// Session sends updates to a container in order. Updates may be sent
+// concurrently, the instance applies them in the order Update was called.
+// If an update is rejected while later ones are being sent, the later ones
+// fail with ErrSequenceGap and the session should be resumed. Sessions
+// expire on the instance once they're unused for a while, updates in an
+// expired session fail with ErrNoSession.
+type Session struct {
+	ID        string
+	Container *schemas.Container
+	client    *Client
+	seq       uint64
+}
+
+// NewSession is a wrapper around DefaultClient.NewSession.
+func NewSession(container *schemas.Container) (*Session, error) {
+	return DefaultClient.NewSession(context.Background(), container)
+}
+
+// NewSession creates a session for the container with a random ID on the
+// instance. The sessions updates are sent using the client.
+func (c *Client) NewSession(ctx context.Context, container *schemas.Container) (*Session, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{ID: hex.EncodeToString(id), Container: container, client: c}
+
+	// Creating a session again keeps it, so retrying it is safe.
+	_, err = session.request(ctx, "POST")
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// ResumeSession is a wrapper around DefaultClient.ResumeSession.
+func ResumeSession(container *schemas.Container, id string) (*Session, error) {
+	return DefaultClient.ResumeSession(context.Background(), container, id)
+}
+
+// ResumeSession continues an existing session after the last update the
+// instance applied. Updates sent after it that weren't applied have to be
+// sent again. If the instance restarted or the session expired ErrNoSession
+// is returned, and the container should be synced again in a new session.
+func (c *Client) ResumeSession(ctx context.Context, container *schemas.Container, id string) (*Session, error) {
+	session := &Session{ID: id, Container: container, client: c}
+	last, err := session.Last(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session.seq = last
+	return session, nil
+}
+
+// Update updates the given path to the instance as the next update
+// in the session. The sequence number is only taken once the update is
+// ready to send, and it's given back if the instance rejects the update. If
+// the instance can't be reached it's kept, since the update may have been
+// applied.
+func (s *Session) Update(ctx context.Context, full, name, status string) error {
+	body, writer, err := newUpdateBody(full, name, status, new(UpdateOptions))
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint64(&s.seq, 1)
+	err = writeSessionFields(writer, s.ID, seq)
+	if err == nil {
+		err = s.client.sendUpdate(ctx, s.Container, name, body, writer)
+	}
+	if err != nil && rejected(err) {
+		// Only the latest sequence number can be given back, otherwise the
+		// updates after it would be out of order.
+		atomic.CompareAndSwapUint64(&s.seq, seq, seq-1)
+	}
+
+	return err
+}
+
+// rejected checks if an update error came from the instance, so the update
+// wasn't applied.
+func rejected(err error) bool {
+	switch err.(type) {
+	case *ConflictError, *UpdateRes:
+		return true
+	}
+
+	return err == ErrNotInUse || err == ErrNoSession || err == ErrSequenceGap
+}
+
+// Last retrieves the sequence number of the last update the instance
+// applied.
+func (s *Session) Last(ctx context.Context) (uint64, error) {
+	return s.request(ctx, "GET")
+}
+
+// request sends a request for the session and gets its last sequence
+// number.
+func (s *Session) request(ctx context.Context, method string) (uint64, error) {
+	ctx, cancel := s.client.timeout(ctx)
+	defer cancel()
+
+	res, err := s.client.send(ctx, method, s.Container.Address, "/containers/"+s.Container.ID+"/sessions/"+url.QueryEscape(s.ID), nil, "", "")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	sessionRes := new(SessionRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(sessionRes)
+	if err != nil {
+		return 0, err
+	}
+
+	if sessionRes.Status != requests.StatusSuccess {
+		// If the error matches return var.
+		switch sessionRes.Error() {
+		case ErrNotInUse.Error():
+			return 0, ErrNotInUse
+		case ErrNoSession.Error():
+			return 0, ErrNoSession
+		}
+
+		return 0, sessionRes
+	}
+
+	return sessionRes.Last, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Bowery/gopackages/requests"
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/gorilla/websocket"
+	"golang.org/x/term"
+)
+
+// Control message types sent as text messages over a terminal session,
+// binary messages carry the terminal input and output.
+const (
+	ResizeMessage = "resize"
+	ExitMessage   = "exit"
+)
+
+// TerminalMessage is a control message for a terminal session. Resize messages
+// are sent by the client, and an exit message is sent once the shell exits.
+type TerminalMessage struct {
+	Type     string `json:"type"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
+	ExitCode int    `json:"exitCode"`
+}
+
+// TerminalSession is an interactive shell running in a container.
+type TerminalSession struct {
+	conn     *websocket.Conn
+	reader   io.Reader
+	exitCode int
+	mutex    sync.Mutex
+}
+
+// OpenTerminal is a wrapper around DefaultClient.OpenTerminal.
+func OpenTerminal(container *schemas.Container, width, height int) (*TerminalSession, error) {
+	return DefaultClient.OpenTerminal(context.Background(), container, width, height)
+}
+
+// OpenTerminal starts a shell in the container with a TTY of the given size.
+func (c *Client) OpenTerminal(ctx context.Context, container *schemas.Container, width, height int) (*TerminalSession, error) {
+	query := url.Values{}
+	query.Set("width", strconv.Itoa(width))
+	query.Set("height", strconv.Itoa(height))
+
+	conn, res, err := c.dialWebSocket(ctx, container.Address, "/containers/"+container.ID+"/terminal?"+query.Encode())
+	if err != nil {
+		// Decode failure response if the upgrade was rejected.
+		if err == websocket.ErrBadHandshake {
+			defer res.Body.Close()
+			resData := new(requests.Res)
+			decoder := json.NewDecoder(res.Body)
+			err = decoder.Decode(resData)
+			if err != nil {
+				return nil, err
+			}
+
+			// If the error matches return var.
+			if resData.Error() == ErrNotInUse.Error() {
+				return nil, ErrNotInUse
+			}
+
+			return nil, resData
+		}
+
+		return nil, err
+	}
+
+	return &TerminalSession{conn: conn, exitCode: -1}, nil
+}
+
+// Read reads the shells output, io.EOF is returned once the shell exits.
+func (ts *TerminalSession) Read(b []byte) (int, error) {
+	for {
+		if ts.reader != nil {
+			n, err := ts.reader.Read(b)
+			if err != io.EOF {
+				return n, err
+			}
+			ts.reader = nil
+
+			if n > 0 {
+				return n, nil
+			}
+		}
+
+		typ, reader, err := ts.conn.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				err = io.EOF
+			}
+
+			return 0, err
+		}
+
+		if typ == websocket.BinaryMessage {
+			ts.reader = reader
+			continue
+		}
+
+		msg := new(TerminalMessage)
+		decoder := json.NewDecoder(reader)
+		err = decoder.Decode(msg)
+		if err != nil {
+			return 0, err
+		}
+
+		if msg.Type == ExitMessage {
+			ts.exitCode = msg.ExitCode
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write sends input to the shell.
+func (ts *TerminalSession) Write(b []byte) (int, error) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	err := ts.conn.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// Resize changes the size of the shells TTY.
+func (ts *TerminalSession) Resize(width, height int) error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return ts.conn.WriteJSON(&TerminalMessage{Type: ResizeMessage, Width: width, Height: height})
+}
+
+// ExitCode retrieves the exit code of the shell, -1 is returned if the
+// shell hasn't exited.
+func (ts *TerminalSession) ExitCode() int {
+	return ts.exitCode
+}
+
+// Close ends the session, killing the shell if it's still running.
+func (ts *TerminalSession) Close() error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	ts.conn.WriteMessage(websocket.CloseMessage, msg)
+	return ts.conn.Close()
+}
+
+// Terminal is a wrapper around DefaultClient.Terminal.
+func Terminal(container *schemas.Container, in *os.File, out io.Writer) (int, error) {
+	return DefaultClient.Terminal(context.Background(), container, in, out)
+}
+
+// Terminal runs a shell in the container bridged to the local terminal. If
+// in is a terminal it's put into raw mode until the shell exits, and size
+// changes are sent to the container. The exit code of the shell is returned.
+func (c *Client) Terminal(ctx context.Context, container *schemas.Container, in *os.File, out io.Writer) (int, error) {
+	fd := int(in.Fd())
+	isTerm := term.IsTerminal(fd)
+	width, height := 80, 24
+	if isTerm {
+		w, h, err := term.GetSize(fd)
+		if err == nil {
+			width, height = w, h
+		}
+	}
+
+	session, err := c.OpenTerminal(ctx, container, width, height)
+	if err != nil {
+		return -1, err
+	}
+	defer session.Close()
+
+	if isTerm {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return -1, err
+		}
+		defer term.Restore(fd, state)
+
+		stop := watchResize(fd, func(width, height int) {
+			session.Resize(width, height)
+		})
+		defer stop()
+	}
+
+	go io.Copy(session, in)
+	_, err = io.Copy(out, session)
+	if err != nil {
+		return -1, err
+	}
+
+	return session.ExitCode(), nil
+}
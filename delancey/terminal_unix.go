@@ -0,0 +1,41 @@
+// Copyright 2014 Bowery, Inc.
+
+//go:build !windows
+// +build !windows
+
+package delancey
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// watchResize calls resize with the terminals size whenever it changes, it
+// stops once the returned func is called.
+func watchResize(fd int, resize func(width, height int)) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGWINCH)
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+				width, height, err := term.GetSize(fd)
+				if err == nil {
+					resize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
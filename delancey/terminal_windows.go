@@ -0,0 +1,40 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"time"
+
+	"golang.org/x/term"
+)
+
+// How often the terminal size is checked, since there's no signal for it.
+const resizeInterval = 250 * time.Millisecond
+
+// watchResize calls resize with the terminals size whenever it changes, it
+// stops once the returned func is called.
+func watchResize(fd int, resize func(width, height int)) func() {
+	ticker := time.NewTicker(resizeInterval)
+	done := make(chan struct{})
+	prevWidth, prevHeight, _ := term.GetSize(fd)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				width, height, err := term.GetSize(fd)
+				if err == nil && (width != prevWidth || height != prevHeight) {
+					prevWidth, prevHeight = width, height
+					resize(width, height)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	stdtar "archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Bowery/gopackages/path"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// TempPrefix starts the names of temporary files written beside the paths
+// they replace, watchers skip paths with it.
+const TempPrefix = ".delancey-"
+
+// Errors that may occur applying changes.
+var (
+	ErrChangePath    = errors.New("The change has a path outside of the tree")
+	ErrChangeLink    = errors.New("The change has a symlink pointing outside of the tree")
+	ErrChangesMissed = errors.New("Changes to the container were missed, the tree has to be synced again")
+)
+
+// RemoteChange is a change made to a path in a containers tree. Entry
+// describes the new version of the path, unless it was deleted. Files have
+// their contents included, unless they're too large in which case
+// Truncated is set and the file has to be downloaded.
+type RemoteChange struct {
+	Path      string         `json:"path"`
+	Deleted   bool           `json:"deleted,omitempty"`
+	Entry     *ManifestEntry `json:"entry,omitempty"`
+	Linkname  string         `json:"linkname,omitempty"`
+	Contents  []byte         `json:"contents,omitempty"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// RemoteWatcher applies the changes made to a containers tree to a local
+// tree. Changes sent by this client aren't received, and the changes it
+// applies are recorded so local watchers can skip them with Applied.
+type RemoteWatcher struct {
+	client    *Client
+	ctx       context.Context
+	container *schemas.Container
+	local     string
+	ignores   *Matcher
+	stream    *EventStream
+	applied   map[string]*ManifestEntry
+	mutex     sync.Mutex
+}
+
+// WatchRemote is a wrapper around DefaultClient.WatchRemote.
+func WatchRemote(container *schemas.Container, local string, errorChan chan error) (*RemoteWatcher, error) {
+	return DefaultClient.WatchRemote(context.Background(), container, local, errorChan)
+}
+
+// WatchRemote streams the changes made to the containers tree and applies
+// them to the local tree. Errors applying changes are sent to the error
+// channel, including the error that ends the stream. If the instance drops
+// the stream because it fell behind ErrChangesMissed is sent, and the local
+// tree has to be synced with the container again. Changes written by the
+// same client aren't streamed back.
+func (c *Client) WatchRemote(ctx context.Context, container *schemas.Container, local string, errorChan chan error) (*RemoteWatcher, error) {
+	ignores, err := LoadIgnores(local)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := c.subscribe(ctx, container.Address, "/containers/"+container.ID+"/changes")
+	if err != nil {
+		return nil, err
+	}
+
+	watcher := &RemoteWatcher{
+		client:    c,
+		ctx:       ctx,
+		container: container,
+		local:     local,
+		ignores:   ignores,
+		stream:    stream,
+		applied:   make(map[string]*ManifestEntry),
+	}
+	go watcher.run(errorChan)
+
+	return watcher, nil
+}
+
+// Close stops receiving changes.
+func (rw *RemoteWatcher) Close() error {
+	return rw.stream.Close()
+}
+
+// Applied checks if the path's current version was applied from a change,
+// a nil entry is a deleted path.
+func (rw *RemoteWatcher) Applied(rel string, entry *ManifestEntry) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	applied, ok := rw.applied[path.RelUnix(rel)]
+	if !ok {
+		return false
+	}
+	if applied == nil || entry == nil {
+		return applied == entry
+	}
+
+	return applied.Type == entry.Type && applied.Hash == entry.Hash
+}
+
+// run applies the changes until the stream ends.
+func (rw *RemoteWatcher) run(errorChan chan error) {
+	for event := range rw.stream.Events {
+		if event.Name == ResyncEvent && errorChan != nil {
+			errorChan <- ErrChangesMissed
+		}
+		if event.Name != ChangeEvent {
+			continue
+		}
+
+		change := new(RemoteChange)
+		err := json.Unmarshal([]byte(event.Data), change)
+		if err == nil {
+			err = rw.apply(change)
+		}
+		if err != nil && errorChan != nil {
+			errorChan <- &BatchError{Path: change.Path, Err: err}
+		}
+	}
+
+	err := rw.stream.Err()
+	if err != nil && errorChan != nil {
+		errorChan <- err
+	}
+}
+
+// apply makes the change to the local tree.
+func (rw *RemoteWatcher) apply(change *RemoteChange) error {
+	rel := filepath.Clean(path.RelSystem(change.Path))
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ErrChangePath
+	}
+	full := filepath.Join(rw.local, rel)
+	isDir := !change.Deleted && change.Entry != nil && change.Entry.Type == DirType
+	if rw.ignores.MatchParents(filepath.ToSlash(rel), isDir) {
+		return nil
+	}
+
+	// A symlink in the tree could point the parent outside of it.
+	err := checkParent(rw.local, full)
+	if err != nil {
+		return err
+	}
+
+	if change.Deleted || change.Entry == nil {
+		err = os.RemoveAll(full)
+		if err != nil {
+			return err
+		}
+
+		rw.record(change.Path, nil)
+		return nil
+	}
+
+	switch change.Entry.Type {
+	case DirType:
+		err = rw.applyDir(full, change.Entry)
+	case SymlinkType:
+		err = rw.applySymlink(full, change.Linkname)
+	case FileType:
+		err = rw.applyFile(full, change)
+	}
+	if err != nil {
+		return err
+	}
+
+	rw.record(change.Path, change.Entry)
+	return nil
+}
+
+// applyDir creates the directory, replacing other paths in its way.
+func (rw *RemoteWatcher) applyDir(full string, entry *ManifestEntry) error {
+	info, err := os.Lstat(full)
+	if err == nil && info.IsDir() {
+		return os.Chmod(full, entry.Mode)
+	}
+	if err == nil {
+		err = os.Remove(full)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.MkdirAll(full, entry.Mode|os.ModeDir)
+}
+
+// applySymlink creates the symlink, replacing the path that's there. The
+// target has to stay inside of the tree.
+func (rw *RemoteWatcher) applySymlink(full, linkname string) error {
+	if target, err := os.Readlink(full); err == nil && target == linkname {
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+	if err == nil {
+		err = CheckLink(rw.local, full, linkname)
+		if err == ErrLinkOutside {
+			err = ErrChangeLink
+		}
+	}
+	if err == nil {
+		err = os.RemoveAll(full)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, full)
+}
+
+// applyFile writes the files contents, downloading them if they weren't
+// included. The file is replaced atomically and files that already match
+// aren't written.
+func (rw *RemoteWatcher) applyFile(full string, change *RemoteChange) error {
+	info, err := os.Lstat(full)
+	if err == nil && info.Mode().IsRegular() {
+		hash, err := hashFile(full)
+		if err == nil && hash == change.Entry.Hash {
+			return os.Chmod(full, change.Entry.Mode)
+		}
+	}
+
+	var contents io.Reader = bytes.NewReader(change.Contents)
+	if change.Truncated {
+		download, err := rw.client.Download(rw.ctx, rw.container, &DownloadOptions{Path: change.Path, NoIgnoreFile: true})
+		if err != nil {
+			return err
+		}
+		defer download.Close()
+
+		contents, err = tarFile(download, change.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	dest, err := ioutil.TempFile(filepath.Dir(full), TempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dest.Name())
+	defer dest.Close()
+
+	_, err = io.Copy(dest, contents)
+	if err == nil {
+		err = dest.Chmod(change.Entry.Mode)
+	}
+	if err == nil {
+		err = dest.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The tree may have changed while the contents were written.
+	err = checkParent(rw.local, full)
+	if err != nil {
+		return err
+	}
+
+	// Directories in the way are replaced.
+	if info != nil && info.IsDir() {
+		err = os.RemoveAll(full)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(dest.Name(), full)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(full, change.Entry.ModTime, change.Entry.ModTime)
+}
+
+// record stores the version of a path that was applied.
+func (rw *RemoteWatcher) record(rel string, entry *ManifestEntry) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	rw.applied[path.RelUnix(rel)] = entry
+}
+
+// checkParent checks that the paths parent directory is still inside of
+// the root once symlinks are followed. Parents that don't exist yet are
+// checked from the closest one that does.
+func checkParent(root, full string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(full)
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if !IsWithin(realRoot, resolved) {
+				return ErrChangePath
+			}
+
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
+
+// tarFile finds a files contents in a gzipped tar.
+func tarFile(r io.Reader, rel string) (io.Reader, error) {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tarReader := stdtar.NewReader(gzipReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = os.ErrNotExist
+			}
+
+			return nil, err
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == rel {
+			return tarReader, nil
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright 2014 Bowery, Inc.
+
+package delancey
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/gopackages/schemas"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Defaults used by watchers when the options don't set them.
+const (
+	defaultWatchDelay = 100 * time.Millisecond
+	defaultRetries    = 3
+	defaultRetryDelay = time.Second
+)
+
+// WatcherOptions configures a watcher. Delay is how long changes are
+// collected after the last one before they're sent. Failed sends are
+// retried Retries times, waiting RetryDelay before the first retry and
+// doubling it after each one. If Remote is set, changes it applied to the
+// local tree aren't sent back.
+type WatcherOptions struct {
+	Delay      time.Duration
+	Retries    int
+	RetryDelay time.Duration
+	Remote     *RemoteWatcher
+}
+
+// Watcher watches a local tree and sends its changes to a container. Bursts
+// of changes are coalesced, a single changed path is sent with Update and
+// anything more is sent with BatchUpdate.
+type Watcher struct {
+	client    *Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	container *schemas.Container
+	local     string
+	opts      *WatcherOptions
+	ignores   *Matcher
+	watcher   *fsnotify.Watcher
+	errorChan chan error
+	pending   map[string]string
+	timer     *time.Timer
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	mutex     sync.Mutex
+}
+
+// NewWatcher is a wrapper around DefaultClient.NewWatcher.
+func NewWatcher(container *schemas.Container, local string, opts *WatcherOptions, errorChan chan error) (*Watcher, error) {
+	return DefaultClient.NewWatcher(context.Background(), container, local, opts, errorChan)
+}
+
+// NewWatcher starts watching the local tree and sending its changes to the
+// container. Paths ignored by the trees ignore files aren't sent. Errors
+// sending changes are sent to the error channel if given, paths that fail
+// are sent as BatchErrors. Changes stop being sent once the context is
+// done or the watcher is closed. The options aren't modified.
+func (c *Client) NewWatcher(ctx context.Context, container *schemas.Container, local string, opts *WatcherOptions, errorChan chan error) (*Watcher, error) {
+	if opts == nil {
+		opts = new(WatcherOptions)
+	}
+	optsCopy := *opts
+	opts = &optsCopy
+	if opts.Delay <= 0 {
+		opts.Delay = defaultWatchDelay
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	} else if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = defaultRetryDelay
+	}
+
+	ignores, err := LoadIgnores(local)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watcher{
+		client:    c,
+		ctx:       ctx,
+		cancel:    cancel,
+		container: container,
+		local:     local,
+		opts:      opts,
+		ignores:   ignores,
+		watcher:   watcher,
+		errorChan: errorChan,
+		pending:   make(map[string]string),
+		ready:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	err = w.watchDir(local, false)
+	if err != nil {
+		cancel()
+		watcher.Close()
+		return nil, err
+	}
+
+	go w.run()
+	go w.send()
+	return w, nil
+}
+
+// Close stops watching the local tree. Changes that haven't been sent yet
+// are dropped. Closing again returns the first error.
+func (w *Watcher) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		w.cancel()
+
+		w.mutex.Lock()
+		if w.timer != nil {
+			w.timer.Stop()
+		}
+		w.mutex.Unlock()
+
+		w.closeErr = w.watcher.Close()
+	})
+
+	return w.closeErr
+}
+
+// watchDir watches a directory and the directories inside of it. If
+// queueing, the paths found are queued as created since they may have been
+// created before the watch started.
+func (w *Watcher) watchDir(dir string, queue bool) error {
+	return filepath.Walk(dir, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Paths may be removed while walking.
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		rel, ignored := w.relPath(full, info.IsDir())
+		if ignored {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if queue && rel != "" {
+			w.queue(rel, CreateStatus)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		return w.watcher.Add(full)
+	})
+}
+
+// relPath gets the relative path for a full path, and checks if it's
+// ignored. The root has an empty relative path.
+func (w *Watcher) relPath(full string, isDir bool) (string, bool) {
+	rel, err := filepath.Rel(w.local, full)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) ||
+		filepath.IsAbs(rel) {
+		return "", true
+	}
+	if rel == "." {
+		return "", false
+	}
+	if strings.HasPrefix(filepath.Base(rel), TempPrefix) {
+		return "", true
+	}
+	rel = filepath.ToSlash(rel)
+
+	return rel, w.ignores.MatchParents(rel, isDir)
+}
+
+// run handles the watchers events until it's closed.
+func (w *Watcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+
+			info, err := os.Lstat(event.Name)
+			isDir := err == nil && info.IsDir()
+			rel, ignored := w.relPath(event.Name, isDir)
+			if ignored || rel == "" {
+				continue
+			}
+
+			switch {
+			case event.Op&fsnotify.Create != 0:
+				w.queue(rel, CreateStatus)
+
+				// New directories have to be watched too.
+				if isDir {
+					err = w.watchDir(event.Name, true)
+					if err != nil {
+						w.report(err)
+					}
+				}
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				w.queue(rel, DeleteStatus)
+			default:
+				w.queue(rel, UpdateStatus)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			w.report(err)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// queue adds a change to the pending changes, and delays sending them until
+// changes settle. A path created since the last send stays created, and a
+// path removed and created again is updated since it was sent before. A
+// path created and removed since the last send was never sent, so it's
+// dropped.
+func (w *Watcher) queue(rel, status string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	prev, ok := w.pending[rel]
+	if ok && prev == CreateStatus && status == UpdateStatus {
+		status = CreateStatus
+	}
+	if ok && prev != CreateStatus && status == CreateStatus {
+		status = UpdateStatus
+	}
+	if ok && prev == CreateStatus && status == DeleteStatus {
+		delete(w.pending, rel)
+	} else {
+		w.pending[rel] = status
+	}
+
+	if w.timer != nil {
+		w.timer.Reset(w.opts.Delay)
+		return
+	}
+
+	w.timer = time.AfterFunc(w.opts.Delay, func() {
+		select {
+		case w.ready <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// send sends the pending changes each time they settle, until the watcher
+// is closed. Only one send happens at a time.
+func (w *Watcher) send() {
+	for {
+		select {
+		case <-w.ready:
+		case <-w.done:
+			return
+		case <-w.ctx.Done():
+			return
+		}
+
+		w.mutex.Lock()
+		pending := w.pending
+		w.pending = make(map[string]string)
+		w.mutex.Unlock()
+
+		paths, statuses, deletes := w.collect(pending)
+		err := w.retry(func() error {
+			return w.update(paths, statuses, deletes)
+		})
+		if err != nil {
+			w.report(err)
+		}
+	}
+}
+
+// collect gets the pending paths to write and delete. The paths current
+// state decides how it's sent, so a path created and removed before the
+// send is skipped. Paths applied by the remote watcher are also skipped.
+func (w *Watcher) collect(pending map[string]string) (map[string]string, map[string]string, []string) {
+	paths := make(map[string]string)
+	statuses := make(map[string]string)
+	deletes := make([]string, 0)
+
+	for rel, status := range pending {
+		full := filepath.Join(w.local, filepath.FromSlash(rel))
+		info, err := os.Lstat(full)
+		if err != nil && !os.IsNotExist(err) {
+			w.report(&BatchError{Path: full, Err: err})
+			continue
+		}
+		if err != nil {
+			if status == CreateStatus || w.applied(rel, nil) {
+				continue
+			}
+
+			deletes = append(deletes, rel)
+			continue
+		}
+
+		if w.opts.Remote != nil {
+			entry, err := NewManifestEntry(full, rel, info)
+			if err == nil && entry != nil && w.applied(rel, entry) {
+				continue
+			}
+		}
+		if status == DeleteStatus {
+			status = CreateStatus
+		}
+
+		paths[full] = rel
+		statuses[full] = status
+	}
+
+	return paths, statuses, deletes
+}
+
+// applied checks if the remote watcher applied the paths current version.
+func (w *Watcher) applied(rel string, entry *ManifestEntry) bool {
+	return w.opts.Remote != nil && w.opts.Remote.Applied(rel, entry)
+}
+
+// update sends the changes to the container, a single change is sent with
+// Update. Paths skipped or rejected by a batch are reported as BatchErrors.
+func (w *Watcher) update(paths, statuses map[string]string, deletes []string) error {
+	switch {
+	case len(paths) <= 0 && len(deletes) <= 0:
+		return nil
+	case len(paths) == 1 && len(deletes) <= 0:
+		for full, rel := range paths {
+			return w.client.Update(w.ctx, w.container, full, rel, statuses[full])
+		}
+	case len(paths) <= 0 && len(deletes) == 1:
+		return w.client.Update(w.ctx, w.container, "", deletes[0], DeleteStatus)
+	}
+
+	// The batch sends at most one error per path, so it never blocks.
+	skipped := make(chan error, len(paths))
+	err := w.client.BatchUpdateWithManifest(w.ctx, w.container, paths, &BatchManifest{Deletes: deletes}, skipped)
+	close(skipped)
+	for skippedErr := range skipped {
+		w.report(skippedErr)
+	}
+
+	if batchErrs, ok := err.(BatchErrors); ok {
+		for _, batchErr := range batchErrs {
+			w.report(batchErr)
+		}
+
+		return nil
+	}
+
+	return err
+}
+
+// retry calls fn until it succeeds, the error isn't transient, or the
+// retries run out. The delay between retries doubles each time.
+func (w *Watcher) retry(fn func() error) error {
+	delay := w.opts.RetryDelay
+
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= w.opts.Retries || !transient(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// report sends an error to the error channel if there is one.
+func (w *Watcher) report(err error) {
+	if w.errorChan == nil {
+		return
+	}
+
+	select {
+	case w.errorChan <- err:
+	case <-w.done:
+	}
+}
+
+// transient checks if an error may not happen again if the request is
+// retried. Only connection failures and 5xx responses are transient, other
+// failures and local errors are returned right away.
+func transient(err error) bool {
+	switch err.(type) {
+	case net.Error, *url.Error, *ServerError:
+		return true
+	}
+
+	return false
+}
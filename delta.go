@@ -0,0 +1,108 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// fileSignature creates the signature of the file at the path. A missing
+// file is treated as empty.
+func fileSignature(fullPath string) (*delancey.Signature, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return delancey.NewSignature(new(bytes.Buffer), delancey.BlockSize(0))
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return delancey.NewSignature(file, delancey.BlockSize(stat.Size()))
+}
+
+// patchFile reconstructs the file at the path by applying a delta to it.
+// The current file has to match the base hash the delta was created
+// against, and the result has to match the hash. The file is replaced
+// atomically so readers never see a partial file.
+func patchFile(fullPath, baseHash, hash string, mode os.FileMode, delta io.Reader) error {
+	sig, err := fileSignature(fullPath)
+	if err != nil {
+		return err
+	}
+	if sig.Hash != baseHash {
+		return delancey.ErrDeltaBase
+	}
+
+	// Keep the current permissions if none are given.
+	base, err := os.Open(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if base != nil {
+		defer base.Close()
+		if mode == 0 {
+			stat, err := base.Stat()
+			if err != nil {
+				return err
+			}
+
+			mode = stat.Mode().Perm()
+		}
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	dest, err := ioutil.TempFile(filepath.Dir(fullPath), delancey.TempPrefix+"delta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dest.Name())
+	defer dest.Close()
+
+	// A missing base has no blocks so it's never read.
+	var baseReader io.ReaderAt = base
+	if base == nil {
+		baseReader = bytes.NewReader(nil)
+	}
+
+	destHash := sha256.New()
+	err = delancey.ApplyDelta(io.MultiWriter(dest, destHash), baseReader, sig, delta)
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(destHash.Sum(nil)) != hash {
+		return delancey.ErrInvalidDelta
+	}
+
+	err = dest.Chmod(mode)
+	if err == nil {
+		err = dest.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(dest.Name(), fullPath)
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+func TestPatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	edited := append(append(append([]byte{}, random[:1000]...), "inserted"...), random[5000:]...)
+
+	cases := []struct {
+		name     string
+		base     []byte
+		contents []byte
+	}{
+		{"new", nil, random[:10000]},
+		{"empty", random[:10000], nil},
+		{"identical", random, random},
+		{"edited", random, edited},
+		{"appended", random, append(append([]byte{}, random...), "tail"...)},
+		{"truncated", random, random[:len(random)-3]},
+		{"small", []byte("hello world"), []byte("hello there world")},
+	}
+
+	for _, c := range cases {
+		fullPath := filepath.Join(dir, c.name)
+		if c.base != nil {
+			err = ioutil.WriteFile(fullPath, c.base, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		sig, err := fileSignature(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var delta bytes.Buffer
+		err = delancey.WriteDelta(&delta, sig, bytes.NewReader(c.contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Unchanged data shouldn't be resent.
+		if c.name == "identical" || c.name == "edited" {
+			if delta.Len() > len(c.contents)/10 {
+				t.Error(c.name, "delta is larger than expected", delta.Len())
+			}
+		}
+
+		sum := sha256.Sum256(c.contents)
+		err = patchFile(fullPath, sig.Hash, hex.EncodeToString(sum[:]), 0, &delta)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		contents, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(contents, c.contents) {
+			t.Error(c.name, "contents aren't as expected")
+		}
+
+		stat, err := os.Stat(fullPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.base != nil && stat.Mode().Perm() != 0600 {
+			t.Error(c.name, "permissions weren't kept")
+		}
+	}
+}
+
+func TestPatchFileBaseChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fullPath := filepath.Join(dir, "file")
+
+	err = ioutil.WriteFile(fullPath, []byte("original"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig, err := fileSignature(fullPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var delta bytes.Buffer
+	err = delancey.WriteDelta(&delta, sig, bytes.NewBufferString("updated"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(fullPath, []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patchFile(fullPath, sig.Hash, "", 0, &delta)
+	if err != delancey.ErrDeltaBase {
+		t.Error("Expected base changed error got", err)
+	}
+}
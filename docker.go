@@ -2,34 +2,51 @@ package main
 
 import (
 	stdtar "archive/tar"
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/Bowery/gopackages/docker"
 	"github.com/docker/docker/builder/command"
 )
 
+// Stream type used in Dockers multiplexed stream header for stderr, any other
+// type is treated as stdout.
+const dockerStderr = 2
+
 // createImage creates the given image from a base image.
 func createImage(imageID, image, baseImage string) error {
 	log.Println("Creating build container using", baseImage, "for", imageID)
-	id, err := DockerClient.Create(new(docker.Config), baseImage, nil)
+	id, err := ContainerRuntime.Create(new(ContainerConfig), baseImage, nil)
 	if err != nil {
 		return err
 	}
 
 	// Commit the empty container to the image name.
 	log.Println("Commit build container to image", image)
-	err = DockerClient.CommitImage(id, image)
+	err = ContainerRuntime.Commit(id, image)
 	if err != nil {
 		return err
 	}
 
 	// Clean up the container.
 	log.Println("Removing build container", imageID)
-	go DockerClient.Remove(id)
+	go ContainerRuntime.Remove(id)
 	return nil
 }
 
@@ -54,7 +71,7 @@ func buildImage(strip bool, paths map[string]string, vars map[string]string, rep
 	}
 
 	if progress == nil {
-		return DockerClient.BuildImage(input, "", repo, nil)
+		return ContainerRuntime.Build(input, repo, nil)
 	}
 
 	steps, err := docker.ParseDockerfile(strings.NewReader(dockerfile))
@@ -70,7 +87,7 @@ func buildImage(strip bool, paths map[string]string, vars map[string]string, rep
 		}
 	}()
 
-	return DockerClient.BuildImage(input, "", repo, progChan)
+	return ContainerRuntime.Build(input, repo, progChan)
 }
 
 // createImageInput creates a tar reader using the given templates as files.
@@ -159,3 +176,602 @@ func stripInstructions(contents io.Reader) (*bytes.Buffer, error) {
 
 	return &buf, nil
 }
+
+// DockerRuntime runs containers with a Docker daemon. Endpoints the Docker
+// client doesn't support, or that need the daemons TLS config, are sent to
+// the remote API directly.
+type DockerRuntime struct {
+	client     *docker.Client
+	addr       string
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+}
+
+// NewDockerRuntime creates a runtime using the Docker daemon at addr. TLS
+// is configured from the environment like the Docker CLI, see
+// dockerTLSConfig.
+func NewDockerRuntime(addr string) (*DockerRuntime, error) {
+	client, err := docker.NewClient(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := dockerTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dr := &DockerRuntime{client: client, addr: addr, tlsConfig: tlsConfig}
+	dr.httpClient = &http.Client{Transport: &http.Transport{
+		Dial: func(network, address string) (net.Conn, error) {
+			return dr.dial()
+		},
+	}}
+
+	return dr, nil
+}
+
+// dockerTLSConfig creates the TLS config for the Docker daemon from the
+// environment. TLS is used if DOCKER_TLS_VERIFY or DOCKER_CERT_PATH is
+// set, and the certs are read from DOCKER_CERT_PATH or ~/.docker. The
+// daemons cert is only verified if DOCKER_TLS_VERIFY is set. Nil is returned
+// if TLS isn't used.
+func dockerTLSConfig() (*tls.Config, error) {
+	verify := os.Getenv("DOCKER_TLS_VERIFY") != ""
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if !verify && certPath == "" {
+		return nil, nil
+	}
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: !verify}
+
+	// The client cert is optional, daemons may not require one.
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err == nil {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if verify {
+		ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("No certificates found in " + filepath.Join(certPath, "ca.pem"))
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// Pull pulls an image, reading Docker's progress stream so missing images
+// are detected whether or not progress is given. The progress sent is the
+// average of the layers progress.
+func (dr *DockerRuntime) Pull(image string, progress chan float64) error {
+	name, tag := splitImageTag(image)
+	query := url.Values{}
+	query.Set("fromImage", name)
+	query.Set("tag", tag)
+
+	res, err := dr.api("POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		if isDockerNotFound(err) {
+			return ErrImageNotFound
+		}
+
+		return err
+	}
+	defer res.Body.Close()
+
+	layers := make(map[string]float64)
+	decoder := json.NewDecoder(res.Body)
+	for {
+		msg := new(dockerPullMessage)
+		err := decoder.Decode(msg)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if msg.Error != "" {
+			err = errors.New(msg.Error)
+			if isDockerNotFound(err) {
+				return ErrImageNotFound
+			}
+
+			return err
+		}
+		if progress == nil || msg.ID == "" {
+			continue
+		}
+
+		switch {
+		case msg.ProgressDetail.Total > 0:
+			layers[msg.ID] = float64(msg.ProgressDetail.Current) / float64(msg.ProgressDetail.Total)
+		case msg.Status == "Download complete", msg.Status == "Pull complete", msg.Status == "Already exists":
+			layers[msg.ID] = 1
+		default:
+			continue
+		}
+
+		total := float64(0)
+		for _, prog := range layers {
+			total += prog
+		}
+		progress <- total / float64(len(layers))
+	}
+}
+
+// dockerPullMessage is a message from Docker's pull progress stream.
+type dockerPullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+// splitImageTag splits an image into its name and tag, the tag defaults to
+// latest so Docker doesn't pull every tag.
+func splitImageTag(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i <= strings.LastIndex(image, "/") {
+		return image, "latest"
+	}
+
+	return image[:i], image[i+1:]
+}
+
+// isDockerNotFound checks if an error from Docker is for a missing image.
+func isDockerNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "does not exist")
+}
+
+// Push pushes an image.
+func (dr *DockerRuntime) Push(image string, progress chan float64) error {
+	return dr.client.PushImage(image, progress)
+}
+
+// Build builds an image from a tar containing a Dockerfile.
+func (dr *DockerRuntime) Build(input io.Reader, repo string, progress chan int) (string, error) {
+	return dr.client.BuildImage(input, "", repo, progress)
+}
+
+// InspectImage retrieves an image's info.
+func (dr *DockerRuntime) InspectImage(image string) (*ImageInfo, error) {
+	inspected, err := dr.client.InspectImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageInfo{ID: image, Env: inspected.Config.Env}, nil
+}
+
+// RemoveImage removes an image.
+func (dr *DockerRuntime) RemoveImage(image string) error {
+	return dr.client.RemoveImage(image)
+}
+
+// Create creates a container from an image running cmd. The config is
+// given to Docker here so it's kept with the container.
+func (dr *DockerRuntime) Create(config *ContainerConfig, image string, cmd []string) (string, error) {
+	if config == nil {
+		config = new(ContainerConfig)
+	}
+
+	volumes := make(map[string]struct{})
+	binds := make([]string, 0, len(config.Volumes))
+	for host, path := range config.Volumes {
+		volumes[path] = struct{}{}
+		binds = append(binds, host+":"+path)
+	}
+	sort.Strings(binds)
+
+	res, err := dr.api("POST", "/containers/create", map[string]interface{}{
+		"Image":   image,
+		"Cmd":     cmd,
+		"Volumes": volumes,
+		"HostConfig": map[string]interface{}{
+			"Binds":       binds,
+			"NetworkMode": config.NetworkMode,
+			"Privileged":  config.Privileged,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	created := new(struct{ ID string })
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(created)
+	if err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// Start starts a container, Docker already has the config from when it was
+// created.
+func (dr *DockerRuntime) Start(config *ContainerConfig, id string) error {
+	res, err := dr.api("POST", "/containers/"+id+"/start", nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// Stop stops a container, killing it after timeout seconds.
+func (dr *DockerRuntime) Stop(id string, timeout int) error {
+	res, err := dr.api("POST", "/containers/"+id+"/stop?t="+strconv.Itoa(timeout), nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// Remove removes a container.
+func (dr *DockerRuntime) Remove(id string) error {
+	return dr.client.Remove(id)
+}
+
+// Commit commits a container's changes to an image.
+func (dr *DockerRuntime) Commit(id, image string) error {
+	return dr.client.CommitImage(id, image)
+}
+
+// Inspect retrieves a container's info.
+func (dr *DockerRuntime) Inspect(id string) (*ContainerInfo, error) {
+	dcontainer, err := dr.client.Inspect(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContainerInfo{ID: id, Image: dcontainer.Image}, nil
+}
+
+// Changes lists the paths changed in a container.
+func (dr *DockerRuntime) Changes(id string) ([]string, error) {
+	res, err := dr.api("GET", "/containers/"+id+"/changes", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var changes []struct{ Path string }
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(&changes)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(changes))
+	for _, change := range changes {
+		paths = append(paths, change.Path)
+	}
+
+	return paths, nil
+}
+
+// Exec runs a command in a container writing its output to stdout and
+// stderr.
+func (dr *DockerRuntime) Exec(id string, cmd, env []string, dir string, stdout, stderr io.Writer) (int, error) {
+	execID, err := dr.createExec(id, cmd, env, dir, false)
+	if err != nil {
+		return -1, err
+	}
+
+	res, err := dr.api("POST", "/exec/"+execID+"/start", map[string]interface{}{
+		"Detach": false,
+		"Tty":    false,
+	})
+	if err != nil {
+		return -1, err
+	}
+	defer res.Body.Close()
+
+	err = demuxDockerStream(res.Body, stdout, stderr)
+	if err != nil {
+		return -1, err
+	}
+
+	return dr.execExitCode(execID)
+}
+
+// Terminal starts an interactive command in a container, the exec
+// instance's connection is used as the TTY.
+func (dr *DockerRuntime) Terminal(id string, cmd []string, dir string) (Terminal, error) {
+	execID, err := dr.createExec(id, cmd, nil, dir, true)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, reader, err := dr.hijack("POST", "/exec/"+execID+"/start", map[string]interface{}{
+		"Detach": false,
+		"Tty":    true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dockerTerminal{runtime: dr, id: execID, conn: conn, reader: reader}, nil
+}
+
+// Logs retrieves a container's logs, Docker's multiplexed stream is
+// combined as it's read.
+func (dr *DockerRuntime) Logs(id string, follow bool, tail string, since int64) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	query.Set("tail", tail)
+	query.Set("since", strconv.FormatInt(since, 10))
+	if follow {
+		query.Set("follow", "1")
+	}
+
+	res, err := dr.api("GET", "/containers/"+id+"/logs?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(demuxDockerStream(res.Body, writer, writer))
+	}()
+
+	return &dockerLogs{PipeReader: reader, body: res.Body}, nil
+}
+
+// dial connects to the Docker daemon, using TLS for TCP addresses if it's
+// configured.
+func (dr *DockerRuntime) dial() (net.Conn, error) {
+	addr, err := url.Parse(dr.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if addr.Scheme == "unix" {
+		return net.Dial("unix", addr.Path)
+	}
+	if dr.tlsConfig == nil {
+		return net.Dial("tcp", addr.Host)
+	}
+
+	tlsConfig := dr.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, err = net.SplitHostPort(addr.Host)
+		if err != nil {
+			tlsConfig.ServerName = addr.Host
+		}
+	}
+
+	return tls.Dial("tcp", addr.Host, tlsConfig)
+}
+
+// newDockerRequest creates a request for the Docker remote API, the body is
+// encoded as JSON if given.
+func newDockerRequest(method, endpoint string, body interface{}) (*http.Request, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		encoder := json.NewEncoder(&reqBody)
+		err := encoder.Encode(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The host is ignored since the runtime dials the daemon itself.
+	req, err := http.NewRequest(method, "http://docker"+endpoint, &reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return req, nil
+}
+
+// dockerError gets the error from a Docker error response.
+func dockerError(res *http.Response) error {
+	msg, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	return errors.New(strings.TrimSpace(string(msg)))
+}
+
+// api sends a request to the Docker remote API, it's used for endpoints the
+// Docker client doesn't support or configure TLS for. Error responses are
+// returned as errors.
+func (dr *DockerRuntime) api(method, endpoint string, body interface{}) (*http.Response, error) {
+	req, err := newDockerRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := dr.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		return nil, dockerError(res)
+	}
+
+	return res, nil
+}
+
+// hijack sends a request to the Docker remote API and takes over the
+// connection, so it can be used as a raw stream in both directions.
+func (dr *DockerRuntime) hijack(method, endpoint string, body interface{}) (net.Conn, *bufio.Reader, error) {
+	req, err := newDockerRequest(method, endpoint, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+
+	conn, err := dr.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if res.StatusCode >= 400 {
+		defer conn.Close()
+		return nil, nil, dockerError(res)
+	}
+
+	return conn, reader, nil
+}
+
+// createExec creates an exec instance to run a command in a Docker container.
+// If tty is true stdin is attached as well.
+func (dr *DockerRuntime) createExec(id string, cmd, env []string, dir string, tty bool) (string, error) {
+	res, err := dr.api("POST", "/containers/"+id+"/exec", map[string]interface{}{
+		"AttachStdin":  tty,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          tty,
+		"Cmd":          cmd,
+		"Env":          env,
+		"WorkingDir":   dir,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	exec := new(struct{ ID string })
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(exec)
+	if err != nil {
+		return "", err
+	}
+
+	return exec.ID, nil
+}
+
+// resizeExec sets the TTY size for an exec instance.
+func (dr *DockerRuntime) resizeExec(id string, width, height int) error {
+	res, err := dr.api("POST", "/exec/"+id+"/resize?w="+strconv.Itoa(width)+"&h="+strconv.Itoa(height), nil)
+	if err != nil {
+		return err
+	}
+
+	return res.Body.Close()
+}
+
+// execExitCode retrieves the exit code for a finished exec instance.
+func (dr *DockerRuntime) execExitCode(id string) (int, error) {
+	res, err := dr.api("GET", "/exec/"+id+"/json", nil)
+	if err != nil {
+		return -1, err
+	}
+	defer res.Body.Close()
+
+	inspect := new(struct{ ExitCode int })
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(inspect)
+	if err != nil {
+		return -1, err
+	}
+
+	return inspect.ExitCode, nil
+}
+
+// dockerTerminal is a terminal using an exec instance's hijacked connection.
+type dockerTerminal struct {
+	runtime *DockerRuntime
+	id      string
+	conn    net.Conn
+	reader  *bufio.Reader
+}
+
+func (dt *dockerTerminal) Read(b []byte) (int, error) {
+	return dt.reader.Read(b)
+}
+
+func (dt *dockerTerminal) Write(b []byte) (int, error) {
+	return dt.conn.Write(b)
+}
+
+func (dt *dockerTerminal) Close() error {
+	return dt.conn.Close()
+}
+
+// Resize sets the size of the exec instance's TTY.
+func (dt *dockerTerminal) Resize(width, height int) error {
+	return dt.runtime.resizeExec(dt.id, width, height)
+}
+
+// ExitCode retrieves the exec instance's exit code.
+func (dt *dockerTerminal) ExitCode() (int, error) {
+	return dt.runtime.execExitCode(dt.id)
+}
+
+// dockerLogs is a containers combined logs, closing it closes the stream
+// from Docker.
+type dockerLogs struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+func (dl *dockerLogs) Close() error {
+	dl.PipeReader.Close()
+	return dl.body.Close()
+}
+
+// demuxDockerStream copies a multiplexed stream from Docker to stdout and
+// stderr. Each frame has an 8 byte header, the first byte is the stream and
+// the last 4 are the big endian size of the frame.
+func demuxDockerStream(stream io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+
+	for {
+		_, err := io.ReadFull(stream, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		dest := stdout
+		if header[0] == dockerStderr {
+			dest = stderr
+		}
+
+		_, err = io.CopyN(dest, stream, int64(binary.BigEndian.Uint32(header[4:])))
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDemuxDockerStream(t *testing.T) {
+	stream := bytes.NewBuffer([]byte{1, 0, 0, 0, 0, 0, 0, 3})
+	stream.WriteString("out")
+	stream.Write([]byte{2, 0, 0, 0, 0, 0, 0, 3})
+	stream.WriteString("err")
+	stream.Write([]byte{1, 0, 0, 0, 0, 0, 0, 1})
+	stream.WriteString("!")
+
+	var stdout, stderr bytes.Buffer
+	err := demuxDockerStream(stream, &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.String() != "out!" {
+		t.Error("stdout doesn't match what was sent")
+	}
+
+	if stderr.String() != "err" {
+		t.Error("stderr doesn't match what was sent")
+	}
+}
+
+func TestDemuxDockerStreamTruncated(t *testing.T) {
+	stream := bytes.NewBuffer([]byte{1, 0, 0, 0, 0, 0, 0, 10})
+	stream.WriteString("short")
+
+	var stdout, stderr bytes.Buffer
+	err := demuxDockerStream(stream, &stdout, &stderr)
+	if err == nil {
+		t.Error("Truncated stream should've failed but didn't")
+	}
+}
+
+func TestSplitImageTag(t *testing.T) {
+	cases := []struct {
+		image string
+		name  string
+		tag   string
+	}{
+		{"ubuntu", "ubuntu", "latest"},
+		{"ubuntu:14.04", "ubuntu", "14.04"},
+		{"bowery/base", "bowery/base", "latest"},
+		{"localhost:5000/base", "localhost:5000/base", "latest"},
+		{"localhost:5000/base:dev", "localhost:5000/base", "dev"},
+	}
+
+	for _, c := range cases {
+		name, tag := splitImageTag(c.image)
+		if name != c.name || tag != c.tag {
+			t.Error(c.image, "expected", c.name, c.tag, "got", name, tag)
+		}
+	}
+}
+
+func TestDockerRuntimePull(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+	fd.AddImage("some-image")
+	fd.AddImage("other-image:dev")
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runtime.Pull("some-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd.Image("some-image:latest") == nil {
+		t.Error("Image wasn't pulled")
+	}
+
+	progress := make(chan float64)
+	done := make(chan error, 1)
+	go func() {
+		done <- runtime.Pull("other-image:dev", progress)
+		close(progress)
+	}()
+
+	last := float64(0)
+	for prog := range progress {
+		if prog < last {
+			t.Error("Progress went backwards", last, prog)
+		}
+		last = prog
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if last != 1 {
+		t.Error("Progress should've finished at 1 but is", last)
+	}
+
+	// Missing images are detected with and without progress.
+	err = runtime.Pull("missing-image", nil)
+	if err != ErrImageNotFound {
+		t.Error("Pulling a missing image should've failed with ErrImageNotFound, got", err)
+	}
+
+	progress = make(chan float64, 10)
+	err = runtime.Pull("missing-image", progress)
+	if err != ErrImageNotFound {
+		t.Error("Pulling a missing image with progress should've failed with ErrImageNotFound, got", err)
+	}
+}
+
+func TestDockerRuntimeCreate(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+	fd.AddImage("some-image")
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runtime.Pull("some-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ContainerConfig{
+		Volumes:     map[string]string{"/host/b": "/b", "/host/a": "/a"},
+		NetworkMode: "host",
+		Privileged:  true,
+	}
+	id, err := runtime.Create(config, "some-image", []string{"/usr/sbin/sshd", "-D"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := fd.Container(id)
+	if container == nil {
+		t.Fatal("Container wasn't created")
+	}
+	host := container.HostConfig
+	if len(host.Binds) != 2 || host.Binds[0] != "/host/a:/a" || host.Binds[1] != "/host/b:/b" ||
+		host.NetworkMode != "host" || !host.Privileged {
+		t.Error("Host config doesn't match the config", host)
+	}
+
+	err = runtime.Start(config, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fd.Container(id).Running {
+		t.Error("Container wasn't started")
+	}
+
+	_, err = runtime.Create(nil, "missing-image", nil)
+	if err == nil {
+		t.Error("Creating a container for a missing image should've failed but didn't")
+	}
+}
+
+func TestDockerRuntimeChanges(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/containers/some-id/changes" {
+			http.NotFound(rw, req)
+			return
+		}
+
+		rw.Write([]byte(`[{"Path":"/root","Kind":0},{"Path":"/root/file","Kind":1}]`))
+	}))
+	defer server.Close()
+	runtime, err := NewDockerRuntime(strings.Replace(server.URL, "http", "tcp", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := runtime.Changes("some-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 || changes[0] != "/root" || changes[1] != "/root/file" {
+		t.Error("Changes don't match what Docker sent")
+	}
+
+	_, err = runtime.Changes("other-id")
+	if err == nil {
+		t.Error("Changes for a missing container should've failed but didn't")
+	}
+}
+
+func TestDockerRuntimeTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`[{"Path":"/root","Kind":0}]`))
+	}))
+	defer server.Close()
+
+	certPath, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certPath)
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(filepath.Join(certPath, "ca.pem"), ca, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range map[string]string{"DOCKER_TLS_VERIFY": "1", "DOCKER_CERT_PATH": certPath} {
+		prev, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if ok {
+			defer os.Setenv(key, prev)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+
+	runtime, err := NewDockerRuntime(strings.Replace(server.URL, "https", "tcp", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Requests reuse the runtimes client.
+	for i := 0; i < 2; i++ {
+		changes, err := runtime.Changes("some-id")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(changes) != 1 || changes[0] != "/root" {
+			t.Error("Changes don't match what Docker sent over TLS")
+		}
+	}
+
+	// The daemon isn't trusted without its CA.
+	err = ioutil.WriteFile(filepath.Join(certPath, "ca.pem"), []byte{}, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDockerRuntime(strings.Replace(server.URL, "https", "tcp", 1))
+	if err == nil {
+		t.Error("Runtime without CA certificates should've failed but didn't")
+	}
+}
+
+func TestDockerRuntimeLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.FormValue("tail") != "10" {
+			t.Error("Tail wasn't sent to Docker")
+		}
+
+		rw.Write([]byte{1, 0, 0, 0, 0, 0, 0, 4})
+		rw.Write([]byte("out\n"))
+		rw.Write([]byte{2, 0, 0, 0, 0, 0, 0, 4})
+		rw.Write([]byte("err\n"))
+	}))
+	defer server.Close()
+	runtime, err := NewDockerRuntime(strings.Replace(server.URL, "http", "tcp", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := runtime.Logs("some-id", false, "10", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+
+	output, err := ioutil.ReadAll(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(output) != "out\nerr\n" {
+		t.Error("Logs should have stdout and stderr combined")
+	}
+}
+
+func TestDockerRuntimeExec(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+	fd.SetExecOutput("out\n", "err\n", 2)
+	id := fd.AddContainer("some-image")
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	code, err := runtime.Exec(id, []string{"ls"}, nil, "/", &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Error("Exec output wasn't split into stdout and stderr", stdout.String(), stderr.String())
+	}
+
+	if code != 2 {
+		t.Error("Exit code should be 2 but is", code)
+	}
+}
+
+func TestDockerRuntimeTerminal(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+	fd.SetExecOutput("", "", 3)
+	id := fd.AddContainer("some-image")
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	term, err := runtime.Terminal(id, []string{"/bin/bash"}, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer term.Close()
+
+	_, err = term.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := make([]byte, 5)
+	_, err = io.ReadFull(term, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(output) != "hello" {
+		t.Error("Terminal output doesn't match the input", string(output))
+	}
+
+	execs := fd.Execs()
+	if len(execs) != 1 || !fd.Exec(execs[0]).Tty {
+		t.Fatal("Terminal should've created an exec instance with a TTY")
+	}
+
+	err = term.Resize(100, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := fd.Exec(execs[0])
+	if exec.Width != 100 || exec.Height != 40 {
+		t.Error("TTY wasn't resized", exec.Width, exec.Height)
+	}
+
+	code, err := term.ExitCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code != 3 {
+		t.Error("Exit code should be 3 but is", code)
+	}
+}
+
+func TestDockerRuntimeLogsFrames(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+	fd.AddLog(1, "starting\n")
+	fd.AddLog(2, "warning\n")
+	fd.AddLog(1, "ready\n")
+	id := fd.AddContainer("some-image")
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs, err := runtime.Logs(id, false, "all", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logs.Close()
+
+	output, err := ioutil.ReadAll(logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(output) != "starting\nwarning\nready\n" {
+		t.Error("Logs should have the frames combined in order", string(output))
+	}
+
+	query := fd.LogsQuery()
+	if query.Get("stdout") != "1" || query.Get("stderr") != "1" || query.Get("tail") != "all" ||
+		query.Get("since") != "5" || query.Get("follow") != "" {
+		t.Error("Logs query isn't as expected", query)
+	}
+}
+
+func TestDockerRuntimeLogsMissing(t *testing.T) {
+	fd := newFakeDocker()
+	defer fd.Close()
+
+	runtime, err := NewDockerRuntime(fd.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runtime.Logs("missing-id", false, "all", 0)
+	if err == nil {
+		t.Error("Logs for a missing container should've failed but didn't")
+	}
+}
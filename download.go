@@ -0,0 +1,260 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	stdtar "archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/path"
+)
+
+// Errors returned when parsing ranges.
+var (
+	errInvalidRange       = errors.New("range is invalid")
+	errUnsatisfiableRange = errors.New("range is past the end")
+)
+
+// tarOptions chooses which paths in a tree are included in its tar. Paths
+// are matched relative to the root, but only the path is walked.
+type tarOptions struct {
+	root    string
+	path    string
+	include *delancey.Matcher
+	exclude *delancey.Matcher
+}
+
+// newTarOptions creates tar options for the tree at the root from a
+// downloads query. The trees ignore file is used unless it's disabled.
+func newTarOptions(root string, query url.Values) (*tarOptions, error) {
+	opts := &tarOptions{root: root, path: root}
+	var err error
+
+	if sub := query.Get("path"); sub != "" {
+		opts.path, err = resolvePath(root, path.RelSystem(sub))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts.include, err = delancey.NewMatcher(query["include"])
+	if err != nil {
+		return nil, err
+	}
+
+	exclude := query["exclude"]
+	if query.Get("ignorefile") != "false" {
+		patterns, err := delancey.ReadIgnoreFile(filepath.Join(root, delancey.IgnoreFile))
+		if err != nil {
+			return nil, err
+		}
+
+		exclude = append(patterns, exclude...)
+	}
+
+	opts.exclude, err = delancey.NewMatcher(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// tarEntry is a path included in a tar.
+type tarEntry struct {
+	full string
+	rel  string
+	info os.FileInfo
+}
+
+// walkTar walks the paths included in the tar. A missing path is treated as
+// an empty tree.
+func walkTar(opts *tarOptions, fn func(full, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(opts.path, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			if full == opts.path && os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		rel, err := filepath.Rel(opts.root, full)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if opts.exclude != nil && opts.exclude.Match(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		// Directories are still walked since their contents may be included.
+		if opts.include != nil && !opts.include.Empty() &&
+			!opts.include.MatchParents(rel, info.IsDir()) {
+			return nil
+		}
+
+		return fn(full, rel, info)
+	})
+}
+
+// listTar walks the tree once and gets the paths included in its tar, so
+// the etag and the tar are created from the same paths.
+func listTar(opts *tarOptions) ([]*tarEntry, error) {
+	entries := make([]*tarEntry, 0)
+
+	err := walkTar(opts, func(full, rel string, info os.FileInfo) error {
+		entries = append(entries, &tarEntry{full: full, rel: rel, info: info})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// treeETag creates an etag for the tar of a tree from the stats of its
+// paths, so files aren't read. The tar written only depends on the paths
+// and their stats, so the etag changes whenever it would.
+func treeETag(entries []*tarEntry) string {
+	hash := sha256.New()
+
+	for _, entry := range entries {
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%d\x00", entry.rel, entry.info.Size(),
+			entry.info.Mode(), entry.info.ModTime().UnixNano())
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// writeTar writes the paths as a gzipped tar. The output only depends on the
+// trees contents and stats, so writing an unchanged tree again creates the
+// same bytes.
+func writeTar(w io.Writer, entries []*tarEntry) error {
+	gzipWriter, err := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	tarWriter := stdtar.NewWriter(gzipWriter)
+
+	for _, entry := range entries {
+		err = writeTarEntry(tarWriter, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+// writeTarEntry writes a single path to the tar.
+func writeTarEntry(tarWriter *stdtar.Writer, entry *tarEntry) error {
+	info := entry.info
+	link := ""
+	var err error
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(entry.full)
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := stdtar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = entry.rel
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	header.AccessTime = header.ModTime
+	header.ChangeTime = header.ModTime
+
+	err = tarWriter.WriteHeader(header)
+	if err != nil || !info.Mode().IsRegular() {
+		return err
+	}
+
+	file, err := os.Open(entry.full)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyN(tarWriter, file, info.Size())
+	return err
+}
+
+// parseRange parses a single byte range for a resource of the given size.
+// Suffix ranges("bytes=-500") are supported, multiple ranges aren't. If the
+// range is malformed errInvalidRange is returned and it should be ignored,
+// if it's past the end errUnsatisfiableRange is returned.
+func parseRange(header string, size int64) (int64, int64, error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		return 0, 0, errInvalidRange
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(header[len("bytes="):]), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errInvalidRange
+	}
+
+	// Suffix range, the last n bytes.
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errInvalidRange
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+
+		return size - n, size - 1, nil
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errInvalidRange
+	}
+
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+
+	return start, end, nil
+}
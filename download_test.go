@@ -0,0 +1,148 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTarOptions(t *testing.T) {
+	root, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	files := map[string]string{
+		".boweryignore":           "# Dependencies\nnode_modules/\n*.log\n!keep.log\n",
+		"main.go":                 "",
+		"debug.log":               "",
+		"keep.log":                "",
+		"build/app":               "",
+		"build/assets/app.js":     "",
+		"node_modules/pkg/pkg.js": "",
+		"src/node_modules":        "",
+	}
+	for name, contents := range files {
+		full := filepath.Join(root, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(full), os.ModePerm|os.ModeDir)
+		if err == nil {
+			err = ioutil.WriteFile(full, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{".boweryignore", "build", "build/app", "build/assets",
+			"build/assets/app.js", "keep.log", "main.go", "src", "src/node_modules"}},
+		{"path=build", []string{"build", "build/app", "build/assets", "build/assets/app.js"}},
+		{"include=build/&include=*.go", []string{"build", "build/app", "build/assets",
+			"build/assets/app.js", "main.go"}},
+		{"exclude=build/assets&exclude=.*", []string{"build", "build/app", "keep.log",
+			"main.go", "src", "src/node_modules"}},
+		{"ignorefile=false&include=**/*.log", []string{"debug.log", "keep.log"}},
+	}
+
+	for _, c := range cases {
+		query, err := url.ParseQuery(c.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts, err := newTarOptions(root, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := make([]string, 0)
+		err = walkTar(opts, func(full, rel string, info os.FileInfo) error {
+			names = append(names, rel)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Error("Paths for", c.query, "aren't as expected", names)
+		}
+	}
+
+	_, err = newTarOptions(root, url.Values{"path": {"../other"}})
+	if _, ok := err.(*PathError); !ok {
+		t.Error("Expected path error got", err)
+	}
+}
+
+func TestTreeETag(t *testing.T) {
+	root, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fullPath := filepath.Join(root, "file")
+	err = ioutil.WriteFile(fullPath, []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	etag := func() string {
+		entries, err := listTar(&tarOptions{root: root, path: root})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return treeETag(entries)
+	}
+	first := etag()
+
+	if etag() != first {
+		t.Error("Etag should be the same for an unchanged tree")
+	}
+
+	err = os.Chtimes(fullPath, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if etag() == first {
+		t.Error("Etag should change when a paths stats change")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header     string
+		start, end int64
+		err        error
+	}{
+		{"bytes=0-", 0, 99, nil},
+		{"bytes=10-19", 10, 19, nil},
+		{"bytes=90-200", 90, 99, nil},
+		{"bytes=-10", 90, 99, nil},
+		{"bytes=-200", 0, 99, nil},
+		{"bytes=100-", 0, 0, errUnsatisfiableRange},
+		{"bytes=-0", 0, 0, errUnsatisfiableRange},
+		{"bytes=10-5", 0, 0, errInvalidRange},
+		{"bytes=0-1,5-6", 0, 0, errInvalidRange},
+		{"items=0-1", 0, 0, errInvalidRange},
+	}
+
+	for _, c := range cases {
+		start, end, err := parseRange(c.header, 100)
+		if err != c.err || start != c.start || end != c.end {
+			t.Error("Range", c.header, "isn't as expected", start, end, err)
+		}
+	}
+}
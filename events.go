@@ -0,0 +1,83 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// Number of events buffered for a subscriber before it's disconnected.
+const eventsBuffer = 64
+
+var broker = NewBroker()
+
+// Broker distributes the events published on a channel to the local
+// subscribers of the channel.
+type Broker struct {
+	channels map[string]map[chan *delancey.Event]bool
+	mutex    sync.Mutex
+}
+
+// NewBroker creates a broker with no subscribers.
+func NewBroker() *Broker {
+	return &Broker{channels: make(map[string]map[chan *delancey.Event]bool)}
+}
+
+// Subscribe creates a channel that receives the events published on the
+// given channel.
+func (broker *Broker) Subscribe(channel string) chan *delancey.Event {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	events := make(chan *delancey.Event, eventsBuffer)
+	subscribers, ok := broker.channels[channel]
+	if !ok {
+		subscribers = make(map[chan *delancey.Event]bool)
+		broker.channels[channel] = subscribers
+	}
+	subscribers[events] = true
+
+	return events
+}
+
+// Unsubscribe stops sending events to a channel created by Subscribe. It's
+// safe to call once the subscriber was disconnected.
+func (broker *Broker) Unsubscribe(channel string, events chan *delancey.Event) {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	subscribers, ok := broker.channels[channel]
+	if !ok {
+		return
+	}
+
+	delete(subscribers, events)
+	if len(subscribers) <= 0 {
+		delete(broker.channels, channel)
+	}
+}
+
+// Publish sends an event to the subscribers of a channel. Subscribers that
+// aren't keeping up are disconnected rather than block the publisher, their
+// channel is closed so they know events were missed.
+func (broker *Broker) Publish(channel string, event *delancey.Event) error {
+	broker.mutex.Lock()
+	defer broker.mutex.Unlock()
+
+	subscribers := broker.channels[channel]
+	for events := range subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(subscribers, events)
+			close(events)
+		}
+	}
+	if subscribers != nil && len(subscribers) <= 0 {
+		delete(broker.channels, channel)
+	}
+
+	return nil
+}
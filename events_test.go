@@ -0,0 +1,42 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+func TestBrokerDisconnectsSlowSubscriber(t *testing.T) {
+	broker := NewBroker()
+	slow := broker.Subscribe("some-channel")
+	fast := broker.Subscribe("some-channel")
+	defer broker.Unsubscribe("some-channel", fast)
+
+	for i := 0; i < eventsBuffer+1; i++ {
+		broker.Publish("some-channel", &delancey.Event{Name: delancey.UpdatedEvent})
+
+		// Keep the fast subscriber drained.
+		<-fast
+	}
+
+	received := 0
+	for range slow {
+		received++
+	}
+	if received != eventsBuffer {
+		t.Error("Slow subscriber should've received the buffered events, received", received)
+	}
+
+	// The fast subscriber still receives events.
+	broker.Publish("some-channel", &delancey.Event{Name: delancey.UpdatedEvent})
+	select {
+	case <-fast:
+	default:
+		t.Error("Fast subscriber should've received the event")
+	}
+
+	// Unsubscribing a disconnected subscriber is safe.
+	broker.Unsubscribe("some-channel", slow)
+}
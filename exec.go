@@ -0,0 +1,81 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// execWriter sends command output to a response as JSON messages, flushing
+// each message so the client receives output as it happens.
+type execWriter struct {
+	encoder *json.Encoder
+	flusher http.Flusher
+	mutex   sync.Mutex
+}
+
+// newExecWriter creates an execWriter writing to the response.
+func newExecWriter(rw http.ResponseWriter) *execWriter {
+	flusher, _ := rw.(http.Flusher)
+	return &execWriter{encoder: json.NewEncoder(rw), flusher: flusher}
+}
+
+// Send writes a single message to the response.
+func (ew *execWriter) Send(output *delancey.ExecOutput) error {
+	ew.mutex.Lock()
+	defer ew.mutex.Unlock()
+
+	err := ew.encoder.Encode(output)
+	if err == nil && ew.flusher != nil {
+		ew.flusher.Flush()
+	}
+
+	return err
+}
+
+// Stream creates a writer that sends the data written as output for the
+// given stream.
+func (ew *execWriter) Stream(stream string) io.Writer {
+	return &execStream{writer: ew, stream: stream}
+}
+
+// execStream is a writer for a single output stream of a command.
+type execStream struct {
+	writer *execWriter
+	stream string
+}
+
+func (es *execStream) Write(b []byte) (int, error) {
+	err := es.writer.Send(&delancey.ExecOutput{Stream: es.stream, Data: b})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// flushWriter flushes a response after every write.
+type flushWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+}
+
+// newFlushWriter creates a flushWriter writing to the response.
+func newFlushWriter(rw http.ResponseWriter) *flushWriter {
+	flusher, _ := rw.(http.Flusher)
+	return &flushWriter{writer: rw, flusher: flusher}
+}
+
+func (fw *flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.writer.Write(b)
+	if err == nil && fw.flusher != nil {
+		fw.flusher.Flush()
+	}
+
+	return n, err
+}
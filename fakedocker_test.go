@@ -0,0 +1,625 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	stdtar "archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Matches the API version some clients prefix endpoints with.
+var dockerVersionPrefix = regexp.MustCompile(`^/v[0-9.]+/`)
+
+// fakeImage is an image in the fake Docker Engine.
+type fakeImage struct {
+	ID  string
+	Env []string
+}
+
+// fakeHostConfig is the host config a container is created with.
+type fakeHostConfig struct {
+	Binds       []string
+	NetworkMode string
+	Privileged  bool
+}
+
+// fakeContainer is a container in the fake Docker Engine.
+type fakeContainer struct {
+	ID         string
+	Image      string
+	Cmd        []string
+	HostConfig fakeHostConfig
+	Running    bool
+}
+
+// fakeExec is an exec instance in the fake Docker Engine. Width and Height
+// are the TTY's size from the last resize.
+type fakeExec struct {
+	ID     string
+	Cmd    []string
+	Tty    bool
+	Width  int
+	Height int
+}
+
+// fakeFrame is a frame of a multiplexed stream, stream is 1 for stdout and
+// 2 for stderr.
+type fakeFrame struct {
+	stream byte
+	data   string
+}
+
+// fakeExecOutput is what exec instances write and exit with.
+type fakeExecOutput struct {
+	stdout   string
+	stderr   string
+	exitCode int
+}
+
+// fakeDocker is an in-process Docker Engine speaking the remote API
+// endpoints the agent uses. Images and containers are kept in memory, the
+// registry holds the images that can be pulled and receives pushes, and
+// every call is recorded.
+type fakeDocker struct {
+	*httptest.Server
+	images     map[string]*fakeImage
+	registry   map[string]*fakeImage
+	containers map[string]*fakeContainer
+	execs      map[string]*fakeExec
+	execOutput *fakeExecOutput
+	logs       []*fakeFrame
+	logsQuery  url.Values
+	changes    []string
+	calls      []string
+	nextID     int
+	mutex      sync.Mutex
+}
+
+// newFakeDocker starts a fake Docker Engine.
+func newFakeDocker() *fakeDocker {
+	fd := &fakeDocker{
+		images:     make(map[string]*fakeImage),
+		registry:   make(map[string]*fakeImage),
+		containers: make(map[string]*fakeContainer),
+		execs:      make(map[string]*fakeExec),
+	}
+	fd.Server = httptest.NewServer(http.HandlerFunc(fd.serveHTTP))
+
+	return fd
+}
+
+// Addr gets the address to give the Docker runtime.
+func (fd *fakeDocker) Addr() string {
+	return strings.Replace(fd.URL, "http://", "tcp://", 1)
+}
+
+// AddImage adds an image to the registry so it can be pulled.
+func (fd *fakeDocker) AddImage(name string, env ...string) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	fd.registry[fakeImageName(name, "")] = &fakeImage{ID: fd.newID("image"), Env: env}
+}
+
+// AddContainer adds a running container for the image, the ID is returned.
+func (fd *fakeDocker) AddContainer(image string) string {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	container := &fakeContainer{ID: fd.newID("container"), Image: image, Running: true}
+	fd.containers[container.ID] = container
+	return container.ID
+}
+
+// SetExecOutput sets what exec instances without a TTY write to stdout and
+// stderr, and the exit code all exec instances report. If it isn't set the
+// command is echoed to stdout and the exit code is 0.
+func (fd *fakeDocker) SetExecOutput(stdout, stderr string, exitCode int) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	fd.execOutput = &fakeExecOutput{stdout: stdout, stderr: stderr, exitCode: exitCode}
+}
+
+// Exec retrieves an exec instance by ID.
+func (fd *fakeDocker) Exec(id string) *fakeExec {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.execs[id]
+}
+
+// Execs lists the IDs of the exec instances created.
+func (fd *fakeDocker) Execs() []string {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	ids := make([]string, 0, len(fd.execs))
+	for id := range fd.execs {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// AddLog adds a frame to the logs containers report, stream is 1 for stdout
+// and 2 for stderr.
+func (fd *fakeDocker) AddLog(stream byte, data string) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	fd.logs = append(fd.logs, &fakeFrame{stream: stream, data: data})
+}
+
+// LogsQuery gets the query of the last logs request.
+func (fd *fakeDocker) LogsQuery() url.Values {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.logsQuery
+}
+
+// SetChanges sets the paths reported as changed in containers.
+func (fd *fakeDocker) SetChanges(changes ...string) {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	fd.changes = changes
+}
+
+// Called checks if an endpoint was called, the method and path are
+// separated by a space.
+func (fd *fakeDocker) Called(call string) bool {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	for _, c := range fd.calls {
+		if c == call {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Image retrieves a local image by name or ID.
+func (fd *fakeDocker) Image(name string) *fakeImage {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.image(name)
+}
+
+// Pushed retrieves an image pushed to the registry.
+func (fd *fakeDocker) Pushed(name string) *fakeImage {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.registry[fakeImageName(name, "")]
+}
+
+// Container retrieves a container by ID.
+func (fd *fakeDocker) Container(id string) *fakeContainer {
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+
+	return fd.containers[id]
+}
+
+// serveHTTP records the call and routes it to the endpoint.
+func (fd *fakeDocker) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	endpoint := dockerVersionPrefix.ReplaceAllString(req.URL.Path, "/")
+
+	fd.mutex.Lock()
+	defer fd.mutex.Unlock()
+	fd.calls = append(fd.calls, req.Method+" "+endpoint)
+
+	switch {
+	case req.Method == "POST" && endpoint == "/images/create":
+		fd.pull(rw, req)
+	case req.Method == "POST" && endpoint == "/build":
+		fd.build(rw, req)
+	case req.Method == "POST" && endpoint == "/commit":
+		fd.commit(rw, req)
+	case req.Method == "POST" && strings.HasPrefix(endpoint, "/images/") && strings.HasSuffix(endpoint, "/push"):
+		fd.push(rw, req, strings.TrimSuffix(strings.TrimPrefix(endpoint, "/images/"), "/push"))
+	case req.Method == "GET" && strings.HasPrefix(endpoint, "/images/") && strings.HasSuffix(endpoint, "/json"):
+		fd.inspectImage(rw, strings.TrimSuffix(strings.TrimPrefix(endpoint, "/images/"), "/json"))
+	case req.Method == "DELETE" && strings.HasPrefix(endpoint, "/images/"):
+		fd.removeImage(rw, strings.TrimPrefix(endpoint, "/images/"))
+	case req.Method == "POST" && endpoint == "/containers/create":
+		fd.create(rw, req)
+	case strings.HasPrefix(endpoint, "/containers/"):
+		fd.container(rw, req, strings.TrimPrefix(endpoint, "/containers/"))
+	case strings.HasPrefix(endpoint, "/exec/"):
+		fd.exec(rw, req, strings.TrimPrefix(endpoint, "/exec/"))
+	default:
+		http.Error(rw, "page not found", http.StatusNotFound)
+	}
+}
+
+// pull copies an image from the registry, streaming its progress.
+func (fd *fakeDocker) pull(rw http.ResponseWriter, req *http.Request) {
+	name := fakeImageName(req.FormValue("fromImage"), req.FormValue("tag"))
+	stream := json.NewEncoder(rw)
+	rw.Header().Set("Content-Type", "application/json")
+
+	image, ok := fd.registry[name]
+	if !ok {
+		msg := "Tag " + req.FormValue("tag") + " not found in repository " + req.FormValue("fromImage")
+		stream.Encode(map[string]interface{}{
+			"errorDetail": map[string]string{"message": msg},
+			"error":       msg,
+		})
+		return
+	}
+
+	stream.Encode(map[string]string{"status": "Pulling image (" + name + ")"})
+	for i := 1; i <= 2; i++ {
+		stream.Encode(map[string]interface{}{
+			"status":         "Downloading",
+			"id":             image.ID,
+			"progressDetail": map[string]int{"current": i, "total": 2},
+		})
+	}
+	stream.Encode(map[string]string{"status": "Download complete", "id": image.ID})
+	fd.tag(name, image)
+}
+
+// build builds an image from the Dockerfile in the tar body, a step is
+// streamed for each instruction. FROM has to use a local image and ENV
+// instructions are added to the images env.
+func (fd *fakeDocker) build(rw http.ResponseWriter, req *http.Request) {
+	dockerfile, err := fakeDockerfile(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stream := json.NewEncoder(rw)
+	rw.Header().Set("Content-Type", "application/json")
+	image := &fakeImage{ID: fd.newID("image")}
+	step := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(dockerfile))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		stream.Encode(map[string]string{"stream": fmt.Sprintf("Step %d : %s\n", step, line)})
+		step++
+
+		fields := strings.Fields(line)
+		switch strings.ToUpper(fields[0]) {
+		case "FROM":
+			base := fd.image(fields[1])
+			if base == nil {
+				msg := "Error: image " + fields[1] + " not found"
+				stream.Encode(map[string]interface{}{
+					"errorDetail": map[string]string{"message": msg},
+					"error":       msg,
+				})
+				return
+			}
+
+			image.Env = append(image.Env, base.Env...)
+		case "ENV":
+			if len(fields) >= 3 {
+				image.Env = append(image.Env, fields[1]+"="+strings.Join(fields[2:], " "))
+			}
+		}
+	}
+
+	stream.Encode(map[string]string{"stream": "Successfully built " + image.ID + "\n"})
+	fd.tag(image.ID, image)
+	if repo := req.FormValue("t"); repo != "" {
+		fd.tag(fakeImageName(repo, ""), image)
+	}
+}
+
+// commit creates an image from a container.
+func (fd *fakeDocker) commit(rw http.ResponseWriter, req *http.Request) {
+	container, ok := fd.containers[req.FormValue("container")]
+	if !ok {
+		http.Error(rw, "No such container: "+req.FormValue("container"), http.StatusNotFound)
+		return
+	}
+
+	image := &fakeImage{ID: fd.newID("image")}
+	if base := fd.image(container.Image); base != nil {
+		image.Env = base.Env
+	}
+	fd.tag(image.ID, image)
+	if repo := req.FormValue("repo"); repo != "" {
+		fd.tag(fakeImageName(repo, req.FormValue("tag")), image)
+	}
+
+	writeFakeJSON(rw, http.StatusCreated, map[string]string{"Id": image.ID})
+}
+
+// push copies a local image to the registry, streaming its progress.
+func (fd *fakeDocker) push(rw http.ResponseWriter, req *http.Request, name string) {
+	name = fakeImageName(name, req.FormValue("tag"))
+	image := fd.image(name)
+	if image == nil {
+		http.Error(rw, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+	stream := json.NewEncoder(rw)
+	rw.Header().Set("Content-Type", "application/json")
+
+	stream.Encode(map[string]string{"status": "The push refers to a repository [" + name + "]"})
+	for i := 1; i <= 2; i++ {
+		stream.Encode(map[string]interface{}{
+			"status":         "Pushing",
+			"id":             image.ID,
+			"progressDetail": map[string]int{"current": i, "total": 2},
+		})
+	}
+	stream.Encode(map[string]string{"status": "Image successfully pushed", "id": image.ID})
+	fd.registry[name] = image
+}
+
+// inspectImage responds with a local image.
+func (fd *fakeDocker) inspectImage(rw http.ResponseWriter, name string) {
+	image := fd.image(name)
+	if image == nil {
+		http.Error(rw, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	writeFakeJSON(rw, http.StatusOK, map[string]interface{}{
+		"Id":     image.ID,
+		"Config": map[string]interface{}{"Env": image.Env},
+	})
+}
+
+// removeImage removes a local image and its tags.
+func (fd *fakeDocker) removeImage(rw http.ResponseWriter, name string) {
+	image := fd.image(name)
+	if image == nil {
+		http.Error(rw, "No such image: "+name, http.StatusNotFound)
+		return
+	}
+
+	deleted := make([]map[string]string, 0)
+	for key, img := range fd.images {
+		if img == image {
+			delete(fd.images, key)
+			deleted = append(deleted, map[string]string{"Untagged": key})
+		}
+	}
+
+	writeFakeJSON(rw, http.StatusOK, append(deleted, map[string]string{"Deleted": image.ID}))
+}
+
+// create creates a container from a local image.
+func (fd *fakeDocker) create(rw http.ResponseWriter, req *http.Request) {
+	body := new(struct {
+		Image      string
+		Cmd        []string
+		HostConfig fakeHostConfig
+	})
+	err := json.NewDecoder(req.Body).Decode(body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	image := fd.image(body.Image)
+	if image == nil {
+		http.Error(rw, "No such image: "+body.Image, http.StatusNotFound)
+		return
+	}
+
+	container := &fakeContainer{ID: fd.newID("container"), Image: image.ID, Cmd: body.Cmd, HostConfig: body.HostConfig}
+	fd.containers[container.ID] = container
+	writeFakeJSON(rw, http.StatusCreated, map[string]interface{}{"Id": container.ID, "Warnings": nil})
+}
+
+// container handles the endpoints for an existing container.
+func (fd *fakeDocker) container(rw http.ResponseWriter, req *http.Request, rest string) {
+	parts := strings.SplitN(rest, "/", 2)
+	container, ok := fd.containers[parts[0]]
+	if !ok {
+		http.Error(rw, "No such container: "+parts[0], http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	switch {
+	case req.Method == "POST" && action == "start":
+		container.Running = true
+		rw.WriteHeader(http.StatusNoContent)
+	case req.Method == "POST" && action == "stop":
+		container.Running = false
+		rw.WriteHeader(http.StatusNoContent)
+	case req.Method == "GET" && action == "json":
+		writeFakeJSON(rw, http.StatusOK, map[string]interface{}{
+			"Id":    container.ID,
+			"Image": container.Image,
+			"State": map[string]bool{"Running": container.Running},
+		})
+	case req.Method == "GET" && action == "changes":
+		changes := make([]map[string]interface{}, 0, len(fd.changes))
+		for _, path := range fd.changes {
+			changes = append(changes, map[string]interface{}{"Path": path, "Kind": 0})
+		}
+
+		writeFakeJSON(rw, http.StatusOK, changes)
+	case req.Method == "GET" && action == "logs":
+		fd.logsQuery = req.URL.Query()
+
+		rw.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		for _, frame := range fd.logs {
+			writeFakeFrame(rw, frame.stream, frame.data)
+		}
+	case req.Method == "POST" && action == "exec":
+		body := new(struct {
+			Cmd []string
+			Tty bool
+		})
+		json.NewDecoder(req.Body).Decode(body)
+		exec := &fakeExec{ID: fd.newID("exec"), Cmd: body.Cmd, Tty: body.Tty}
+		fd.execs[exec.ID] = exec
+
+		writeFakeJSON(rw, http.StatusCreated, map[string]string{"Id": exec.ID})
+	case req.Method == "DELETE" && action == "":
+		delete(fd.containers, container.ID)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(rw, "page not found", http.StatusNotFound)
+	}
+}
+
+// exec handles the endpoints for an exec instance. Without a TTY the output
+// is sent as a multiplexed stream, with one the connection is hijacked and
+// the input is echoed back raw until the client closes it.
+func (fd *fakeDocker) exec(rw http.ResponseWriter, req *http.Request, rest string) {
+	parts := strings.SplitN(rest, "/", 2)
+	exec, ok := fd.execs[parts[0]]
+	if !ok || len(parts) < 2 {
+		http.Error(rw, "No such exec instance: "+parts[0], http.StatusNotFound)
+		return
+	}
+	output := fd.execOutput
+	if output == nil {
+		output = &fakeExecOutput{stdout: strings.Join(exec.Cmd, " ") + "\n"}
+	}
+
+	switch parts[1] {
+	case "start":
+		if exec.Tty {
+			fd.hijackExec(rw)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		writeFakeFrame(rw, 1, output.stdout)
+		writeFakeFrame(rw, 2, output.stderr)
+	case "resize":
+		exec.Width, _ = strconv.Atoi(req.FormValue("w"))
+		exec.Height, _ = strconv.Atoi(req.FormValue("h"))
+		rw.WriteHeader(http.StatusCreated)
+	case "json":
+		writeFakeJSON(rw, http.StatusOK, map[string]interface{}{"ID": exec.ID, "Running": false, "ExitCode": output.exitCode})
+	default:
+		http.Error(rw, "page not found", http.StatusNotFound)
+	}
+}
+
+// hijackExec takes over the connection for an exec instance with a TTY, the
+// input is echoed back in the background.
+func (fd *fakeDocker) hijackExec(rw http.ResponseWriter) {
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		http.Error(rw, "Hijacking isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	io.WriteString(conn, "HTTP/1.1 101 UPGRADED\r\n"+
+		"Content-Type: application/vnd.docker.raw-stream\r\n"+
+		"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	go func() {
+		defer conn.Close()
+		io.Copy(conn, buf)
+	}()
+}
+
+// writeFakeFrame writes a frame of a multiplexed stream, empty frames are
+// skipped.
+func writeFakeFrame(w io.Writer, stream byte, data string) {
+	if data == "" {
+		return
+	}
+
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	w.Write(append(header, data...))
+}
+
+// image gets a local image by name or ID.
+func (fd *fakeDocker) image(name string) *fakeImage {
+	if image, ok := fd.images[name]; ok {
+		return image
+	}
+
+	return fd.images[fakeImageName(name, "")]
+}
+
+// tag stores a local image under a name.
+func (fd *fakeDocker) tag(name string, image *fakeImage) {
+	fd.images[name] = image
+	fd.images[image.ID] = image
+}
+
+// newID creates a unique ID with a prefix.
+func (fd *fakeDocker) newID(prefix string) string {
+	fd.nextID++
+	return fmt.Sprintf("%s%012d", prefix, fd.nextID)
+}
+
+// fakeImageName gets the full name for an image, the tag defaults to latest.
+func fakeImageName(name, tag string) string {
+	if tag != "" {
+		return name + ":" + tag
+	}
+	if strings.LastIndex(name, ":") > strings.LastIndex(name, "/") {
+		return name
+	}
+
+	return name + ":latest"
+}
+
+// fakeDockerfile finds the Dockerfile in a build context.
+func fakeDockerfile(context io.Reader) (string, error) {
+	tarReader := stdtar.NewReader(context)
+
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("Cannot locate Dockerfile")
+			}
+
+			return "", err
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == "Dockerfile" {
+			contents, err := ioutil.ReadAll(tarReader)
+			return string(contents), err
+		}
+	}
+}
+
+// writeFakeJSON writes a JSON response.
+func writeFakeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(body)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	io.Copy(rw, &buf)
+}
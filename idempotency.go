@@ -0,0 +1,161 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// How long the result of a request with an idempotency key is kept.
+var idempotencyTTL = 10 * time.Minute
+
+var idempotency = NewIdempotencyStore()
+
+// Result is a response recorded for an idempotency key.
+type Result struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// idempotentRequest is a request with an idempotency key. Done is closed
+// once the request finishes, and result is set if it succeeded.
+type idempotentRequest struct {
+	result  *Result
+	done    chan struct{}
+	expires time.Time
+}
+
+// IdempotencyStore holds the results of requests by their idempotency key,
+// so retried requests aren't applied again. Only successful results are
+// kept, if a request fails a retry runs it again. Results aren't persisted.
+type IdempotencyStore struct {
+	requests map[string]*idempotentRequest
+	mutex    sync.Mutex
+}
+
+// NewIdempotencyStore creates an empty idempotency store.
+func NewIdempotencyStore() *IdempotencyStore {
+	return &IdempotencyStore{requests: make(map[string]*idempotentRequest)}
+}
+
+// Start starts the request for a key. If a request with the key already
+// succeeded its result is returned, and if one is running it waits for it to
+// finish. When nil is returned the caller runs the request and must call
+// Finish afterwards.
+func (is *IdempotencyStore) Start(key string) *Result {
+	for {
+		is.mutex.Lock()
+		is.prune()
+
+		request, ok := is.requests[key]
+		if !ok {
+			is.requests[key] = &idempotentRequest{done: make(chan struct{})}
+			is.mutex.Unlock()
+			return nil
+		}
+		is.mutex.Unlock()
+
+		<-request.done
+		if request.result != nil {
+			return request.result
+		}
+	}
+}
+
+// Finish finishes the request for a key, the result is kept if the status
+// is successful.
+func (is *IdempotencyStore) Finish(key string, result *Result) {
+	is.mutex.Lock()
+	defer is.mutex.Unlock()
+
+	request, ok := is.requests[key]
+	if !ok {
+		return
+	}
+
+	if result.Status >= 200 && result.Status < 300 {
+		request.result = result
+		request.expires = time.Now().Add(idempotencyTTL)
+	} else {
+		delete(is.requests, key)
+	}
+	close(request.done)
+}
+
+// prune removes the expired results.
+func (is *IdempotencyStore) prune() {
+	now := time.Now()
+
+	for key, request := range is.requests {
+		if request.result != nil && now.After(request.expires) {
+			delete(is.requests, key)
+		}
+	}
+}
+
+// resultRecorder writes a response while recording it.
+type resultRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *resultRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *resultRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+
+	return rr.ResponseWriter.Write(b)
+}
+
+// idempotent wraps a handler so requests with an idempotency key are only
+// applied once, retries get the response of the request that succeeded.
+// Keys are scoped to the requests method and path.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get(delancey.IdempotencyKeyHeader)
+		if key == "" {
+			handler(rw, req)
+			return
+		}
+		key = req.Method + " " + req.URL.Path + " " + key
+
+		result := idempotency.Start(key)
+		if result != nil {
+			for name, values := range result.Header {
+				rw.Header()[name] = values
+			}
+			rw.WriteHeader(result.Status)
+			rw.Write(result.Body)
+			return
+		}
+
+		recorder := &resultRecorder{ResponseWriter: rw}
+		defer func() {
+			header := make(http.Header)
+			for name, values := range rw.Header() {
+				header[name] = values
+			}
+
+			idempotency.Finish(key, &Result{
+				Status: recorder.status,
+				Header: header,
+				Body:   recorder.body.Bytes(),
+			})
+		}()
+
+		handler(recorder, req)
+	}
+}
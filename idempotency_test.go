@@ -0,0 +1,106 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+func TestIdempotent(t *testing.T) {
+	idempotency = NewIdempotencyStore()
+	calls := 0
+	handler := idempotent(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.WriteHeader(http.StatusAccepted)
+		io.WriteString(rw, "job-1")
+	})
+
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/containers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(delancey.IdempotencyKeyHeader, "some-key")
+
+		res := httptest.NewRecorder()
+		handler(res, req)
+		if res.Code != http.StatusAccepted || res.Body.String() != "job-1" ||
+			res.Header().Get("Content-Type") != "text/plain" {
+			t.Error("Response isn't the original result", res.Code, res.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Error("Request with the same key should've been applied once, applied", calls)
+	}
+
+	// Requests without a key or with another key are applied.
+	for _, key := range []string{"", "other-key"} {
+		req, err := http.NewRequest("POST", "/containers", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.Header.Set(delancey.IdempotencyKeyHeader, key)
+		}
+
+		handler(httptest.NewRecorder(), req)
+	}
+	if calls != 3 {
+		t.Error("Requests without the key should've been applied, applied", calls)
+	}
+}
+
+func TestIdempotentFailure(t *testing.T) {
+	idempotency = NewIdempotencyStore()
+	calls := 0
+	handler := idempotent(func(rw http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.WriteHeader(http.StatusOK)
+	})
+
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("PUT", "/containers/some-id/save", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(delancey.IdempotencyKeyHeader, "some-key")
+
+		handler(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 {
+		t.Error("Failed request should've been applied again on retry, applied", calls)
+	}
+}
+
+func TestIdempotencyStoreExpires(t *testing.T) {
+	store := NewIdempotencyStore()
+	prevTTL := idempotencyTTL
+	idempotencyTTL = time.Millisecond
+	defer func() { idempotencyTTL = prevTTL }()
+
+	if store.Start("some-key") != nil {
+		t.Fatal("Key shouldn't have a result yet")
+	}
+	store.Finish("some-key", &Result{Status: http.StatusOK})
+	if store.Start("some-key") == nil {
+		t.Error("Key should have the original result")
+	}
+
+	<-time.After(5 * time.Millisecond)
+	if store.Start("some-key") != nil {
+		t.Error("Result should've expired")
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// How long a finished job is kept around for clients to retrieve.
+const jobExpiration = time.Hour
+
+var jobs = NewJobStore()
+
+// Job tracks the progress of work done in the background.
+type Job struct {
+	job   delancey.Job
+	store *JobStore
+	mutex sync.RWMutex
+}
+
+// SetStep sets the name of the step the job is currently running.
+func (job *Job) SetStep(step string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.job.Step = step
+}
+
+// SetProgress sets the fraction of the job that has completed.
+func (job *Job) SetProgress(prog float64) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+
+	job.job.Progress = prog
+}
+
+// Finish marks the job as complete, if err is non nil the job has failed.
+// The job is removed from its store once it expires.
+func (job *Job) Finish(container *schemas.Container, err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	time.AfterFunc(jobExpiration, func() {
+		job.store.remove(job.job.ID)
+	})
+
+	if err != nil {
+		job.job.Status = delancey.JobFailed
+		job.job.Error = err.Error()
+	} else {
+		job.job.Status = delancey.JobSucceeded
+		job.job.Progress = 1
+		job.job.Container = container
+	}
+}
+
+// Info retrieves a copy of the jobs current info.
+func (job *Job) Info() *delancey.Job {
+	job.mutex.RLock()
+	defer job.mutex.RUnlock()
+
+	info := job.job
+	return &info
+}
+
+// JobStore holds the jobs on the agent keyed by their ID.
+type JobStore struct {
+	jobs  map[string]*Job
+	mutex sync.RWMutex
+}
+
+// NewJobStore creates an empty job store.
+func NewJobStore() *JobStore {
+	return &JobStore{jobs: make(map[string]*Job)}
+}
+
+// Create creates a running job.
+func (store *JobStore) Create() *Job {
+	job := &Job{store: store, job: delancey.Job{
+		ID:     uuid.New(),
+		Status: delancey.JobRunning,
+	}}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.jobs[job.job.ID] = job
+	return job
+}
+
+// Get retrieves the job with the given ID, nil is returned if it doesn't
+// exist.
+func (store *JobStore) Get(id string) *Job {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.jobs[id]
+}
+
+// remove removes the job with the given ID.
+func (store *JobStore) remove(id string) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.jobs, id)
+}
@@ -0,0 +1,285 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/config"
+	loggly "github.com/segmentio/go-loggly"
+	"github.com/timonv/pusher"
+)
+
+// Timeout for delivering an event to a webhook.
+const webhookTimeout = 10 * time.Second
+
+// Number of events queued for a slow publisher, events are dropped once
+// it's full.
+const publishQueueSize = 256
+
+// Channel log events are sent on.
+const logChannel = "agent"
+
+// Levels for log events.
+const (
+	logInfo  = "info"
+	logError = "error"
+)
+
+// ErrPublishQueueFull is used when an event is dropped because a publisher
+// isn't keeping up.
+var ErrPublishQueueFull = errors.New("The publishers queue is full")
+
+// Publisher used to send progress, lifecycle and log events.
+var publisher Publisher = broker
+
+// Publisher sends events that occur on a channel somewhere.
+type Publisher interface {
+	Publish(channel string, event *delancey.Event) error
+}
+
+// NewPublisher creates a publisher from a comma separated list of publisher
+// names, the local broker is included unless the name is none. The webhook
+// URL is only used if the webhook publisher is included. Publishers sending
+// events over the network are queued so they don't block the caller.
+func NewPublisher(names, webhook string) (Publisher, error) {
+	if strings.TrimSpace(names) == "none" {
+		return NopPublisher{}, nil
+	}
+	publishers := Publishers{broker}
+
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "pusher":
+			publishers = append(publishers, NewAsyncPublisher(NewPusherPublisher()))
+		case "loggly":
+			publishers = append(publishers, NewAsyncPublisher(NewLogglyPublisher()))
+		case "stdout":
+			publishers = append(publishers, NewJSONPublisher(os.Stdout))
+		case "webhook":
+			if webhook == "" {
+				return nil, errors.New("A webhook URL is required for the webhook publisher")
+			}
+
+			publishers = append(publishers, NewAsyncPublisher(NewWebhookPublisher(webhook)))
+		default:
+			return nil, errors.New("Unknown publisher " + name)
+		}
+	}
+
+	return publishers, nil
+}
+
+// Publishers sends events to multiple publishers.
+type Publishers []Publisher
+
+// Publish sends the event to all the publishers, the first error that
+// occurs is returned.
+func (publishers Publishers) Publish(channel string, event *delancey.Event) error {
+	var err error
+
+	for _, publisher := range publishers {
+		perr := publisher.Publish(channel, event)
+		if perr != nil && err == nil {
+			err = perr
+		}
+	}
+
+	return err
+}
+
+// queuedEvent is an event waiting to be sent by an async publisher.
+type queuedEvent struct {
+	channel string
+	event   *delancey.Event
+}
+
+// AsyncPublisher sends events to a publisher in the background, in the
+// order they were published. Failures are logged since nothing waits on
+// them.
+type AsyncPublisher struct {
+	publisher Publisher
+	queue     chan *queuedEvent
+}
+
+// NewAsyncPublisher creates a publisher queueing events for the given
+// publisher.
+func NewAsyncPublisher(publisher Publisher) *AsyncPublisher {
+	ap := &AsyncPublisher{
+		publisher: publisher,
+		queue:     make(chan *queuedEvent, publishQueueSize),
+	}
+	go ap.run()
+
+	return ap
+}
+
+// Publish queues the event, if the queue is full the event is dropped and
+// Channel log events are sent on.
+const logChannel = "agent"
+
+// Levels for log events.
+const (
+	logInfo  = "info"
+	logError = "error"
+)
+
+// ErrPublishQueueFull is returned.
+func (ap *AsyncPublisher) Publish(channel string, event *delancey.Event) error {
+	select {
+	case ap.queue <- &queuedEvent{channel: channel, event: event}:
+		return nil
+	default:
+		log.Println("Dropping event", event.Name, "for", channel+":", ErrPublishQueueFull)
+		return ErrPublishQueueFull
+	}
+}
+
+// run sends the queued events.
+func (ap *AsyncPublisher) run() {
+	for queued := range ap.queue {
+		err := ap.publisher.Publish(queued.channel, queued.event)
+		if err != nil {
+			log.Println("Publishing event", queued.event.Name, "for", queued.channel, "failed:", err)
+		}
+	}
+}
+
+// NopPublisher drops all events.
+type NopPublisher struct{}
+
+// Publish does nothing.
+func (nop NopPublisher) Publish(channel string, event *delancey.Event) error {
+	return nil
+}
+
+// PusherPublisher sends events to Pusher.
+type PusherPublisher struct {
+	client *pusher.Client
+}
+
+// NewPusherPublisher creates a publisher using Bowery's Pusher app.
+func NewPusherPublisher() *PusherPublisher {
+	return &PusherPublisher{
+		client: pusher.NewClient(config.PusherAppID, config.PusherKey, config.PusherSecret),
+	}
+}
+
+// Publish sends the event to the Pusher channel.
+func (pp *PusherPublisher) Publish(channel string, event *delancey.Event) error {
+	return pp.client.Publish(event.Data, event.Name, channel)
+}
+
+// logEntry is the data sent with a log event.
+type logEntry struct {
+	Level   string                 `json:"level"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields"`
+}
+
+// LogglyPublisher sends log events to Loggly, other events are ignored.
+type LogglyPublisher struct {
+	client *loggly.Client
+}
+
+// NewLogglyPublisher creates a publisher using Bowery's Loggly account.
+func NewLogglyPublisher() *LogglyPublisher {
+	return &LogglyPublisher{client: loggly.New(config.LogglyKey, "agent")}
+}
+
+// Publish sends the log event to Loggly at the events level.
+func (lp *LogglyPublisher) Publish(channel string, event *delancey.Event) error {
+	if event.Name != delancey.LogEvent {
+		return nil
+	}
+
+	entry := new(logEntry)
+	err := json.Unmarshal([]byte(event.Data), entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.Level == logError {
+		return lp.client.Error(entry.Message, entry.Fields)
+	}
+	return lp.client.Info(entry.Message, entry.Fields)
+}
+
+// publishedEvent is the format of events sent by the JSON and webhook
+// publishers.
+type publishedEvent struct {
+	Channel string `json:"channel"`
+	*delancey.Event
+	Time time.Time `json:"time"`
+}
+
+// JSONPublisher writes events as lines of JSON.
+type JSONPublisher struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+// NewJSONPublisher creates a publisher writing to the given writer.
+func NewJSONPublisher(writer io.Writer) *JSONPublisher {
+	return &JSONPublisher{writer: writer}
+}
+
+// Publish writes the event as a single line.
+func (jp *JSONPublisher) Publish(channel string, event *delancey.Event) error {
+	dat, err := json.Marshal(&publishedEvent{Channel: channel, Event: event, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	jp.mutex.Lock()
+	defer jp.mutex.Unlock()
+	_, err = jp.writer.Write(append(dat, '\n'))
+	return err
+}
+
+// WebhookPublisher sends events as JSON in a POST request to a URL.
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookPublisher creates a publisher sending to the given URL.
+func NewWebhookPublisher(url string) *WebhookPublisher {
+	return &WebhookPublisher{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+}
+
+// Publish posts the event to the webhook, non 2xx responses are errors.
+func (wp *WebhookPublisher) Publish(channel string, event *delancey.Event) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	err := encoder.Encode(&publishedEvent{Channel: channel, Event: event, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	res, err := wp.client.Post(wp.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return errors.New("Webhook responded with " + res.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+var testEvent = &delancey.Event{Name: delancey.StepEvent, Data: "Testing"}
+
+func TestJSONPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewJSONPublisher(&buf).Publish("some-channel", testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := new(publishedEvent)
+	err = json.Unmarshal(buf.Bytes(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Channel != "some-channel" || event.Name != testEvent.Name || event.Data != testEvent.Data {
+		t.Error("Published event doesn't match what was sent")
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	events := make(chan *publishedEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		event := new(publishedEvent)
+		json.NewDecoder(req.Body).Decode(event)
+		events <- event
+	}))
+	defer server.Close()
+
+	err := NewWebhookPublisher(server.URL).Publish("some-channel", testEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-events
+	if event.Channel != "some-channel" || event.Name != testEvent.Name || event.Data != testEvent.Data {
+		t.Error("Webhook event doesn't match what was sent")
+	}
+}
+
+func TestWebhookPublisherFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	err := NewWebhookPublisher(server.URL).Publish("some-channel", testEvent)
+	if err == nil {
+		t.Error("Publish should've failed but didn't")
+	}
+}
+
+// blockingPublisher blocks publishing until it's released.
+type blockingPublisher struct {
+	release chan struct{}
+	events  chan *delancey.Event
+}
+
+func (bp *blockingPublisher) Publish(channel string, event *delancey.Event) error {
+	<-bp.release
+	bp.events <- event
+	return nil
+}
+
+func TestAsyncPublisher(t *testing.T) {
+	blocking := &blockingPublisher{
+		release: make(chan struct{}),
+		events:  make(chan *delancey.Event, publishQueueSize+1),
+	}
+	async := NewAsyncPublisher(blocking)
+
+	published := make(chan error, 1)
+	go func() {
+		published <- async.Publish("some-channel", testEvent)
+	}()
+
+	select {
+	case err := <-published:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a slow publisher")
+	}
+
+	close(blocking.release)
+	select {
+	case event := <-blocking.events:
+		if event != testEvent {
+			t.Error("Queued event doesn't match what was sent")
+		}
+	case <-time.After(time.Second):
+		t.Error("Queued event wasn't sent")
+	}
+}
+
+func TestAsyncPublisherFull(t *testing.T) {
+	blocking := &blockingPublisher{
+		release: make(chan struct{}),
+		events:  make(chan *delancey.Event, publishQueueSize+1),
+	}
+	defer close(blocking.release)
+	async := NewAsyncPublisher(blocking)
+
+	// One event is taken off the queue by the blocked publisher.
+	var err error
+	for i := 0; i < publishQueueSize+2 && err == nil; i++ {
+		err = async.Publish("some-channel", testEvent)
+	}
+
+	if err != ErrPublishQueueFull {
+		t.Error("Publishing to a full queue should've failed with ErrPublishQueueFull")
+	}
+}
+
+func TestNewPublisherUnknown(t *testing.T) {
+	_, err := NewPublisher("stdout,carrier-pigeon", "")
+	if err == nil {
+		t.Error("Unknown publisher should've failed but didn't")
+	}
+}
+
+func TestNewPublisherNone(t *testing.T) {
+	pub, err := NewPublisher("none", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := pub.(NopPublisher); !ok {
+		t.Error("None shouldn't include any publishers, got", pub)
+	}
+}
+
+func TestSendLog(t *testing.T) {
+	var buf bytes.Buffer
+	defer func(pub Publisher) { publisher = pub }(publisher)
+	publisher = NewJSONPublisher(&buf)
+
+	err := sendLog(logError, "some-error", map[string]interface{}{"container": "some-id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := new(publishedEvent)
+	entry := new(logEntry)
+	err = json.Unmarshal(buf.Bytes(), event)
+	if err == nil {
+		err = json.Unmarshal([]byte(event.Data), entry)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Channel != logChannel || event.Name != delancey.LogEvent {
+		t.Error("Log event sent to the wrong channel", event.Channel, event.Name)
+	}
+	if entry.Level != logError || entry.Message != "some-error" || entry.Fields["container"] != "some-id" {
+		t.Error("Log entry doesn't match what was sent", entry)
+	}
+}
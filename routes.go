@@ -7,29 +7,33 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/Bowery/delancey/delancey"
 	"github.com/Bowery/gopackages/config"
-	"github.com/Bowery/gopackages/docker"
-	"github.com/Bowery/gopackages/docker/quay"
 	"github.com/Bowery/gopackages/path"
 	"github.com/Bowery/gopackages/requests"
-	"github.com/Bowery/gopackages/tar"
+	"github.com/Bowery/gopackages/schemas"
 	"github.com/Bowery/gopackages/web"
 	"github.com/Bowery/kenmare/kenmare"
+	"github.com/gorilla/mux"
 	"github.com/unrolled/render"
 )
 
 const (
 	// 32 MB, same as http.
 	httpMaxMem = 32 << 10
+
+	// How often to keep idle event streams alive.
+	eventsKeepAlive = 15 * time.Second
 )
 
 // Dockerfile contents to use when creating an image.
@@ -52,6 +56,12 @@ var (
 	boweryDir = filepath.Join(homeDir, ".bowery")
 )
 
+// imageSaved tells Kenmare a containers image was pushed, tests replace it so
+// Kenmare isn't contacted.
+var imageSaved = func(imageID string) {
+	kenmare.UpdateImage(imageID)
+}
+
 var renderer = render.New(render.Options{
 	IndentJSON:    true,
 	IsDevelopment: true,
@@ -59,31 +69,59 @@ var renderer = render.New(render.Options{
 
 // List of named routes.
 var Routes = []web.Route{
-	{"GET", "/", indexHandler, false},
-	{"POST", "/", createContainerHandler, false},
-	{"PUT", "/", uploadContainerHandler, false},
-	{"PATCH", "/", updateContainerHandler, false},
-	{"PATCH", "/batch", batchUpdateContainerHandler, false},
-	{"PUT", "/containers", saveContainerHandler, false},
-	{"DELETE", "/", removeContainerHandler, false},
-	{"PUT", "/ssh", uploadSSHHandler, false},
+	{"GET", "/containers", listContainersHandler, false},
+	{"POST", "/containers", idempotent(createContainerHandler), false},
+	{"GET", "/containers/{id}", downloadContainerHandler, false},
+	{"PUT", "/containers/{id}", uploadContainerHandler, false},
+	{"PATCH", "/containers/{id}", idempotent(updateContainerHandler), false},
+	{"POST", "/containers/{id}/sessions/{session}", createSessionHandler, false},
+	{"GET", "/containers/{id}/sessions/{session}", sessionHandler, false},
+	{"PATCH", "/containers/{id}/batch", idempotent(batchUpdateContainerHandler), false},
+	{"GET", "/containers/{id}/manifest", manifestHandler, false},
+	{"GET", "/containers/{id}/signature", signatureHandler, false},
+	{"PATCH", "/containers/{id}/delta", deltaUpdateContainerHandler, false},
+	{"PUT", "/containers/{id}/save", idempotent(saveContainerHandler), false},
+	{"DELETE", "/containers/{id}", removeContainerHandler, false},
+	{"PUT", "/containers/{id}/ssh", uploadSSHHandler, false},
+	{"POST", "/containers/{id}/exec", execHandler, false},
+	{"GET", "/containers/{id}/terminal", terminalHandler, false},
+	{"GET", "/containers/{id}/logs", logsHandler, false},
+	{"GET", "/containers/{id}/changes", changesHandler, false},
+	{"POST", "/containers/{id}/stop", stopContainerHandler, false},
+	{"POST", "/containers/{id}/start", startContainerHandler, false},
+	{"POST", "/containers/{id}/restart", restartContainerHandler, false},
+	{"GET", "/jobs/{id}", jobHandler, false},
+	{"GET", "/events", eventsHandler, false},
 	{"GET", "/healthz", healthzHandler, false},
-	{"GET", "/_/state/container", containerStateHandler, false},
+	{"GET", "/_/state/containers", containerStateHandler, false},
+	{"GET", "/_/state/container", legacyContainerStateHandler, false},
 	{"POST", "/_/pull", pullImageHandler, false},
 }
 
-// GET /, Retrieve the containers code.
-func indexHandler(rw http.ResponseWriter, req *http.Request) {
-	var (
-		contents io.Reader
-		err      error
-	)
-	empty, gzipWriter, tarWriter := tar.NewTarGZ()
-	tarWriter.Close()
-	gzipWriter.Close()
+// GET /containers, List the containers on the agent without their private
+// fields.
+func listContainersHandler(rw http.ResponseWriter, req *http.Request) {
+	list := containers.List()
+	containersCopy := make([]*schemas.Container, len(list))
+
+	for i, container := range list {
+		containersCopy[i] = container.Public()
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":     requests.StatusSuccess,
+		"containers": containersCopy,
+	})
+}
 
+// GET /containers/{id}, Retrieve the containers code. The code is streamed as
+// a gzipped tar, a single byte range can be requested to resume a download.
+// The path, include, exclude and ignorefile query fields choose which paths
+// are included.
+func downloadContainerHandler(rw http.ResponseWriter, req *http.Request) {
 	// Require a container to exist.
-	if currentContainer == nil {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -91,36 +129,93 @@ func indexHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Tar the contents of the container.
-	contents, err = tar.Tar(currentContainer.RemotePath, []string{})
-	if err != nil && !os.IsNotExist(err) {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+	opts, err := newTarOptions(container.RemotePath, req.URL.Query())
+	if err != nil {
+		if _, ok := err.(*PathError); ok {
+			renderPathError(rw, err)
+			return
+		}
+
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
 
-	// If the path didn't exist, just provide an empty targz stream.
+	entries, err := listTar(opts)
 	if err != nil {
-		contents = empty
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	etag := treeETag(entries)
+	rw.Header().Set("Content-Type", "application/x-gzip")
+	rw.Header().Set("Accept-Ranges", "bytes")
+	rw.Header().Set("ETag", etag)
+
+	// Ranges are only served if the tree hasn't changed since the etag the
+	// client has, full downloads are streamed as they're compressed.
+	rangeHeader := req.Header.Get("Range")
+	ifRange := req.Header.Get("If-Range")
+	if rangeHeader == "" || (ifRange != "" && ifRange != etag) {
+		rw.WriteHeader(http.StatusOK)
+		err = writeTar(rw, entries)
+		if err != nil {
+			log.Println("Failed to write container", container.ID, err)
+		}
+		return
 	}
 
-	rw.WriteHeader(http.StatusOK)
-	io.Copy(rw, contents)
-}
-
-// POST /, Create container.
-func createContainerHandler(rw http.ResponseWriter, req *http.Request) {
-	// Only allow one container at a time.
-	if currentContainer != nil {
-		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+	// Resumes need the compressed length, so the tar is compressed once to a
+	// temp file and the range is read from it.
+	file, err := ioutil.TempFile("", "delancey-download")
+	if err == nil {
+		defer os.Remove(file.Name())
+		defer file.Close()
+		err = writeTar(file, entries)
+	}
+	var size int64
+	if err == nil {
+		size, err = file.Seek(0, os.SEEK_CUR)
+	}
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  delancey.ErrInUse.Error(),
+			"error":  err.Error(),
 		})
 		return
 	}
 
+	start, end, err := parseRange(rangeHeader, size)
+	switch err {
+	case nil:
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		rw.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		rw.WriteHeader(http.StatusPartialContent)
+	case errUnsatisfiableRange:
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	default:
+		// Invalid ranges are ignored and the full contents are sent.
+		start, end = 0, size-1
+		rw.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		rw.WriteHeader(http.StatusOK)
+	}
+
+	_, err = io.Copy(rw, io.NewSectionReader(file, start, end-start+1))
+	if err != nil {
+		log.Println("Failed to write range of container", container.ID, err)
+	}
+}
+
+// POST /containers, Create container. The container is created in the
+// background, the job returned is used to check on its progress. Retries
+// with the same idempotency key get the same job.
+func createContainerHandler(rw http.ResponseWriter, req *http.Request) {
 	// Get container from body.
 	containerReq := new(requests.DockerfileContainerReq)
 	decoder := json.NewDecoder(req.Body)
@@ -134,17 +229,24 @@ func createContainerHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 	scontainer := containerReq.Container
 
-	go logClient.Info("creating container", map[string]interface{}{
-		"container": scontainer,
-		"ip":        agentHost,
+	sendLog(logInfo, "creating container", map[string]interface{}{
+		"container": scontainer.ID,
 	})
 
+	// Only allow one container per ID.
+	if containers.Get(scontainer.ID) != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrInUse.Error(),
+		})
+		return
+	}
+
 	// Create new Container.
 	container, err := NewContainer(scontainer)
 	if err != nil {
-		go logClient.Error(err.Error(), map[string]interface{}{
-			"container": scontainer,
-			"ip":        agentHost,
+		sendLog(logError, err.Error(), map[string]interface{}{
+			"container": scontainer.ID,
 		})
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -152,8 +254,53 @@ func createContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		})
 		return
 	}
+	container.State = ContainerCreating
+
+	// Reserve the ID, another create may have started since the check.
+	err = containers.Add(container)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	job := jobs.Create()
+
+	go func() {
+		err := createContainer(job, container, containerReq.Dockerfile)
+		if err != nil {
+			sendLog(logError, err.Error(), map[string]interface{}{
+				"container": scontainer.ID,
+			})
+			job.Finish(nil, err)
+			return
+		}
+
+		job.Finish(container.Container, nil)
+		sendContainerEvent(delancey.CreatedEvent, container)
+	}()
+
+	renderer.JSON(rw, http.StatusAccepted, map[string]interface{}{
+		"status": requests.StatusCreated,
+		"job":    job.Info(),
+	})
+}
+
+// createContainer runs the steps to create the image and Docker container
+// for the given container, progress is reported through the job.
+func createContainer(job *Job, container *Container, dockerfile string) (err error) {
 	image := config.DockerBaseImage + ":" + container.ImageID
 	steps := float64(4) // Number of steps in the create progress.
+	channel := fmt.Sprintf("container-%s", container.ID)
+	setStep := func(step string) {
+		job.SetStep(step)
+		sendStep(step, channel)
+	}
+	setProgress := func(prog float64) {
+		job.SetProgress(prog)
+		sendProgress("environment", prog, channel)
+	}
 
 	// Clean up if a failure occured.
 	defer func() {
@@ -161,239 +308,167 @@ func createContainerHandler(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		if Env != "testing" && container.DockerID != "" {
+		if container.DockerID != "" {
 			container.DeleteDocker()
 		}
 		container.DeletePaths()
-		currentContainer = nil
-		currentContainer.Save()
+		containers.Remove(container.ID)
 	}()
 
-	if Env != "testing" {
-		// Pull the image down to check if it exists.
-		log.Println("Pulling down image", container.ImageID)
-		progChan := make(chan float64)
-		prevProg := float64(0)
-
-		go func() {
-			for prog := range progChan {
-				progVal := float64(prog) / steps
-				prevProg = progVal
+	// Pull the image down to check if it exists.
+	log.Println("Pulling down image", container.ImageID)
+	setStep("Pulling image")
+	progChan := make(chan float64)
+	prevProg := float64(0)
 
-				sendProgress("environment", progVal, fmt.Sprintf("container-%s", container.ID))
-			}
-		}()
+	go func() {
+		for prog := range progChan {
+			progVal := float64(prog) / steps
+			prevProg = progVal
 
-		err = quay.PullImage(DockerClient, image, progChan)
-		if err != nil && !quay.IsNotFound(err) {
-			go logClient.Error(err.Error(), map[string]interface{}{
-				"container": scontainer,
-				"ip":        agentHost,
-			})
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
+			setProgress(progVal)
 		}
+	}()
 
-		// If the tag doesn't exist yet, create it from the base.
-		if err != nil {
-			// Create a container using the base.
-			log.Println("Image doesn't exist", container.ImageID)
-
-			// Set the prev since there was no progress done.
-			prevProg = 1 / steps
-			sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
-
-			// If no Dockerfile was given, just create the image from the base.
-			if containerReq.Dockerfile == "" {
-				err = createImage(container.ImageID, image, config.DockerBaseImage)
-				if err != nil {
-					go logClient.Error(err.Error(), map[string]interface{}{
-						"container": scontainer,
-						"ip":        agentHost,
-					})
-					renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-						"status": requests.StatusFailed,
-						"error":  err.Error(),
-					})
-					return
-				}
-				prevProg = (1 / steps) + prevProg
-				sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
-			} else {
-				progChan := make(chan float64)
-				lastProg := prevProg
-
-				go func() {
-					for prog := range progChan {
-						prevProg = ((prog / 2) / steps) + lastProg
-						sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
-					}
-				}()
-
-				// Use the given Dockerfile as the base image.
-				log.Println("Building Dockerfile to image for", container.ImageID)
-				_, err = buildImage(true, map[string]string{
-					"Dockerfile": containerReq.Dockerfile,
-				}, nil, image, progChan)
-				if err != nil {
-					go logClient.Error(err.Error(), map[string]interface{}{
-						"container": scontainer,
-						"ip":        agentHost,
-					})
-					renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-						"status": requests.StatusFailed,
-						"error":  err.Error(),
-					})
-					return
-				}
-				progChan = make(chan float64)
-				lastProg = prevProg
-
-				go func() {
-					for prog := range progChan {
-						prevProg = ((prog) / steps) + lastProg
-						sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
-					}
-				}()
-
-				// Now we need to ensure sshd is installed and configured correctly.
-				// To do this we build the image using itself as the base.
-				log.Println("Building Dockerfile with SSH for", container.ImageID)
-				_, err = buildImage(false, map[string]string{
-					"Dockerfile": sshDockerfile,
-				}, map[string]string{
-					"baseimage":   image,
-					"sshdinstall": config.SSHInstallAddr,
-					"sshdconfig":  config.SSHConfigAddr,
-				}, image, progChan)
-				if err != nil {
-					go logClient.Error(err.Error(), map[string]interface{}{
-						"container": scontainer,
-						"ip":        agentHost,
-					})
-					renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-						"status": requests.StatusFailed,
-						"error":  err.Error(),
-					})
-					return
+	err = ContainerRuntime.Pull(image, progChan)
+	if err != nil && err != ErrImageNotFound {
+		return err
+	}
+
+	// If the tag doesn't exist yet, create it from the base.
+	if err != nil {
+		// Create a container using the base.
+		log.Println("Image doesn't exist", container.ImageID)
+
+		// Set the prev since there was no progress done.
+		prevProg = 1 / steps
+		setProgress(prevProg)
+
+		// If no Dockerfile was given, just create the image from the base.
+		if dockerfile == "" {
+			setStep("Creating image")
+			err = createImage(container.ImageID, image, config.DockerBaseImage)
+			if err != nil {
+				return err
+			}
+			prevProg = (1 / steps) + prevProg
+			setProgress(prevProg)
+		} else {
+			progChan := make(chan float64)
+			lastProg := prevProg
+
+			go func() {
+				for prog := range progChan {
+					prevProg = ((prog / 2) / steps) + lastProg
+					setProgress(prevProg)
 				}
+			}()
+
+			// Use the given Dockerfile as the base image.
+			log.Println("Building Dockerfile to image for", container.ImageID)
+			setStep("Building Dockerfile")
+			_, err = buildImage(true, map[string]string{
+				"Dockerfile": dockerfile,
+			}, nil, image, progChan)
+			if err != nil {
+				return err
 			}
-		}
+			progChan = make(chan float64)
+			lastProg = prevProg
 
-		// Inspect the image to get any env vars.
-		inspectedBase, err := DockerClient.InspectImage(image)
-		if err != nil {
-			go logClient.Error(err.Error(), map[string]interface{}{
-				"container": scontainer,
-				"ip":        agentHost,
-			})
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
-		user := "root"
-		password := uuid.New()
-		envVars := ""
-		envVarsExport := ""
-
-		// Copy the env vars to use as a file in the image build.
-		if inspectedBase.Config.Env != nil {
-			envVars = strings.Join(inspectedBase.Config.Env, "\n")
-			for _, kv := range inspectedBase.Config.Env {
-				envVarsExport += "export " + kv + "\n"
+			go func() {
+				for prog := range progChan {
+					prevProg = ((prog) / steps) + lastProg
+					setProgress(prevProg)
+				}
+			}()
+
+			// Now we need to ensure sshd is installed and configured correctly.
+			// To do this we build the image using itself as the base.
+			log.Println("Building Dockerfile with SSH for", container.ImageID)
+			setStep("Installing SSH")
+			_, err = buildImage(false, map[string]string{
+				"Dockerfile": sshDockerfile,
+			}, map[string]string{
+				"baseimage":   image,
+				"sshdinstall": config.SSHInstallAddr,
+				"sshdconfig":  config.SSHConfigAddr,
+			}, image, progChan)
+			if err != nil {
+				return err
 			}
 		}
+	}
 
-		// Build the image to use for the container, which sets the password.
-		log.Println("Creating runner image for container", container.ImageID)
-		image, err := buildImage(false, map[string]string{
-			"Dockerfile":  passwordDockerfile,
-			"bowery-env":  envVars,
-			"bowery-vars": envVarsExport,
-		}, map[string]string{
-			"baseimage": image,
-			"user":      user,
-			"password":  password,
-			"motdpath":  config.EnvMessageAddr,
-		}, config.DockerBaseImage, nil)
-		if err != nil {
-			go logClient.Error(err.Error(), map[string]interface{}{
-				"container": scontainer,
-				"ip":        agentHost,
-			})
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
-		prevProg = (1 / steps) + prevProg
-		sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
-
-		container.ContainerPath = "/root/" + filepath.Base(path.RelSystem(container.LocalPath))
-		config := &docker.Config{
-			Volumes: map[string]string{
-				container.RemotePath: container.ContainerPath,
-				container.SSHPath:    "/root/.ssh",
-			},
-			NetworkMode: "host",
-			Privileged:  true,
+	// Inspect the image to get any env vars.
+	inspectedBase, err := ContainerRuntime.InspectImage(image)
+	if err != nil {
+		return err
+	}
+	user := "root"
+	password := uuid.New()
+	envVars := ""
+	envVarsExport := ""
+
+	// Copy the env vars to use as a file in the image build.
+	if inspectedBase.Env != nil {
+		envVars = strings.Join(inspectedBase.Env, "\n")
+		for _, kv := range inspectedBase.Env {
+			envVarsExport += "export " + kv + "\n"
 		}
+	}
 
-		log.Println("Creating container", container.ImageID)
-		id, err := DockerClient.Create(config, image, []string{"/usr/sbin/sshd", "-D"})
-		if err != nil {
-			go logClient.Error(err.Error(), map[string]interface{}{
-				"container": scontainer,
-				"ip":        agentHost,
-			})
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
+	// Build the image to use for the container, which sets the password.
+	log.Println("Creating runner image for container", container.ImageID)
+	setStep("Creating runner image")
+	image, err = buildImage(false, map[string]string{
+		"Dockerfile":  passwordDockerfile,
+		"bowery-env":  envVars,
+		"bowery-vars": envVarsExport,
+	}, map[string]string{
+		"baseimage": image,
+		"user":      user,
+		"password":  password,
+		"motdpath":  config.EnvMessageAddr,
+	}, config.DockerBaseImage, nil)
+	if err != nil {
+		return err
+	}
+	prevProg = (1 / steps) + prevProg
+	setProgress(prevProg)
 
-		log.Println("Starting container", container.ImageID)
-		err = DockerClient.Start(config, id)
-		if err != nil {
-			go logClient.Error(err.Error(), map[string]interface{}{
-				"container": scontainer,
-				"ip":        agentHost,
-			})
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
-				"status": requests.StatusFailed,
-				"error":  err.Error(),
-			})
-			return
-		}
-		log.Println("Container started", id, container.ImageID)
-		prevProg = (1 / steps) + prevProg
-		sendProgress("environment", prevProg, fmt.Sprintf("container-%s", container.ID))
+	container.ContainerPath = "/root/" + filepath.Base(path.RelSystem(container.LocalPath))
+	container.Config = container.NewDockerConfig()
 
-		container.User = user
-		container.Password = password
-		container.DockerID = id
+	log.Println("Creating container", container.ImageID)
+	setStep("Creating container")
+	id, err := ContainerRuntime.Create(container.Config, image, []string{"/usr/sbin/sshd", "-D"})
+	if err != nil {
+		return err
 	}
+	container.DockerID = id
 
-	err = nil
-	currentContainer = container
-	currentContainer.Save()
-	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
-		"status":    requests.StatusCreated,
-		"container": container,
-	})
+	log.Println("Starting container", container.ImageID)
+	setStep("Starting container")
+	err = ContainerRuntime.Start(container.Config, id)
+	if err != nil {
+		return err
+	}
+	log.Println("Container started", id, container.ImageID)
+	prevProg = (1 / steps) + prevProg
+	setProgress(prevProg)
+
+	container.User = user
+	container.Password = password
+	containers.SetState(container, ContainerRunning)
+	return container.Save()
 }
 
-// PUT /, Upload code for container.
+// PUT /containers/{id}, Upload code for container.
 func uploadContainerHandler(rw http.ResponseWriter, req *http.Request) {
 	// Require a container to exist.
-	if currentContainer == nil {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -401,8 +476,8 @@ func uploadContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Untar the tar contents from the body to the containers path.
-	err := tar.Untar(req.Body, currentContainer.RemotePath)
+	// Paths matching the ignores aren't extracted.
+	ignores, err := uploadIgnores(container.RemotePath)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -411,12 +486,22 @@ func uploadContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Untar the tar contents from the body to the containers path.
+	container.pathsMutex.Lock()
+	err = untar(req.Body, container.RemotePath, ignores)
+	container.pathsMutex.Unlock()
+	if err != nil {
+		renderPathError(rw, err)
+		return
+	}
+
+	go sendContainerEvent(delancey.UpdatedEvent, container)
 	renderer.JSON(rw, http.StatusOK, map[string]string{
 		"status": requests.StatusSuccess,
 	})
 }
 
-// PATCH /, Update the FS with a file change.
+// PATCH /containers/{id}, Update the FS with a file change.
 func updateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 	// Get the fields required to do the path update.
 	err := req.ParseMultipartForm(httpMaxMem)
@@ -438,10 +523,10 @@ func updateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		})
 		return
 	}
-	fullPath := filepath.Join(currentContainer.RemotePath, path.RelSystem(relPath))
 
 	// Container needs to exist.
-	if currentContainer == nil {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -449,13 +534,100 @@ func updateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	go logClient.Info("updating container", map[string]interface{}{
-		"container": currentContainer,
-		"ip":        agentHost,
+	// Updates in a session are applied in order of their sequence numbers.
+	applied := false
+	if sessionID := req.FormValue("session"); sessionID != "" {
+		seq, err := strconv.ParseUint(req.FormValue("seq"), 10, 64)
+		if err != nil || seq == 0 {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  "Invalid sequence number.",
+			})
+			return
+		}
+
+		session := sessions.Get(container.ID, sessionID)
+		if session == nil {
+			renderer.JSON(rw, http.StatusNotFound, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  delancey.ErrNoSession.Error(),
+			})
+			return
+		}
+
+		apply, err := session.Wait(seq, sequenceTimeout)
+		if err != nil {
+			renderer.JSON(rw, http.StatusConflict, map[string]interface{}{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+				"last":   session.Last(),
+			})
+			return
+		}
+
+		// Already applied, so the client is retrying.
+		if !apply {
+			renderer.JSON(rw, http.StatusOK, map[string]string{
+				"status": requests.StatusUpdated,
+			})
+			return
+		}
+
+		// The update is only marked as applied once it's written, so a
+		// failed update can be sent again.
+		defer func() {
+			if applied {
+				session.Done(seq)
+			} else {
+				session.Cancel()
+			}
+		}()
+	}
+
+	// Deletes remove the path itself, so a symlink isn't followed.
+	var fullPath string
+	if typ == delancey.DeleteStatus {
+		fullPath, err = resolveParentPath(container.RemotePath, path.RelSystem(relPath))
+	} else {
+		fullPath, err = resolvePath(container.RemotePath, path.RelSystem(relPath))
+	}
+	if err != nil {
+		renderPathError(rw, err)
+		return
+	}
+	container.pathsMutex.RLock()
+	defer container.pathsMutex.RUnlock()
+	container.pathLocks.Lock(fullPath)
+	defer container.pathLocks.Unlock(fullPath)
+
+	// Only update if the path is the version the client expects.
+	current, ok, err := checkPreconditions(fullPath, relPath, req.FormValue("prevhash"), req.FormValue("prevmtime"))
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if !ok {
+		renderer.JSON(rw, http.StatusConflict, map[string]interface{}{
+			"status":  requests.StatusFailed,
+			"error":   delancey.ErrConflict.Error(),
+			"current": current,
+		})
+		return
+	}
+
+	sendLog(logInfo, "updating container", map[string]interface{}{
+		"container": container.ID,
 	})
 
+	// Clients don't receive their own changes.
+	client := req.Header.Get(delancey.ClientHeader)
+
 	if typ == delancey.DeleteStatus {
 		// Delete path from the service.
+		watchers.SuppressDeleted(container, client, path.RelUnix(relPath))
 		err = os.RemoveAll(fullPath)
 		if err != nil {
 			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
@@ -532,7 +704,7 @@ func updateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 				return
 			}
 
-			err = os.Chmod(fullPath, os.FileMode(mode))
+			err = os.Chmod(fullPath, os.FileMode(mode).Perm())
 			if err != nil {
 				renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 					"status": requests.StatusFailed,
@@ -543,16 +715,21 @@ func updateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	applied = true
+	watchers.Suppress(container, client, path.RelUnix(relPath))
+
+	go sendContainerEvent(delancey.UpdatedEvent, container)
 	renderer.JSON(rw, http.StatusOK, map[string]string{
 		"status": requests.StatusUpdated,
 	})
 }
 
-// PATCH /batch, Update the FS with a list of file changes. Only creates/updates
-// can be done here.
-func batchUpdateContainerHandler(rw http.ResponseWriter, req *http.Request) {
-	// Require a container to exist.
-	if currentContainer == nil {
+// POST /containers/{id}/sessions/{session}, Create a session to send ordered
+// updates in. Creating an existing session keeps its last update.
+func createSessionHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	container := containers.Get(vars["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -560,29 +737,51 @@ func batchUpdateContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	go logClient.Info("batch updating container", map[string]interface{}{
-		"container": currentContainer,
-		"ip":        agentHost,
+	session := sessions.Create(container.ID, vars["session"])
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusSuccess,
+		"session": session.ID,
+		"last":    session.Last(),
 	})
+}
 
-	// Untar the tar contents from the body to the containers path.
-	err := tar.Untar(req.Body, currentContainer.RemotePath)
-	if err != nil {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+// GET /containers/{id}/sessions/{session}, Retrieve the last update applied in
+// a session.
+func sessionHandler(rw http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	container := containers.Get(vars["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
-			"error":  err.Error(),
+			"error":  delancey.ErrNotInUse.Error(),
 		})
 		return
 	}
 
-	renderer.JSON(rw, http.StatusOK, map[string]string{
-		"status": requests.StatusUpdated,
+	session := sessions.Get(container.ID, vars["session"])
+	if session == nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNoSession.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusSuccess,
+		"session": session.ID,
+		"last":    session.Last(),
 	})
 }
 
-// PUT /containers, Save service.
-func saveContainerHandler(rw http.ResponseWriter, req *http.Request) {
-	if currentContainer == nil {
+// PATCH /containers/{id}/batch, Update the FS with a list of file changes. The
+// body is a multipart form with a manifest of deletes and renames, followed
+// by a tar of the created/updated paths. A plain tar body is also accepted.
+// The batch is applied all or nothing.
+func batchUpdateContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	// Require a container to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -590,35 +789,21 @@ func saveContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if Env == "testing" {
-		renderer.JSON(rw, http.StatusOK, map[string]string{
-			"status": requests.StatusUpdated,
-		})
-		return
-	}
-
-	// Get the changes for the image.
-	log.Println("Getting changes for container", currentContainer.ImageID)
-	changes, err := DockerClient.Changes(currentContainer.DockerID, nil)
+	manifest, contents, err := readBatch(req)
 	if err != nil {
-		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  err.Error(),
 		})
 		return
 	}
-	image := config.DockerBaseImage + ":" + currentContainer.ImageID
 
-	// No changes made so just return successfully.
-	if len(changes) <= 0 {
-		renderer.JSON(rw, http.StatusOK, map[string]string{
-			"status": requests.StatusUpdated,
-		})
-		return
-	}
+	sendLog(logInfo, "batch updating container", map[string]interface{}{
+		"container": container.ID,
+	})
 
-	log.Println("Committing image changes", currentContainer.ImageID)
-	err = DockerClient.CommitImage(currentContainer.DockerID, image)
+	// Paths matching the ignores aren't extracted.
+	ignores, err := uploadIgnores(container.RemotePath)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -626,30 +811,36 @@ func saveContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		})
 		return
 	}
-	progChan := make(chan float64)
-
-	go func() {
-		for prog := range progChan {
-			sendProgress("environment", prog, fmt.Sprintf("container-%s", currentContainer.ID))
-		}
-	}()
 
-	log.Println("Pushing image to hub", currentContainer.ImageID)
-	err = DockerClient.PushImage(image, progChan)
+	// Clients don't receive their own changes, the paths are recorded before
+	// the lock is released so the changes aren't published first.
+	container.pathsMutex.Lock()
+	applied, err := applyBatch(container.RemotePath, manifest, contents, ignores)
 	if err == nil {
-		kenmare.UpdateImage(currentContainer.ImageID)
+		suppress := append(applied, manifest.Deletes...)
+		for _, rename := range manifest.Renames {
+			suppress = append(suppress, rename.From)
+		}
+		watchers.Suppress(container, req.Header.Get(delancey.ClientHeader), suppress...)
+	}
+	container.pathsMutex.Unlock()
+	if err != nil {
+		renderBatchError(rw, err)
+		return
 	}
-	log.Println("Image push complete", currentContainer.ImageID)
 
-	renderer.JSON(rw, http.StatusOK, map[string]string{
-		"status": requests.StatusUpdated,
+	go sendContainerEvent(delancey.UpdatedEvent, container)
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":  requests.StatusUpdated,
+		"applied": applied,
+		"failed":  PathErrors{},
 	})
 }
 
-// DELETE /, Remove service.
-func removeContainerHandler(rw http.ResponseWriter, req *http.Request) {
-	// Container needs to exist.
-	if currentContainer == nil {
+// GET /containers/{id}/manifest, Retrieve the manifest of the containers code.
+func manifestHandler(rw http.ResponseWriter, req *http.Request) {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -657,16 +848,98 @@ func removeContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	go logClient.Info("removing container", map[string]interface{}{
-		"container": currentContainer,
-		"ip":        agentHost,
-	})
-
-	if Env != "testing" {
-		log.Println("Removing container and runner image", currentContainer.ImageID)
-		err := currentContainer.DeleteDocker()
-		if err != nil {
-			renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+	manifest, err := delancey.BuildManifest(container.RemotePath)
+	if err != nil && !os.IsNotExist(err) {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	if manifest == nil {
+		manifest = make(delancey.Manifest, 0)
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":   requests.StatusSuccess,
+		"manifest": manifest,
+	})
+}
+
+// GET /containers/{id}/signature, Retrieve the block signature of a file.
+func signatureHandler(rw http.ResponseWriter, req *http.Request) {
+	relPath := req.FormValue("path")
+	if relPath == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Missing form fields.",
+		})
+		return
+	}
+
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	fullPath, err := resolvePath(container.RemotePath, path.RelSystem(relPath))
+	if err != nil {
+		renderPathError(rw, err)
+		return
+	}
+
+	sig, err := fileSignature(fullPath)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusSuccess,
+		"signature": sig,
+	})
+}
+
+// PATCH /containers/{id}/delta, Update a file by applying a delta to it.
+func deltaUpdateContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	err := req.ParseMultipartForm(httpMaxMem)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	relPath := req.FormValue("path")
+	baseHash := req.FormValue("base")
+	hash := req.FormValue("hash")
+	modeStr := req.FormValue("mode")
+	delta, _, err := req.FormFile("delta")
+	if relPath == "" || baseHash == "" || hash == "" || err != nil {
+		if err == nil || err == http.ErrMissingFile {
+			err = errors.New("Missing form fields.")
+		}
+
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer delta.Close()
+
+	var mode uint64
+	if modeStr != "" {
+		mode, err = strconv.ParseUint(modeStr, 10, 32)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 				"status": requests.StatusFailed,
 				"error":  err.Error(),
 			})
@@ -674,19 +947,170 @@ func removeContainerHandler(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	// Remove the containers path/ssh and clean up the current container.
-	currentContainer.DeletePaths()
-	currentContainer = nil
-	currentContainer.Save()
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	fullPath, err := resolvePath(container.RemotePath, path.RelSystem(relPath))
+	if err != nil {
+		renderPathError(rw, err)
+		return
+	}
+
+	sendLog(logInfo, "delta updating container", map[string]interface{}{
+		"container": container.ID,
+	})
+
+	// Clients don't receive their own changes, the path is recorded before
+	// the lock is released so the change isn't published first.
+	container.pathsMutex.RLock()
+	container.pathLocks.Lock(fullPath)
+	err = patchFile(fullPath, baseHash, hash, os.FileMode(mode).Perm(), delta)
+	if err == nil {
+		watchers.Suppress(container, req.Header.Get(delancey.ClientHeader), path.RelUnix(relPath))
+	}
+	container.pathLocks.Unlock(fullPath)
+	container.pathsMutex.RUnlock()
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == delancey.ErrDeltaBase {
+			status = http.StatusConflict
+		} else if err == delancey.ErrInvalidDelta {
+			status = http.StatusBadRequest
+		}
+
+		renderer.JSON(rw, status, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	go sendContainerEvent(delancey.UpdatedEvent, container)
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// PUT /containers/{id}/save, Save service. Retries with the same
+// idempotency key don't save again.
+func saveContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	// Get the changes for the image.
+	log.Println("Getting changes for container", container.ImageID)
+	changes, err := ContainerRuntime.Changes(container.DockerID)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	image := config.DockerBaseImage + ":" + container.ImageID
+
+	// No changes made so just return successfully.
+	if len(changes) <= 0 {
+		renderer.JSON(rw, http.StatusOK, map[string]string{
+			"status": requests.StatusUpdated,
+		})
+		return
+	}
+
+	log.Println("Committing image changes", container.ImageID)
+	sendStep("Committing image", fmt.Sprintf("container-%s", container.ID))
+	err = ContainerRuntime.Commit(container.DockerID, image)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	progChan := make(chan float64)
+	channel := fmt.Sprintf("container-%s", container.ID)
+
+	go func() {
+		for prog := range progChan {
+			sendProgress("environment", prog, channel)
+		}
+	}()
+
+	log.Println("Pushing image to hub", container.ImageID)
+	sendStep("Pushing image", channel)
+	err = ContainerRuntime.Push(image, progChan)
+	close(progChan)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	imageSaved(container.ImageID)
+	go sendContainerEvent(delancey.SavedEvent, container)
+	log.Println("Image push complete", container.ImageID)
+
+	renderer.JSON(rw, http.StatusOK, map[string]string{
+		"status": requests.StatusUpdated,
+	})
+}
+
+// DELETE /containers/{id}, Remove service.
+func removeContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	// Container needs to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	sendLog(logInfo, "removing container", map[string]interface{}{
+		"container": container.ID,
+	})
+
+	log.Println("Removing container and runner image", container.ImageID)
+	err := container.DeleteDocker()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	// Remove the containers path/ssh and clean up the container.
+	container.DeletePaths()
+	containers.Remove(container.ID)
+	sessions.Remove(container.ID)
+	containers.Save()
+	go sendContainerEvent(delancey.RemovedEvent, container)
 	renderer.JSON(rw, http.StatusOK, map[string]string{
 		"status": requests.StatusRemoved,
 	})
 }
 
-// PUT /ssh, Accepts ssh tarfile for user auth to their container
-func uploadSSHHandler(rw http.ResponseWriter, req *http.Request) {
-	// Require a container to exist.
-	if currentContainer == nil {
+// POST /containers/{id}/stop, Stop the containers processes, keeping its
+// state so it can be started again.
+func stopContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	// Container needs to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
 		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
 			"status": requests.StatusFailed,
 			"error":  delancey.ErrNotInUse.Error(),
@@ -694,8 +1118,8 @@ func uploadSSHHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// Untar the tar contents from the body to the containers path.
-	err := tar.Untar(req.Body, currentContainer.SSHPath)
+	log.Println("Stopping container", container.ImageID)
+	err := container.StopDocker()
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -704,9 +1128,101 @@ func uploadSSHHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	containers.SetState(container, ContainerStopped)
+	container.Save()
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusUpdated,
+		"container": container.Public(),
+	})
+}
+
+// POST /containers/{id}/start, Start a stopped container.
+func startContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	// Container needs to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	log.Println("Starting container", container.ImageID)
+	err := container.StartDocker()
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	containers.SetState(container, ContainerRunning)
+	container.Save()
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusUpdated,
+		"container": container.Public(),
+	})
+}
+
+// POST /containers/{id}/restart, Stop and start the container.
+func restartContainerHandler(rw http.ResponseWriter, req *http.Request) {
+	// Container needs to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	log.Println("Restarting container", container.ImageID)
+	err := container.StopDocker()
+	if err == nil {
+		containers.SetState(container, ContainerStopped)
+		err = container.StartDocker()
+	}
+	if err != nil {
+		container.Save()
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	containers.SetState(container, ContainerRunning)
+	container.Save()
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status":    requests.StatusUpdated,
+		"container": container.Public(),
+	})
+}
+
+// PUT /containers/{id}/ssh, Accepts ssh tarfile for user auth to their container
+func uploadSSHHandler(rw http.ResponseWriter, req *http.Request) {
+	// Require a container to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	// Untar the tar contents from the body to the containers path.
+	err := untar(req.Body, container.SSHPath, nil)
+	if err != nil {
+		renderPathError(rw, err)
+		return
+	}
+
 	// Ensure files/directories are private.
-	err = filepath.Walk(currentContainer.SSHPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil || currentContainer.SSHPath == path {
+	err = filepath.Walk(container.SSHPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || container.SSHPath == path {
 			return err
 		}
 
@@ -729,25 +1245,327 @@ func uploadSSHHandler(rw http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// POST /containers/{id}/exec, Run a command in the container streaming the
+// output as JSON messages.
+func execHandler(rw http.ResponseWriter, req *http.Request) {
+	// Require a container to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	exec := new(delancey.ExecConfig)
+	decoder := json.NewDecoder(req.Body)
+	err := decoder.Decode(exec)
+	if err != nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	if len(exec.Cmd) <= 0 {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Missing command.",
+		})
+		return
+	}
+
+	if exec.WorkingDir == "" {
+		exec.WorkingDir = container.ContainerPath
+	}
+	output := newExecWriter(rw)
+
+	log.Println("Running command in container", container.ImageID, exec.Cmd)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	code, err := ContainerRuntime.Exec(container.DockerID, exec.Cmd, exec.Env, exec.WorkingDir,
+		output.Stream(delancey.StdoutStream), output.Stream(delancey.StderrStream))
+	if err != nil {
+		output.Send(&delancey.ExecOutput{Error: err.Error()})
+		return
+	}
+
+	output.Send(&delancey.ExecOutput{ExitCode: &code})
+}
+
+// GET /containers/{id}/terminal, Attach an interactive shell in the container
+// to a WebSocket.
+func terminalHandler(rw http.ResponseWriter, req *http.Request) {
+	// Require a container to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	// Browsers on other sites can't use the agents credentials to open
+	// terminals.
+	if !upgrader.CheckOrigin(req) {
+		renderer.JSON(rw, http.StatusForbidden, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  errOriginNotAllowed.Error(),
+		})
+		return
+	}
+	width, _ := strconv.Atoi(req.FormValue("width"))
+	height, _ := strconv.Atoi(req.FormValue("height"))
+
+	term, err := ContainerRuntime.Terminal(container.DockerID, terminalCmd, container.ContainerPath)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer term.Close()
+
+	// Upgrade responds with the error if it fails.
+	ws, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+
+	if width > 0 && height > 0 {
+		err = term.Resize(width, height)
+		if err != nil {
+			log.Println("Failed to resize terminal", err)
+		}
+	}
+
+	log.Println("Terminal session started for container", container.ImageID)
+	runTerminal(ws, term)
+	log.Println("Terminal session ended for container", container.ImageID)
+}
+
+// GET /containers/{id}/logs, Stream the containers logs. The follow, tail and
+// since query params are used to choose which logs are sent.
+func logsHandler(rw http.ResponseWriter, req *http.Request) {
+	// Require a container to exist.
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+	follow := req.FormValue("follow") == "true"
+	tail := req.FormValue("tail")
+	sinceStr := req.FormValue("since")
+	since := int64(0)
+
+	if tail == "" {
+		tail = "all"
+	} else if _, err := strconv.ParseUint(tail, 10, 64); err != nil && tail != "all" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Tail must be a number or all",
+		})
+		return
+	}
+
+	if sinceStr != "" {
+		var err error
+		since, err = strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+				"status": requests.StatusFailed,
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+
+	logs, err := ContainerRuntime.Logs(container.DockerID, follow, tail, since)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer logs.Close()
+
+	// Stop following once the client goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-req.Context().Done():
+			logs.Close()
+		case <-done:
+		}
+	}()
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	io.Copy(newFlushWriter(rw), logs)
+}
+
+// GET /jobs/{id}, Retrieve the progress of a job.
+func jobHandler(rw http.ResponseWriter, req *http.Request) {
+	job := jobs.Get(mux.Vars(req)["id"])
+	if job == nil {
+		renderer.JSON(rw, http.StatusNotFound, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNoJob.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusOK, map[string]interface{}{
+		"status": requests.StatusSuccess,
+		"job":    job.Info(),
+	})
+}
+
+// GET /events, Stream the events sent on a channel as server-sent events.
+func eventsHandler(rw http.ResponseWriter, req *http.Request) {
+	channel := req.FormValue("channel")
+	if channel == "" {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Channel query param required",
+		})
+		return
+	}
+
+	streamEvents(rw, req, channel)
+}
+
+// GET /containers/{id}/changes, Stream the changes made to the containers code
+// as server-sent events. Changes written by the client streaming them, named
+// in the Delancey-Client header, aren't sent.
+func changesHandler(rw http.ResponseWriter, req *http.Request) {
+	container := containers.Get(mux.Vars(req)["id"])
+	if container == nil {
+		renderer.JSON(rw, http.StatusBadRequest, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  delancey.ErrNotInUse.Error(),
+		})
+		return
+	}
+
+	client := req.Header.Get(delancey.ClientHeader)
+	_, err := watchers.Acquire(container, client)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+	defer watchers.Release(container.ID, client)
+
+	streamEvents(rw, req, changesChannel(container.ID, client))
+}
+
+// streamEvents streams the events sent on a channel as server-sent events
+// until the client disconnects.
+func streamEvents(rw http.ResponseWriter, req *http.Request, channel string) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  "Streaming isn't supported",
+		})
+		return
+	}
+	events := broker.Subscribe(channel)
+	defer broker.Unsubscribe(channel, events)
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			// The stream fell behind and missed events, so the client has to
+			// resync.
+			if !ok {
+				writeEvent(rw, &delancey.Event{Name: delancey.ResyncEvent})
+				flusher.Flush()
+				return
+			}
+
+			writeEvent(rw, event)
+		case <-keepAlive.C:
+			// Comments are ignored by clients, but keep proxies from timing out.
+			fmt.Fprint(rw, ":\n\n")
+		case <-req.Context().Done():
+			return
+		}
+
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event as a server-sent event.
+func writeEvent(w io.Writer, event *delancey.Event) {
+	fmt.Fprintf(w, "event: %s\n", event.Name)
+	for _, line := range strings.Split(event.Data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
 // GET /healthz, Return the status of the agent.
 func healthzHandler(rw http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(rw, "ok")
 }
 
-// GET /_/state/container, Return the current container data.
+// GET /_/state/containers, Return the containers data.
 func containerStateHandler(rw http.ResponseWriter, req *http.Request) {
-	if currentContainer == nil {
+	list := containers.List()
+	if len(list) <= 0 {
 		rw.Write([]byte("Nothing"))
 		return
 	}
-	containerCopy := *currentContainer
+	containersCopy := make([]*schemas.Container, len(list))
 
-	containerCopy.SSHPath = ""
-	containerCopy.LocalPath = ""
-	containerCopy.User = ""
-	containerCopy.Password = ""
+	for i, container := range list {
+		containersCopy[i] = container.Public()
+	}
 
-	data, err := json.Marshal(containerCopy)
+	data, err := json.Marshal(containersCopy)
+	if err != nil {
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// GET /_/state/container, Return the first containers data. Agents used to
+// host a single container, older clients still expect a single object.
+func legacyContainerStateHandler(rw http.ResponseWriter, req *http.Request) {
+	list := containers.List()
+	if len(list) <= 0 {
+		rw.Write([]byte("Nothing"))
+		return
+	}
+
+	data, err := json.Marshal(list[0].Public())
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -776,7 +1594,7 @@ func pullImageHandler(rw http.ResponseWriter, req *http.Request) {
 		image = config.DockerBaseImage + ":" + image
 	}
 
-	err := DockerClient.PullImage(image, nil)
+	err := ContainerRuntime.Pull(image, nil)
 	if err != nil {
 		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
 			"status": requests.StatusFailed,
@@ -790,9 +1608,91 @@ func pullImageHandler(rw http.ResponseWriter, req *http.Request) {
 	})
 }
 
+// renderPathError renders an error from writing to a containers paths. Paths
+// that were rejected as unsafe are included in the response.
+func renderPathError(rw http.ResponseWriter, err error) {
+	var rejected PathErrors
+	switch perr := err.(type) {
+	case *PathError:
+		rejected = PathErrors{perr}
+	case PathErrors:
+		rejected = perr
+	default:
+		renderer.JSON(rw, http.StatusInternalServerError, map[string]string{
+			"status": requests.StatusFailed,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	renderer.JSON(rw, http.StatusBadRequest, map[string]interface{}{
+		"status": requests.StatusFailed,
+		"error":  err.Error(),
+		"paths":  rejected,
+	})
+}
+
+// renderBatchError renders an error from applying a batch. Nothing was
+// applied, and the paths that failed are included in the response.
+func renderBatchError(rw http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	failed := PathErrors{}
+	switch berr := err.(type) {
+	case PathErrors:
+		status = http.StatusBadRequest
+		failed = berr
+	case *PathError:
+		status = http.StatusBadRequest
+		failed = PathErrors{berr}
+	case *delancey.BatchError:
+		failed = PathErrors{{Path: berr.Path, Reason: berr.Err.Error()}}
+	}
+
+	renderer.JSON(rw, status, map[string]interface{}{
+		"status":  requests.StatusFailed,
+		"error":   err.Error(),
+		"applied": []string{},
+		"failed":  failed,
+	})
+}
+
 // sendProgress sends a progress event to the channel using the step and progress
 // as the data formatted step:prog.
 func sendProgress(step string, prog float64, channel string) error {
 	val := step + ":" + strconv.FormatFloat(prog, 'e', -1, 64)
-	return pusherC.Publish(val, "progress", channel)
+	return publisher.Publish(channel, &delancey.Event{Name: delancey.ProgressEvent, Data: val})
+}
+
+// sendStep sends a step event to the channel with the name of the step
+// that's being run.
+func sendStep(step string, channel string) error {
+	return publisher.Publish(channel, &delancey.Event{Name: delancey.StepEvent, Data: step})
+}
+
+// sendContainerEvent sends a lifecycle event to the containers channel using
+// the containers public info as the data.
+func sendContainerEvent(name string, container *Container) error {
+	data, err := json.Marshal(container.Public())
+	if err != nil {
+		return err
+	}
+
+	channel := fmt.Sprintf("container-%s", container.ID)
+	return publisher.Publish(channel, &delancey.Event{Name: name, Data: string(data)})
+}
+
+// sendLog sends a log event to the agents channel, the agents IP is added
+// to the fields.
+func sendLog(level, msg string, fields map[string]interface{}) error {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["ip"] = agentHost
+
+	data, err := json.Marshal(&logEntry{Level: level, Message: msg, Fields: fields})
+	if err != nil {
+		return err
+	}
+
+	return publisher.Publish(logChannel, &delancey.Event{Name: delancey.LogEvent, Data: string(data)})
 }
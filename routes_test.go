@@ -2,19 +2,32 @@
 package main
 
 import (
+	stdtar "archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/config"
 	"github.com/Bowery/gopackages/requests"
 	"github.com/Bowery/gopackages/schemas"
 	"github.com/Bowery/gopackages/tar"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 var Rcontainer = &schemas.Container{
@@ -22,8 +35,21 @@ var Rcontainer = &schemas.Container{
 }
 var uploadPath = filepath.Join("test", "upload.tar.gz")
 
+// Runtime the handlers use while testing.
+var testContainerRuntime = newTestRuntime()
+
+// Fake Docker Engine and container for tests running the Docker runtime.
+var (
+	testDocker = newFakeDocker()
+	Dcontainer = &schemas.Container{
+		ID:        "docker-id",
+		ImageID:   "docker-image",
+		LocalPath: "/local/app",
+	}
+)
+
 func init() {
-	Env = "testing"
+	ContainerRuntime = testContainerRuntime
 	err := os.MkdirAll("test", os.ModePerm|os.ModeDir)
 	if err != nil {
 		panic(err)
@@ -54,7 +80,7 @@ func init() {
 }
 
 func TestUploadNoContainer(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(uploadContainerHandler))
+	server := newContainerServer(uploadContainerHandler)
 	defer server.Close()
 
 	file, err := os.Open(uploadPath)
@@ -63,7 +89,7 @@ func TestUploadNoContainer(t *testing.T) {
 	}
 	defer file.Close()
 
-	res, err := http.Post(server.URL, "application/x-gzip", file)
+	res, err := http.Post(containerURL(server), "application/x-gzip", file)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,18 +124,27 @@ func TestCreateContainer(t *testing.T) {
 	}
 	defer res.Body.Close()
 
-	containerRes := new(requests.ContainerRes)
+	jobRes := new(delancey.JobRes)
 	decoder := json.NewDecoder(res.Body)
-	err = decoder.Decode(containerRes)
+	err = decoder.Decode(jobRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if jobRes.Status != requests.StatusCreated {
+		t.Fatal("Should've been created but failed")
+	}
+
+	job, err := waitJob(jobRes.Job.ID)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if containerRes.Status != requests.StatusCreated {
-		t.Error("Should've been created but failed")
+	if job.Status != delancey.JobSucceeded {
+		t.Fatal("Create job should've succeeded but failed")
 	}
 
-	Rcontainer.RemotePath = containerRes.Container.RemotePath
+	Rcontainer.RemotePath = job.Container.RemotePath
 }
 
 func TestCreateContainerCreated(t *testing.T) {
@@ -129,24 +164,56 @@ func TestCreateContainerCreated(t *testing.T) {
 	}
 	defer res.Body.Close()
 
-	containerRes := new(requests.ContainerRes)
+	jobRes := new(delancey.JobRes)
 	decoder := json.NewDecoder(res.Body)
-	err = decoder.Decode(containerRes)
+	err = decoder.Decode(jobRes)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if containerRes.Status == requests.StatusCreated {
+	if jobRes.Status == requests.StatusCreated {
 		t.Error("Should've been failed but didn't")
 	}
 
-	if currentContainer == nil {
-		t.Error("currentContainer should be set after create")
+	if containers.Get(Rcontainer.ID) == nil {
+		t.Error("container should be set after create")
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(listContainersHandler))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(delancey.ContainersRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusSuccess {
+		t.Error("List failed when it should've passed")
+	}
+
+	if len(resData.Containers) != 1 || resData.Containers[0].ID != Rcontainer.ID {
+		t.Error("List should only contain the created container")
+	}
+
+	for _, container := range resData.Containers {
+		if container.SSHPath != "" || container.User != "" || container.Password != "" {
+			t.Error("Listed containers shouldn't include their private fields")
+		}
 	}
 }
 
 func TestUpload(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(uploadContainerHandler))
+	server := newContainerServer(uploadContainerHandler)
 	defer server.Close()
 
 	file, err := os.Open(uploadPath)
@@ -155,7 +222,7 @@ func TestUpload(t *testing.T) {
 	}
 	defer file.Close()
 
-	res, err := http.Post(server.URL, "application/x-gzip", file)
+	res, err := http.Post(containerURL(server), "application/x-gzip", file)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -173,11 +240,79 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestDownload(t *testing.T) {
+	server := newContainerServer(downloadContainerHandler)
+	defer server.Close()
+
+	res, err := http.Get(containerURL(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	full, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != http.StatusOK || etag == "" || len(full) <= 100 {
+		t.Fatal("Download failed but should've passed")
+	}
+
+	// Resume from the middle.
+	req, err := http.NewRequest("GET", containerURL(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=100-")
+	req.Header.Set("If-Range", etag)
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	partial, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusPartialContent || !bytes.Equal(partial, full[100:]) {
+		t.Error("Range contents aren't as expected")
+	}
+
+	// A stale etag gets the full contents.
+	req.Header.Set("If-Range", `"stale"`)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Error("Stale range should've returned the full contents")
+	}
+
+	// A range past the end can't be satisfied.
+	req.Header.Set("Range", "bytes="+strconv.Itoa(len(full))+"-")
+	req.Header.Set("If-Range", etag)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusRequestedRangeNotSatisfiable ||
+		res.Header.Get("Content-Range") != "bytes */"+strconv.Itoa(len(full)) {
+		t.Error("Range past the end should've been unsatisfiable", res.StatusCode)
+	}
+}
+
 func TestUpdateDir(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(updateContainerHandler))
+	server := newContainerServer(updateContainerHandler)
 	defer server.Close()
 
-	req, err := newUploadRequest(server.URL, nil, map[string]string{
+	req, err := newUploadRequest(containerURL(server), nil, map[string]string{
 		"pathtype": "dir",
 		"path":     "newdir",
 		"type":     "create",
@@ -209,11 +344,99 @@ func TestUpdateDir(t *testing.T) {
 	}
 }
 
+func TestUpdateWaitsForBatch(t *testing.T) {
+	server := newContainerServer(updateContainerHandler)
+	defer server.Close()
+	container := containers.Get(Rcontainer.ID)
+
+	req, err := newUploadRequest(containerURL(server), nil, map[string]string{
+		"pathtype": "dir",
+		"path":     "lockeddir",
+		"type":     "create",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the lock like a running batch.
+	container.pathsMutex.Lock()
+	done := make(chan error, 1)
+	go func() {
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Error("Update should've waited for the batch")
+	case <-time.After(50 * time.Millisecond):
+	}
+	container.pathsMutex.Unlock()
+
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(Rcontainer.RemotePath, "lockeddir"))
+	if err != nil {
+		t.Error("lockeddir should exist but stat failed")
+	}
+}
+
+func TestUpdateSession(t *testing.T) {
+	server := newContainerServer(updateContainerHandler)
+	defer server.Close()
+	session := sessions.Create(Rcontainer.ID, "update-session")
+
+	cases := []struct {
+		session  string
+		prevhash string
+		status   int
+		last     uint64
+	}{
+		{"missing-session", "", http.StatusNotFound, 0},
+		{"update-session", "stale", http.StatusConflict, 0},
+		{"update-session", "", http.StatusOK, 1},
+	}
+
+	for _, c := range cases {
+		params := map[string]string{
+			"pathtype": "dir",
+			"path":     "sessiondir",
+			"type":     "create",
+			"session":  c.session,
+			"seq":      "1",
+		}
+		if c.prevhash != "" {
+			params["prevhash"] = c.prevhash
+		}
+
+		req, err := newUploadRequest(containerURL(server), nil, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != c.status || session.Last() != c.last {
+			t.Error("Update in", c.session, "isn't as expected", res.StatusCode, session.Last())
+		}
+	}
+}
+
 func TestUpdateFile(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(updateContainerHandler))
+	server := newContainerServer(updateContainerHandler)
 	defer server.Close()
 
-	req, err := newUploadRequest(server.URL, map[string]string{
+	req, err := newUploadRequest(containerURL(server), map[string]string{
 		"file": uploadPath,
 	}, map[string]string{
 		"pathtype": "file",
@@ -247,11 +470,212 @@ func TestUpdateFile(t *testing.T) {
 	}
 }
 
+func TestManifest(t *testing.T) {
+	server := newContainerServer(manifestHandler)
+	defer server.Close()
+
+	res, err := http.Get(containerURL(server) + "/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(delancey.ManifestRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusSuccess {
+		t.Fatal("Manifest failed but should've passed")
+	}
+
+	entries := resData.Manifest.Map()
+	if entry, ok := entries["newdir"]; !ok || entry.Type != delancey.DirType {
+		t.Error("newdir should be in the manifest as a directory")
+	}
+
+	contents, err := ioutil.ReadFile(uploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(contents)
+
+	entry, ok := entries["somecoolfile"]
+	if !ok {
+		t.Fatal("somecoolfile should be in the manifest")
+	}
+	if entry.Hash != hex.EncodeToString(sum[:]) || entry.Size != int64(len(contents)) {
+		t.Error("somecoolfile hash or size isn't as expected")
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	server := newContainerServer(updateContainerHandler)
+	defer server.Close()
+
+	contents, err := ioutil.ReadFile(uploadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(contents)
+	hash := hex.EncodeToString(sum[:])
+
+	for _, prevHash := range []string{"stale", hash} {
+		req, err := newUploadRequest(containerURL(server), map[string]string{
+			"file": uploadPath,
+		}, map[string]string{
+			"pathtype": "file",
+			"path":     "somecoolfile",
+			"type":     "update",
+			"prevhash": prevHash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		resData := new(delancey.UpdateRes)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(resData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if prevHash == hash {
+			if resData.Status != requests.StatusUpdated {
+				t.Error("Update failed but should've passed", resData.Error())
+			}
+			continue
+		}
+
+		if res.StatusCode != http.StatusConflict || resData.Error() != delancey.ErrConflict.Error() {
+			t.Error("Update should've conflicted")
+		}
+		if resData.Current == nil || resData.Current.Hash != hash {
+			t.Error("Current version isn't as expected")
+		}
+	}
+}
+
+func TestUpdateConflictConcurrent(t *testing.T) {
+	server := newContainerServer(updateContainerHandler)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(Rcontainer.RemotePath, "racefile"), []byte("base"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("base"))
+	hash := hex.EncodeToString(sum[:])
+
+	// Every writer expects the base version, so only one can apply.
+	writers := 8
+	statuses := make(chan int, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		upload := filepath.Join(dir, "writer-"+strconv.Itoa(i))
+		err = ioutil.WriteFile(upload, []byte("writer-"+strconv.Itoa(i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := newUploadRequest(containerURL(server), map[string]string{
+			"file": upload,
+		}, map[string]string{
+			"pathtype": "file",
+			"path":     "racefile",
+			"type":     "update",
+			"prevhash": hash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+			statuses <- res.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	applied := 0
+	for status := range statuses {
+		if status == http.StatusOK {
+			applied++
+		} else if status != http.StatusConflict {
+			t.Error("Update should've been applied or conflicted", status)
+		}
+	}
+	if applied != 1 {
+		t.Error("Only one writer should've been applied, applied", applied)
+	}
+}
+
+func TestUpdateRetryIdempotent(t *testing.T) {
+	server := newContainerServer(idempotent(updateContainerHandler))
+	defer server.Close()
+
+	err := ioutil.WriteFile(filepath.Join(Rcontainer.RemotePath, "retryfile"), []byte("base"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("base"))
+	hash := hex.EncodeToString(sum[:])
+
+	// The retry expects the base version too, but it gets the result of the
+	// update that was applied instead of conflicting with it.
+	for i := 0; i < 2; i++ {
+		req, err := newUploadRequest(containerURL(server), map[string]string{
+			"file": uploadPath,
+		}, map[string]string{
+			"pathtype": "file",
+			"path":     "retryfile",
+			"type":     "update",
+			"prevhash": hash,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(delancey.IdempotencyKeyHeader, "retry-key")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Error("Update", i, "should've succeeded but got", res.StatusCode)
+		}
+	}
+}
+
 func TestUpdateDeleteFile(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(updateContainerHandler))
+	server := newContainerServer(updateContainerHandler)
 	defer server.Close()
 
-	req, err := newUploadRequest(server.URL, nil, map[string]string{
+	req, err := newUploadRequest(containerURL(server), nil, map[string]string{
 		"pathtype": "file",
 		"path":     "somecoolfile",
 		"type":     "delete",
@@ -283,11 +707,86 @@ func TestUpdateDeleteFile(t *testing.T) {
 	}
 }
 
+func TestBatchUpdate(t *testing.T) {
+	server := newContainerServer(batchUpdateContainerHandler)
+	defer server.Close()
+
+	for _, name := range []string{"batch-old", "batch-gone"} {
+		err := ioutil.WriteFile(filepath.Join(Rcontainer.RemotePath, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	err := writer.WriteField("manifest", `{"deletes": ["batch-gone"], `+
+		`"renames": [{"from": "batch-old", "to": "batch/renamed"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part, err := writer.CreateFormFile("tar", "batch.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.Copy(part, newTestTar(t, []tarEntry{
+		{name: "batch/file", typ: stdtar.TypeReg, body: "contents"},
+		{name: "batch/link", typ: stdtar.TypeSymlink, linkname: "file"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	req, err := http.NewRequest("PATCH", containerURL(server)+"/batch", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(delancey.BatchRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusUpdated {
+		t.Fatal("Batch update failed but should've passed", resData.Error())
+	}
+	if len(resData.Applied) != 4 || len(resData.Failed) != 0 {
+		t.Error("Applied and failed paths aren't as expected", resData.Applied)
+	}
+
+	_, err = os.Stat(filepath.Join(Rcontainer.RemotePath, "batch-gone"))
+	if !os.IsNotExist(err) {
+		t.Error("batch-gone should've been deleted")
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(Rcontainer.RemotePath, "batch", "renamed"))
+	if err != nil || string(contents) != "batch-old" {
+		t.Error("batch-old should've been renamed")
+	}
+
+	target, err := os.Readlink(filepath.Join(Rcontainer.RemotePath, "batch", "link"))
+	if err != nil || target != "file" {
+		t.Error("batch/link should be a symlink to file")
+	}
+}
+
 func TestSaveContainer(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(saveContainerHandler))
+	server := newContainerServer(saveContainerHandler)
 	defer server.Close()
 
-	req, err := http.NewRequest("PUT", server.URL+"/containers", nil)
+	req, err := http.NewRequest("PUT", containerURL(server)+"/save", nil)
 	if err != nil {
 		t.Error(err)
 	}
@@ -302,11 +801,39 @@ func TestSaveContainer(t *testing.T) {
 	}
 }
 
-func TestRemoveContainer(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(removeContainerHandler))
+// pushFailRuntime is a test runtime with changes to save that fails to push.
+type pushFailRuntime struct {
+	*testRuntime
+}
+
+func (pr pushFailRuntime) Changes(id string) ([]string, error) {
+	return []string{"/root/file"}, nil
+}
+
+func (pr pushFailRuntime) Push(image string, progress chan float64) error {
+	return errors.New("push failed")
+}
+
+func TestSaveContainerPushFails(t *testing.T) {
+	container := addTestContainer(t, "push-fail-id")
+	defer containers.Remove(container.ID)
+	ContainerRuntime = pushFailRuntime{testContainerRuntime}
+	defer func() { ContainerRuntime = testContainerRuntime }()
+	saved := false
+	prevSaved := imageSaved
+	imageSaved = func(imageID string) {
+		saved = true
+	}
+	defer func() { imageSaved = prevSaved }()
+	server := newContainerServer(saveContainerHandler)
 	defer server.Close()
 
-	res, err := http.Get(server.URL)
+	req, err := http.NewRequest("PUT", server.URL+"/containers/"+container.ID+"/save", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -319,13 +846,584 @@ func TestRemoveContainer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if resData.Status != requests.StatusRemoved {
+	if res.StatusCode != http.StatusInternalServerError || resData.Status != requests.StatusFailed {
+		t.Error("Save should've failed when the push fails", res.StatusCode, resData.Status)
+	}
+
+	if saved {
+		t.Error("Kenmare shouldn't be told about an image that wasn't pushed")
+	}
+}
+
+func TestStopContainer(t *testing.T) {
+	server := newContainerServer(stopContainerHandler)
+	defer server.Close()
+
+	res, err := http.Post(containerURL(server)+"/stop", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(requests.Res)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusUpdated {
+		t.Error("Stop failed but should've passed")
+	}
+
+	if containers.Get(Rcontainer.ID).State != ContainerStopped {
+		t.Error("container should be stopped after stop")
+	}
+}
+
+func TestStartContainer(t *testing.T) {
+	server := newContainerServer(startContainerHandler)
+	defer server.Close()
+
+	res, err := http.Post(containerURL(server)+"/start", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(requests.Res)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusUpdated {
+		t.Error("Start failed but should've passed")
+	}
+
+	if containers.Get(Rcontainer.ID).State != ContainerRunning {
+		t.Error("container should be running after start")
+	}
+}
+
+func TestRemoveContainer(t *testing.T) {
+	server := newContainerServer(removeContainerHandler)
+	defer server.Close()
+
+	req, err := http.NewRequest("DELETE", containerURL(server), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(requests.Res)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resData.Status != requests.StatusRemoved {
+		t.Error("Remove should've succeeded but didn't")
+	}
+
+	if containers.Get(Rcontainer.ID) != nil {
+		t.Error("container should be unset after remove")
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "?channel=container-" + Rcontainer.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Events should be sent as an event stream")
+	}
+	sendStep("Testing", "container-"+Rcontainer.ID)
+
+	expected := "event: " + delancey.StepEvent + "\ndata: Testing\n\n"
+	buf := make([]byte, len(expected))
+	_, err = io.ReadFull(res.Body, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != expected {
+		t.Error("Step event wasn't sent as expected")
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	allowedOrigins = []string{"https://bowery.io"}
+	defer func() { allowedOrigins = nil }()
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"http://agent.example.com", true},
+		{"https://bowery.io", true},
+		{"https://bowery.io.example.com", false},
+		{"http://example.com", false},
+		{"%zz", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://agent.example.com/containers/some-id/terminal", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		if checkOrigin(req) != test.allowed {
+			t.Error("Origin", test.origin, "should be allowed", test.allowed)
+		}
+	}
+}
+
+func TestTerminalForeignOrigin(t *testing.T) {
+	container := addTestContainer(t, "terminal-origin-id")
+	defer containers.Remove(container.ID)
+	server := newContainerServer(terminalHandler)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/containers/"+container.ID+"/terminal", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "http://example.com")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Terminal from a foreign origin should've been forbidden, got", res.StatusCode)
+	}
+}
+
+func TestTerminalHandler(t *testing.T) {
+	container := addTestContainer(t, "terminal-id")
+	defer containers.Remove(container.ID)
+	server := newContainerServer(terminalHandler)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/containers/" + container.ID + "/terminal?width=80&height=24"
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	term := testContainerRuntime.testTerminal(container.DockerID)
+	if size := waitResize(t, term); size != [2]int{80, 24} {
+		t.Error("Terminal should've been opened with the requested size, got", size)
+	}
+
+	// Input and output are sent as binary messages.
+	err = ws.WriteMessage(websocket.BinaryMessage, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != websocket.BinaryMessage || string(data) != "hello" {
+		t.Error("Terminal output wasn't sent as a binary message", typ, string(data))
+	}
+
+	// Control messages are sent as text.
+	err = ws.WriteJSON(&delancey.TerminalMessage{Type: delancey.ResizeMessage, Width: 100, Height: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := waitResize(t, term); size != [2]int{100, 40} {
+		t.Error("Terminal should've been resized, got", size)
+	}
+
+	err = ws.WriteMessage(websocket.BinaryMessage, []byte("exit\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(delancey.TerminalMessage)
+	err = ws.ReadJSON(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != delancey.ExitMessage || msg.ExitCode != 0 {
+		t.Error("Exit message should've been sent once the shell exited, got", msg)
+	}
+
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Error("Socket should've been closed normally, got", err)
+	}
+}
+
+func TestTerminalHandlerNoContainer(t *testing.T) {
+	server := newContainerServer(terminalHandler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/containers/missing-id/terminal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	resData := new(requests.Res)
+	err = json.NewDecoder(res.Body).Decode(resData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusNotFound || resData.Error() != delancey.ErrNotInUse.Error() {
+		t.Error("Terminal for a missing container should've been not found, got", res.StatusCode, resData.Error())
+	}
+}
+
+func TestExecHandler(t *testing.T) {
+	container := addTestContainer(t, "exec-id")
+	defer containers.Remove(container.ID)
+	server := newContainerServer(execHandler)
+	defer server.Close()
+
+	body := strings.NewReader(`{"cmd": ["echo", "hello"]}`)
+	res, err := http.Post(server.URL+"/containers/"+container.ID+"/exec", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// The output is streamed as JSON messages ending with the exit code.
+	var outputs []*delancey.ExecOutput
+	decoder := json.NewDecoder(res.Body)
+	for {
+		output := new(delancey.ExecOutput)
+		err = decoder.Decode(output)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outputs = append(outputs, output)
+	}
+
+	if len(outputs) != 2 {
+		t.Fatal("Expected output and exit messages, got", len(outputs))
+	}
+	if outputs[0].Stream != delancey.StdoutStream || string(outputs[0].Data) != "echo hello" {
+		t.Error("Output wasn't sent on stdout", outputs[0].Stream, string(outputs[0].Data))
+	}
+	if outputs[1].ExitCode == nil || *outputs[1].ExitCode != 0 {
+		t.Error("Last message should have the exit code")
+	}
+}
+
+func TestLogsHandler(t *testing.T) {
+	container := addTestContainer(t, "logs-id")
+	defer containers.Remove(container.ID)
+	server := newContainerServer(logsHandler)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/containers/" + container.ID + "/logs?follow=true&tail=10&since=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	logs, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK || string(logs) != "follow=true tail=10 since=5\n" {
+		t.Error("Logs weren't streamed with the requested options", res.StatusCode, string(logs))
+	}
+
+	res, err = http.Get(server.URL + "/containers/" + container.ID + "/logs?tail=some")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Error("Invalid tail should've failed, got", res.StatusCode)
+	}
+}
+
+func TestExecAndLogsNoContainer(t *testing.T) {
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		action  string
+	}{
+		{execHandler, "POST", "exec"},
+		{logsHandler, "GET", "logs"},
+	}
+
+	for _, test := range tests {
+		server := newContainerServer(test.handler)
+		req, err := http.NewRequest(test.method, server.URL+"/containers/missing-id/"+test.action,
+			strings.NewReader(`{"cmd": ["true"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resData := new(requests.Res)
+		err = json.NewDecoder(res.Body).Decode(resData)
+		res.Body.Close()
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if res.StatusCode != http.StatusNotFound || resData.Error() != delancey.ErrNotInUse.Error() {
+			t.Error(test.action, "for a missing container should've been not found, got", res.StatusCode, resData.Error())
+		}
+	}
+}
+
+func TestDockerCreateContainer(t *testing.T) {
+	defer useFakeDocker()()
+	image := config.DockerBaseImage + ":" + Dcontainer.ImageID
+	testDocker.AddImage(image, "PATH=/usr/bin")
+	server := httptest.NewServer(http.HandlerFunc(createContainerHandler))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	err := encoder.Encode(Dcontainer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Post(server.URL, "application/json", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	jobRes := new(delancey.JobRes)
+	decoder := json.NewDecoder(res.Body)
+	err = decoder.Decode(jobRes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := waitJob(jobRes.Job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.Status != delancey.JobSucceeded {
+		t.Fatal("Create job should've succeeded but failed", job.Error)
+	}
+
+	if !testDocker.Called("POST /images/create") || !testDocker.Called("POST /build") {
+		t.Error("Image should've been pulled and the runner image built")
+	}
+
+	dcontainer := testDocker.Container(job.Container.DockerID)
+	if dcontainer == nil || !dcontainer.Running {
+		t.Fatal("Docker container should be running after create")
+	}
+
+	runner := testDocker.Image(dcontainer.Image)
+	if runner == nil || len(runner.Env) != 1 || runner.Env[0] != "PATH=/usr/bin" {
+		t.Error("Runner image should have the pulled images env")
+	}
+	Dcontainer.DockerID = job.Container.DockerID
+}
+
+func TestDockerSaveContainer(t *testing.T) {
+	defer useFakeDocker()()
+	testDocker.SetChanges("/root/file")
+	saved := ""
+	prevSaved := imageSaved
+	imageSaved = func(imageID string) {
+		saved = imageID
+	}
+	defer func() { imageSaved = prevSaved }()
+	server := newContainerServer(saveContainerHandler)
+	defer server.Close()
+
+	req, err := http.NewRequest("PUT", server.URL+"/containers/"+Dcontainer.ID+"/save", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Error("Save should've succeeded but didn't")
+	}
+
+	if !testDocker.Called("POST /commit") {
+		t.Error("Container should've been committed")
+	}
+
+	if testDocker.Pushed(config.DockerBaseImage+":"+Dcontainer.ImageID) == nil {
+		t.Error("Committed image should've been pushed")
+	}
+
+	if saved != Dcontainer.ImageID {
+		t.Error("Kenmare should've been told the image was saved")
+	}
+}
+
+func TestDockerRemoveContainer(t *testing.T) {
+	defer useFakeDocker()()
+	dcontainer := testDocker.Container(Dcontainer.DockerID)
+	if dcontainer == nil {
+		t.Fatal("Docker container should exist before remove")
+	}
+	server := newContainerServer(removeContainerHandler)
+	defer server.Close()
+
+	req, err := http.NewRequest("DELETE", server.URL+"/containers/"+Dcontainer.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
 		t.Error("Remove should've succeeded but didn't")
 	}
 
-	if currentContainer != nil {
-		t.Error("currentContainer should be unset after remove")
+	if testDocker.Container(Dcontainer.DockerID) != nil || testDocker.Image(dcontainer.Image) != nil {
+		t.Error("Docker container and its runner image should've been removed")
+	}
+
+	if containers.Get(Dcontainer.ID) != nil {
+		t.Error("container should be unset after remove")
+	}
+}
+
+// waitJob polls the job handler until the job with the given ID completes.
+func waitJob(id string) (*delancey.Job, error) {
+	router := mux.NewRouter()
+	router.HandleFunc("/jobs/{id}", jobHandler)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	for {
+		res, err := http.Get(server.URL + "/jobs/" + id)
+		if err != nil {
+			return nil, err
+		}
+
+		jobRes := new(delancey.JobRes)
+		decoder := json.NewDecoder(res.Body)
+		err = decoder.Decode(jobRes)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if jobRes.Status != requests.StatusSuccess {
+			return nil, jobRes
+		}
+
+		if jobRes.Job.Status != delancey.JobRunning {
+			return jobRes.Job, nil
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+}
+
+// useFakeDocker makes the handlers use the Docker runtime with the fake
+// Docker Engine, the returned func restores the test runtime.
+func useFakeDocker() func() {
+	runtime, err := NewDockerRuntime(testDocker.Addr())
+	if err != nil {
+		panic(err)
+	}
+	ContainerRuntime = runtime
+
+	return func() {
+		ContainerRuntime = testContainerRuntime
+	}
+}
+
+// addTestContainer adds a container with the given ID running in the test
+// runtime.
+func addTestContainer(t *testing.T, id string) *Container {
+	_, err := testContainerRuntime.Build(strings.NewReader(""), "test-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dockerID, err := testContainerRuntime.Create(nil, "test-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &Container{Container: &schemas.Container{ID: id, DockerID: dockerID}}
+	err = containers.Add(container)
+	if err != nil {
+		t.Fatal(err)
 	}
+
+	return container
+}
+
+// waitResize waits for the terminal to be resized.
+func waitResize(t *testing.T, term *testTerminal) [2]int {
+	select {
+	case size := <-term.resizes:
+		return size
+	case <-time.After(time.Second):
+		t.Fatal("Terminal wasn't resized")
+	}
+
+	return [2]int{}
+}
+
+// newContainerServer creates a test server that routes the container ID paths
+// to the given handler.
+func newContainerServer(handler http.HandlerFunc) *httptest.Server {
+	router := mux.NewRouter()
+	router.HandleFunc("/containers/{id}", handler)
+	router.HandleFunc("/containers/{id}/{action}", handler)
+
+	return httptest.NewServer(router)
+}
+
+// containerURL gets the URL to the test container on the given server.
+func containerURL(server *httptest.Server) string {
+	return server.URL + "/containers/" + Rcontainer.ID
 }
 
 // newUploadRequest creates a new request with file uploads.
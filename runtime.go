@@ -0,0 +1,101 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrImageNotFound is used when pulling an image that doesn't exist.
+var ErrImageNotFound = errors.New("The image doesn't exist")
+
+// ImageInfo describes an image in a runtime.
+type ImageInfo struct {
+	ID  string
+	Env []string
+}
+
+// ContainerInfo describes a container in a runtime.
+type ContainerInfo struct {
+	ID    string
+	Image string
+}
+
+// ContainerConfig is the config a container is created and started with.
+// Volumes maps paths on the host to paths in the container.
+type ContainerConfig struct {
+	Volumes     map[string]string
+	NetworkMode string
+	Privileged  bool
+}
+
+// Terminal is an interactive command running with a TTY. Reading gets the
+// TTY's output and writing sends its input, closing it ends the command.
+type Terminal interface {
+	io.ReadWriteCloser
+
+	// Resize sets the size of the TTY.
+	Resize(width, height int) error
+
+	// ExitCode retrieves the exit code once the command finishes.
+	ExitCode() (int, error)
+}
+
+// Runtime runs the containers on the agent and manages their images. The
+// configs given are the ones stored with the containers, so they have to be
+// usable when the agent restarts.
+type Runtime interface {
+	// Pull pulls an image, ErrImageNotFound is returned if it doesn't exist.
+	// Progress is sent across the channel if given.
+	Pull(image string, progress chan float64) error
+
+	// Push pushes an image, progress is sent across the channel if given.
+	Push(image string, progress chan float64) error
+
+	// Build builds an image from a tar containing a Dockerfile, tagging it as
+	// repo. The index of each step is sent across the channel if given.
+	Build(input io.Reader, repo string, progress chan int) (string, error)
+
+	// InspectImage retrieves an image's info.
+	InspectImage(image string) (*ImageInfo, error)
+
+	// RemoveImage removes an image.
+	RemoveImage(image string) error
+
+	// Create creates a container from an image running cmd, the ID is
+	// returned.
+	Create(config *ContainerConfig, image string, cmd []string) (string, error)
+
+	// Start starts a container using the config it was created with.
+	Start(config *ContainerConfig, id string) error
+
+	// Stop stops a container, killing it if it doesn't stop after timeout
+	// seconds.
+	Stop(id string, timeout int) error
+
+	// Remove removes a container.
+	Remove(id string) error
+
+	// Commit commits a container's changes to an image.
+	Commit(id, image string) error
+
+	// Inspect retrieves a container's info.
+	Inspect(id string) (*ContainerInfo, error)
+
+	// Changes lists the paths changed in a container since it was created.
+	Changes(id string) ([]string, error)
+
+	// Exec runs a command in a container writing its output to stdout and
+	// stderr. The exit code of the command is returned.
+	Exec(id string, cmd, env []string, dir string, stdout, stderr io.Writer) (int, error)
+
+	// Terminal starts an interactive command in a container.
+	Terminal(id string, cmd []string, dir string) (Terminal, error)
+
+	// Logs retrieves a container's stdout and stderr logs combined. If follow
+	// is true the logs continue until they're closed. Tail is the number of
+	// lines to get from the end, or "all". Since is a unix timestamp to get
+	// logs after, 0 means the beginning.
+	Logs(id string, follow bool, tail string, since int64) (io.ReadCloser, error)
+}
@@ -0,0 +1,268 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// testRuntime is a runtime that keeps its images and containers in memory,
+// so the handlers can run without Docker.
+type testRuntime struct {
+	images     map[string]*ImageInfo
+	containers map[string]*ContainerInfo
+	running    map[string]bool
+	terminals  map[string]*testTerminal
+	nextID     int
+	mutex      sync.Mutex
+}
+
+func newTestRuntime() *testRuntime {
+	return &testRuntime{
+		images:     make(map[string]*ImageInfo),
+		containers: make(map[string]*ContainerInfo),
+		running:    make(map[string]bool),
+		terminals:  make(map[string]*testTerminal),
+	}
+}
+
+// testTerminal echoes its input until exit is written.
+type testTerminal struct {
+	reader  *io.PipeReader
+	writer  *io.PipeWriter
+	resizes chan [2]int
+}
+
+func newTestTerminal() *testTerminal {
+	reader, writer := io.Pipe()
+	return &testTerminal{reader: reader, writer: writer, resizes: make(chan [2]int, 10)}
+}
+
+func (tt *testTerminal) Read(b []byte) (int, error) {
+	return tt.reader.Read(b)
+}
+
+func (tt *testTerminal) Write(b []byte) (int, error) {
+	if string(b) == "exit\n" {
+		return len(b), tt.writer.Close()
+	}
+
+	return tt.writer.Write(b)
+}
+
+func (tt *testTerminal) Close() error {
+	return tt.writer.Close()
+}
+
+func (tt *testTerminal) Resize(width, height int) error {
+	select {
+	case tt.resizes <- [2]int{width, height}:
+	default:
+	}
+
+	return nil
+}
+
+func (tt *testTerminal) ExitCode() (int, error) {
+	return 0, nil
+}
+
+func (tr *testRuntime) Pull(image string, progress chan float64) error {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	if _, ok := tr.images[image]; !ok {
+		return ErrImageNotFound
+	}
+
+	return nil
+}
+
+func (tr *testRuntime) Push(image string, progress chan float64) error {
+	_, err := tr.InspectImage(image)
+	return err
+}
+
+func (tr *testRuntime) Build(input io.Reader, repo string, progress chan int) (string, error) {
+	_, err := io.Copy(ioutil.Discard, input)
+	if err != nil {
+		return "", err
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.images[repo] = &ImageInfo{ID: repo, Env: []string{"HOME=/root"}}
+	return repo, nil
+}
+
+func (tr *testRuntime) InspectImage(image string) (*ImageInfo, error) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	info, ok := tr.images[image]
+	if !ok {
+		return nil, errors.New("No such image: " + image)
+	}
+
+	return info, nil
+}
+
+func (tr *testRuntime) RemoveImage(image string) error {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	delete(tr.images, image)
+	return nil
+}
+
+func (tr *testRuntime) Create(config *ContainerConfig, image string, cmd []string) (string, error) {
+	_, err := tr.InspectImage(image)
+	if err != nil {
+		return "", err
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.nextID++
+	id := "container-" + strconv.Itoa(tr.nextID)
+	tr.containers[id] = &ContainerInfo{ID: id, Image: image}
+	return id, nil
+}
+
+func (tr *testRuntime) Start(config *ContainerConfig, id string) error {
+	return tr.setRunning(id, true)
+}
+
+func (tr *testRuntime) Stop(id string, timeout int) error {
+	return tr.setRunning(id, false)
+}
+
+func (tr *testRuntime) setRunning(id string, running bool) error {
+	_, err := tr.Inspect(id)
+	if err != nil {
+		return err
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.running[id] = running
+	return nil
+}
+
+func (tr *testRuntime) Remove(id string) error {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	delete(tr.containers, id)
+	delete(tr.running, id)
+	return nil
+}
+
+func (tr *testRuntime) Commit(id, image string) error {
+	info, err := tr.Inspect(id)
+	if err != nil {
+		return err
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	tr.images[image] = &ImageInfo{ID: image, Env: tr.images[info.Image].Env}
+	return nil
+}
+
+func (tr *testRuntime) Inspect(id string) (*ContainerInfo, error) {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	info, ok := tr.containers[id]
+	if !ok {
+		return nil, errors.New("No such container: " + id)
+	}
+
+	return info, nil
+}
+
+func (tr *testRuntime) Changes(id string) ([]string, error) {
+	_, err := tr.Inspect(id)
+	return []string{}, err
+}
+
+func (tr *testRuntime) Exec(id string, cmd, env []string, dir string, stdout, stderr io.Writer) (int, error) {
+	_, err := tr.Inspect(id)
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = io.WriteString(stdout, strings.Join(cmd, " "))
+	return 0, err
+}
+
+func (tr *testRuntime) Terminal(id string, cmd []string, dir string) (Terminal, error) {
+	_, err := tr.Inspect(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	term := newTestTerminal()
+	tr.terminals[id] = term
+	return term, nil
+}
+
+// testTerminal gets the last terminal opened in the container.
+func (tr *testRuntime) testTerminal(id string) *testTerminal {
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+
+	return tr.terminals[id]
+}
+
+// Logs writes a single line with the options given.
+func (tr *testRuntime) Logs(id string, follow bool, tail string, since int64) (io.ReadCloser, error) {
+	_, err := tr.Inspect(id)
+	if err != nil {
+		return nil, err
+	}
+
+	line := "follow=" + strconv.FormatBool(follow) + " tail=" + tail + " since=" + strconv.FormatInt(since, 10) + "\n"
+	return ioutil.NopCloser(strings.NewReader(line)), nil
+}
+
+func TestDeleteDocker(t *testing.T) {
+	runtime := newTestRuntime()
+	ContainerRuntime = runtime
+	defer func() { ContainerRuntime = testContainerRuntime }()
+
+	_, err := runtime.Build(strings.NewReader(""), "some-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &Container{Container: &schemas.Container{ID: "delete-id"}}
+	container.DockerID, err = runtime.Create(container.NewDockerConfig(), "some-image", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = container.DeleteDocker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runtime.containers) != 0 || len(runtime.images) != 0 {
+		t.Error("Container and its image should've been removed")
+	}
+}
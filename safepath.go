@@ -0,0 +1,276 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	stdtar "archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// PathError describes a path that was rejected because it isn't safe to
+// write to.
+type PathError struct {
+	Path   string `json:"path"`
+	Reason string `json:"error"`
+}
+
+func (pe *PathError) Error() string {
+	return pe.Path + ": " + pe.Reason
+}
+
+// PathErrors is a list of paths that were rejected.
+type PathErrors []*PathError
+
+func (pe PathErrors) Error() string {
+	return strconv.Itoa(len(pe)) + " unsafe path(s) rejected, first " + pe[0].Error()
+}
+
+// resolvePath resolves a relative path inside the root. The path is rejected
+// if it's absolute, refers to the root itself, or escapes the root either
+// with .. elements or by passing through a symlink that points outside of
+// the root.
+func resolvePath(root, rel string) (string, error) {
+	clean, err := cleanPath(rel)
+	if err != nil {
+		return "", err
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		// Nothing inside can be a symlink if the root doesn't exist yet.
+		if os.IsNotExist(err) {
+			return filepath.Join(root, clean), nil
+		}
+
+		return "", err
+	}
+
+	// Check each existing element for symlinks pointing outside the root.
+	current := root
+	for _, elem := range strings.Split(clean, string(filepath.Separator)) {
+		current = filepath.Join(current, elem)
+		info, err := os.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+
+			return "", err
+		}
+
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return "", &PathError{Path: rel, Reason: "symlink can't be resolved"}
+		}
+
+		if !delancey.IsWithin(realRoot, target) {
+			return "", &PathError{Path: rel, Reason: "symlink points outside the root"}
+		}
+	}
+
+	return filepath.Join(root, clean), nil
+}
+
+// cleanPath cleans a relative path, rejecting it if it's absolute, refers to
+// the root, or escapes the root with .. elements.
+func cleanPath(rel string) (string, error) {
+	clean := filepath.Clean(rel)
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" {
+		return "", &PathError{Path: rel, Reason: "absolute paths aren't allowed"}
+	}
+
+	if clean == "." {
+		return "", &PathError{Path: rel, Reason: "path refers to the root"}
+	}
+
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", &PathError{Path: rel, Reason: "path escapes the root"}
+	}
+
+	return clean, nil
+}
+
+// resolveParentPath resolves a relative path inside the root like resolvePath,
+// but the last element isn't followed if it's a symlink. It's used for
+// operations on the path itself, like removing it.
+func resolveParentPath(root, rel string) (string, error) {
+	clean, err := cleanPath(rel)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Dir(clean)
+	if dir == "." {
+		return filepath.Join(root, clean), nil
+	}
+
+	dir, err = resolvePath(root, dir)
+	if err != nil {
+		if pe, ok := err.(*PathError); ok {
+			pe.Path = rel
+		}
+
+		return "", err
+	}
+
+	return filepath.Join(dir, filepath.Base(clean)), nil
+}
+
+// untar extracts a gzipped tar stream to the root. Entries matching the
+// ignores are skipped. Entries with unsafe paths, symlinks pointing outside
+// the root, or unsupported types are skipped and returned as PathErrors once
+// the rest of the stream is extracted.
+func untar(r io.Reader, root string, ignores *delancey.Matcher) error {
+	var rejected PathErrors
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	tarReader := stdtar.NewReader(gzipReader)
+
+	err = os.MkdirAll(root, os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.Trim(path.Clean("/"+header.Name), "/")
+		if ignores != nil && name != "" &&
+			ignores.MatchParents(name, header.Typeflag == stdtar.TypeDir) {
+			continue
+		}
+
+		err = untarEntry(tarReader, header, root)
+		if pe, ok := err.(*PathError); ok {
+			rejected = append(rejected, pe)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(rejected) > 0 {
+		return rejected
+	}
+
+	return nil
+}
+
+// uploadIgnores creates the matcher for paths that aren't extracted to the
+// root, from the agents ignore list and the roots ignore file.
+func uploadIgnores(root string) (*delancey.Matcher, error) {
+	patterns, err := delancey.ReadIgnoreFile(filepath.Join(root, delancey.IgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+
+	return delancey.NewMatcher(append(append([]string{}, ignoreList...), patterns...))
+}
+
+// untarEntry extracts a single tar entry to the root.
+func untarEntry(reader io.Reader, header *stdtar.Header, root string) error {
+	rel := filepath.FromSlash(header.Name)
+	mode := os.FileMode(header.Mode).Perm()
+
+	// The root itself may be included, but only its contents are extracted.
+	if filepath.Clean(rel) == "." && header.Typeflag == stdtar.TypeDir {
+		return nil
+	}
+
+	switch header.Typeflag {
+	case stdtar.TypeDir, stdtar.TypeReg, stdtar.TypeSymlink, stdtar.TypeLink:
+	default:
+		return &PathError{Path: header.Name, Reason: "unsupported entry type"}
+	}
+
+	fullPath, err := resolveParentPath(root, rel)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm|os.ModeDir)
+	if err != nil {
+		return err
+	}
+
+	// Links are checked before anything is replaced, so a rejected entry
+	// doesn't remove the existing path.
+	var linkTarget string
+	switch header.Typeflag {
+	case stdtar.TypeSymlink:
+		linkTarget = filepath.FromSlash(header.Linkname)
+		err = delancey.CheckLink(root, fullPath, linkTarget)
+		if err == delancey.ErrLinkOutside {
+			return &PathError{Path: header.Name, Reason: "symlink points outside the root"}
+		}
+		if err != nil {
+			return &PathError{Path: header.Name, Reason: err.Error()}
+		}
+	case stdtar.TypeLink:
+		linkTarget, err = resolvePath(root, filepath.FromSlash(header.Linkname))
+		if err != nil {
+			if pe, ok := err.(*PathError); ok {
+				pe.Path = header.Name
+			}
+
+			return err
+		}
+	}
+
+	// Replace existing non directories rather than writing through them.
+	info, err := os.Lstat(fullPath)
+	if err == nil && !info.IsDir() {
+		err = os.Remove(fullPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case stdtar.TypeDir:
+		err = os.MkdirAll(fullPath, mode|os.ModeDir)
+		if err == nil {
+			err = os.Chmod(fullPath, mode)
+		}
+	case stdtar.TypeReg:
+		var file *os.File
+		file, err = os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(file, reader)
+		file.Close()
+	case stdtar.TypeSymlink:
+		return os.Symlink(linkTarget, fullPath)
+	case stdtar.TypeLink:
+		return os.Link(linkTarget, fullPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(fullPath, header.ModTime, header.ModTime)
+}
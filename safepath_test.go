@@ -0,0 +1,255 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	stdtar "archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typ      byte
+	linkname string
+	body     string
+}
+
+func newTestTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := stdtar.NewWriter(gzipWriter)
+
+	for _, entry := range entries {
+		err := tarWriter.WriteHeader(&stdtar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typ,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tarWriter.Write([]byte(entry.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tarWriter.Close()
+	gzipWriter.Close()
+	return &buf
+}
+
+func newTestRoot(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	for _, p := range []string{root, outside} {
+		err = os.Mkdir(p, os.ModePerm|os.ModeDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root, outside
+}
+
+func TestResolvePath(t *testing.T) {
+	root, outside := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	err := os.Symlink(outside, filepath.Join(root, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullPath, err := resolvePath(root, filepath.Join("a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullPath != filepath.Join(root, "a", "b") {
+		t.Error("Resolved path isn't as expected", fullPath)
+	}
+
+	for _, rel := range []string{"", ".", "..", "../x", "a/../../x", outside, "out/x"} {
+		_, err = resolvePath(root, filepath.FromSlash(rel))
+		if _, ok := err.(*PathError); !ok {
+			t.Error("Expected path error for", rel, "got", err)
+		}
+	}
+
+	// Removing the symlink itself is fine.
+	fullPath, err = resolveParentPath(root, "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fullPath != filepath.Join(root, "out") {
+		t.Error("Resolved path isn't as expected", fullPath)
+	}
+}
+
+func TestUntarRejectsUnsafeEntries(t *testing.T) {
+	root, outside := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	buf := newTestTar(t, []tarEntry{
+		{name: "dir/file", typ: stdtar.TypeReg, body: "ok"},
+		{name: "../escape", typ: stdtar.TypeReg, body: "bad"},
+		{name: "out", typ: stdtar.TypeSymlink, linkname: outside},
+		{name: "rel", typ: stdtar.TypeSymlink, linkname: "../outside"},
+		{name: "out/file", typ: stdtar.TypeReg, body: "bad"},
+		{name: "rel/file", typ: stdtar.TypeReg, body: "bad"},
+		{name: "inside", typ: stdtar.TypeSymlink, linkname: "dir"},
+		{name: "inside/other", typ: stdtar.TypeReg, body: "ok"},
+	})
+
+	err := untar(buf, root, nil)
+	rejected, ok := err.(PathErrors)
+	if !ok {
+		t.Fatal("Expected path errors got", err)
+	}
+	if len(rejected) != 3 {
+		t.Error("Expected 3 rejected entries got", len(rejected), rejected)
+	}
+
+	for _, name := range []string{"dir/file", "dir/other"} {
+		contents, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "ok" {
+			t.Error("Contents of", name, "aren't as expected")
+		}
+	}
+
+	files, err := ioutil.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) > 0 {
+		t.Error("Files were written outside of the root")
+	}
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(root), "escape"))
+	if !os.IsNotExist(err) {
+		t.Error("Entry escaped the root")
+	}
+}
+
+func TestUntarReplacesExistingSymlink(t *testing.T) {
+	root, outside := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	// A symlink created in the container shouldn't be written through.
+	err := os.Symlink(filepath.Join(outside, "target"), filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = untar(newTestTar(t, []tarEntry{
+		{name: "file", typ: stdtar.TypeReg, body: "ok"},
+	}), root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(outside, "target"))
+	if !os.IsNotExist(err) {
+		t.Error("File was written through the symlink")
+	}
+}
+
+func TestUntarRejectsSymlinkThroughSymlink(t *testing.T) {
+	root, _ := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	// Lexically l/.. is the root, but l points at the root so it's really
+	// the roots parent.
+	err := untar(newTestTar(t, []tarEntry{
+		{name: "l", typ: stdtar.TypeSymlink, linkname: "."},
+		{name: "esc", typ: stdtar.TypeSymlink, linkname: "l/.."},
+	}), root, nil)
+	rejected, ok := err.(PathErrors)
+	if !ok {
+		t.Fatal("Expected path errors got", err)
+	}
+	if len(rejected) != 1 || rejected[0].Path != "esc" {
+		t.Error("Expected the escaping symlink to be rejected got", rejected)
+	}
+
+	_, err = os.Lstat(filepath.Join(root, "esc"))
+	if !os.IsNotExist(err) {
+		t.Error("Escaping symlink was created")
+	}
+}
+
+func TestUntarRejectedEntryKeepsExisting(t *testing.T) {
+	root, outside := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("ok"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = untar(newTestTar(t, []tarEntry{
+		{name: "file", typ: stdtar.TypeFifo},
+		{name: "file", typ: stdtar.TypeSymlink, linkname: outside},
+	}), root, nil)
+	if rejected, ok := err.(PathErrors); !ok || len(rejected) != 2 {
+		t.Fatal("Expected both entries to be rejected got", err)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(root, "file"))
+	if err != nil || string(contents) != "ok" {
+		t.Error("Rejected entries shouldn't remove the existing file")
+	}
+}
+
+func TestUntarIgnores(t *testing.T) {
+	root, _ := newTestRoot(t)
+	defer os.RemoveAll(filepath.Dir(root))
+
+	err := ioutil.WriteFile(filepath.Join(root, ".boweryignore"), []byte("node_modules/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ignoreList = []string{".git/"}
+	defer func() { ignoreList = nil }()
+	ignores, err := uploadIgnores(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = untar(newTestTar(t, []tarEntry{
+		{name: ".git/config", typ: stdtar.TypeReg, body: "bad"},
+		{name: "node_modules/pkg/index.js", typ: stdtar.TypeReg, body: "bad"},
+		{name: "main.go", typ: stdtar.TypeReg, body: "ok"},
+	}), root, ignores)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{".git", "node_modules"} {
+		_, err = os.Stat(filepath.Join(root, name))
+		if !os.IsNotExist(err) {
+			t.Error(name, "should've been ignored")
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(root, "main.go"))
+	if err != nil {
+		t.Error("main.go should exist but stat failed")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+// How long a session can be idle while updates wait for a missing update
+// before the gap is reported.
+var sequenceTimeout = 10 * time.Second
+
+// How long a session is kept after it was last used.
+var sessionTTL = 30 * time.Minute
+
+var sessions = NewSessionStore()
+
+// Session orders the updates a client sends to a container. Sequence
+// numbers start at 1, and each update is applied once the update before it
+// is done.
+type Session struct {
+	ID       string
+	last     uint64
+	applying bool
+	active   time.Time // When an update last arrived or finished.
+	changed  chan struct{}
+	mutex    sync.Mutex
+
+	// When the session was last retrieved, guarded by the stores mutex.
+	used time.Time
+}
+
+// NewSession creates a session with no updates applied.
+func NewSession(id string) *Session {
+	return &Session{ID: id, changed: make(chan struct{})}
+}
+
+// Wait waits for the updates before the sequence number to be done. If the
+// update was already applied false is returned. A gap is only reported once
+// the session is idle, with no update arriving, applying or finishing for
+// the idle timeout while this one still waits for a missing update, then
+// ErrSequenceGap is returned. When true is returned Done must be called once
+// the update is applied, or Cancel if it failed.
+func (s *Session) Wait(seq uint64, idle time.Duration) (bool, error) {
+	s.mutex.Lock()
+	s.touch()
+	s.mutex.Unlock()
+
+	for {
+		s.mutex.Lock()
+		if seq <= s.last {
+			s.mutex.Unlock()
+			return false, nil
+		}
+
+		if seq == s.last+1 && !s.applying {
+			s.applying = true
+			s.mutex.Unlock()
+			return true, nil
+		}
+
+		// An update being applied keeps the session active.
+		remaining := idle
+		if !s.applying {
+			remaining = idle - time.Since(s.active)
+			if remaining <= 0 {
+				s.mutex.Unlock()
+				return false, delancey.ErrSequenceGap
+			}
+		}
+		changed := s.changed
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Done marks the update as applied and lets the next update continue.
+func (s *Session) Done(seq uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.applying = false
+	if seq > s.last {
+		s.last = seq
+	}
+	s.touch()
+}
+
+// Cancel lets the next update continue without marking the update as
+// applied, so it can be sent again.
+func (s *Session) Cancel() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.applying = false
+	s.touch()
+}
+
+// touch marks the session as active and wakes the waiting updates, the
+// mutex must be held.
+func (s *Session) touch() {
+	s.active = time.Now()
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Last gets the last sequence number applied.
+func (s *Session) Last() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.last
+}
+
+// SessionStore holds the sessions for each container. Sessions aren't
+// persisted, so after a restart clients have to resync.
+type SessionStore struct {
+	sessions map[string]map[string]*Session
+	mutex    sync.Mutex
+}
+
+// NewSessionStore creates an empty session store.
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]map[string]*Session)}
+}
+
+// Create creates a containers session, if it already exists the existing
+// one is returned.
+func (ss *SessionStore) Create(containerID, id string) *Session {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.prune()
+
+	containerSessions, ok := ss.sessions[containerID]
+	if !ok {
+		containerSessions = make(map[string]*Session)
+		ss.sessions[containerID] = containerSessions
+	}
+
+	session, ok := containerSessions[id]
+	if !ok {
+		session = NewSession(id)
+		containerSessions[id] = session
+	}
+	session.used = time.Now()
+
+	return session
+}
+
+// Get retrieves a containers session, nil is returned if it doesn't exist
+// or it expired.
+func (ss *SessionStore) Get(containerID, id string) *Session {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	ss.prune()
+
+	session, ok := ss.sessions[containerID][id]
+	if !ok {
+		return nil
+	}
+	session.used = time.Now()
+
+	return session
+}
+
+// prune removes the sessions that haven't been used within the ttl.
+func (ss *SessionStore) prune() {
+	now := time.Now()
+
+	for containerID, containerSessions := range ss.sessions {
+		for id, session := range containerSessions {
+			if now.Sub(session.used) > sessionTTL {
+				delete(containerSessions, id)
+			}
+		}
+
+		if len(containerSessions) <= 0 {
+			delete(ss.sessions, containerID)
+		}
+	}
+}
+
+// Remove removes the sessions for a container.
+func (ss *SessionStore) Remove(containerID string) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+
+	delete(ss.sessions, containerID)
+}
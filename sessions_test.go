@@ -0,0 +1,128 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+)
+
+func TestSessionOrder(t *testing.T) {
+	session := NewSession("some-session")
+	var (
+		applied []uint64
+		mutex   sync.Mutex
+		wg      sync.WaitGroup
+	)
+
+	// Start the updates in reverse order.
+	for seq := uint64(5); seq > 0; seq-- {
+		wg.Add(1)
+		go func(seq uint64) {
+			defer wg.Done()
+			apply, err := session.Wait(seq, time.Second)
+			if err != nil || !apply {
+				t.Error("Update", seq, "should've been applied", err)
+				return
+			}
+
+			mutex.Lock()
+			applied = append(applied, seq)
+			mutex.Unlock()
+			session.Done(seq)
+		}(seq)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	for i, seq := range applied {
+		if seq != uint64(i+1) {
+			t.Fatal("Updates weren't applied in order", applied)
+		}
+	}
+	if session.Last() != 5 {
+		t.Error("Last update isn't as expected", session.Last())
+	}
+
+	// Retries of applied updates are skipped.
+	apply, err := session.Wait(3, time.Second)
+	if err != nil || apply {
+		t.Error("Update 3 was already applied")
+	}
+}
+
+func TestSessionGap(t *testing.T) {
+	session := NewSession("some-session")
+
+	_, err := session.Wait(2, 10*time.Millisecond)
+	if err != delancey.ErrSequenceGap {
+		t.Error("Expected sequence gap got", err)
+	}
+}
+
+func TestSessionNoGapWhileApplying(t *testing.T) {
+	session := NewSession("some-session")
+
+	apply, err := session.Wait(1, 20*time.Millisecond)
+	if err != nil || !apply {
+		t.Fatal("Update 1 should've been applied", err)
+	}
+	time.AfterFunc(100*time.Millisecond, func() { session.Done(1) })
+
+	// The session isn't idle while update 1 is applied, even though it takes
+	// longer than the timeout.
+	apply, err = session.Wait(2, 20*time.Millisecond)
+	if err != nil || !apply {
+		t.Fatal("Update 2 should've waited for update 1", err)
+	}
+	session.Done(2)
+
+	// Once idle the gap is reported.
+	start := time.Now()
+	_, err = session.Wait(4, 20*time.Millisecond)
+	if err != delancey.ErrSequenceGap || time.Since(start) < 20*time.Millisecond {
+		t.Error("Expected sequence gap once idle got", err)
+	}
+}
+
+func TestSessionCancel(t *testing.T) {
+	session := NewSession("some-session")
+
+	apply, err := session.Wait(1, time.Second)
+	if err != nil || !apply {
+		t.Fatal("Update 1 should've been applied", err)
+	}
+	session.Cancel()
+
+	// The failed update can be sent again.
+	apply, err = session.Wait(1, time.Second)
+	if err != nil || !apply {
+		t.Fatal("Update 1 should've been applied again", err)
+	}
+	if session.Last() != 0 {
+		t.Error("Failed update shouldn't be the last update", session.Last())
+	}
+	session.Done(1)
+}
+
+func TestSessionStoreExpires(t *testing.T) {
+	store := NewSessionStore()
+	prevTTL := sessionTTL
+	sessionTTL = time.Millisecond
+	defer func() { sessionTTL = prevTTL }()
+
+	if store.Get("some-container", "some-session") != nil {
+		t.Fatal("Session shouldn't exist before it's created")
+	}
+	session := store.Create("some-container", "some-session")
+	if store.Get("some-container", "some-session") != session {
+		t.Error("Session should exist once it's created")
+	}
+
+	<-time.After(5 * time.Millisecond)
+	if store.Get("some-container", "some-session") != nil {
+		t.Error("Session should've expired")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/gorilla/websocket"
+)
+
+// Command used for terminal sessions, a login shell loads the containers env.
+var terminalCmd = []string{"/bin/bash", "-l"}
+
+// Origins allowed to open terminals besides the agents own host.
+var allowedOrigins []string
+
+// errOriginNotAllowed is used when a browser on another site tries to open
+// a terminal.
+var errOriginNotAllowed = errors.New("The requests origin isn't allowed")
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin allows requests from the agents host or the allowed origins.
+// Requests without an origin don't come from browsers, so they're allowed.
+func checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(originURL.Host, req.Host) {
+		return true
+	}
+
+	for _, allowed := range allowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runTerminal bridges a WebSocket to a terminal's TTY until either side
+// closes. Binary messages carry the TTY's input and output, text messages
+// carry control messages.
+func runTerminal(ws *websocket.Conn, term Terminal) {
+	done := make(chan struct{})
+
+	// Send the TTY output to the socket.
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := term.Read(buf)
+			if n > 0 {
+				werr := ws.WriteMessage(websocket.BinaryMessage, buf[:n])
+				if werr != nil {
+					return
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Send the socket input to the TTY, closing the terminal once the socket
+	// is closed.
+	go func() {
+		defer term.Close()
+
+		for {
+			typ, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			if typ == websocket.BinaryMessage {
+				_, err = term.Write(data)
+				if err != nil {
+					return
+				}
+				continue
+			}
+
+			msg := new(delancey.TerminalMessage)
+			err = json.Unmarshal(data, msg)
+			if err != nil {
+				continue
+			}
+
+			if msg.Type == delancey.ResizeMessage {
+				err = term.Resize(msg.Width, msg.Height)
+				if err != nil {
+					log.Println("Failed to resize terminal", err)
+				}
+			}
+		}
+	}()
+	<-done
+
+	code, err := term.ExitCode()
+	if err != nil {
+		code = -1
+	}
+
+	ws.WriteJSON(&delancey.TerminalMessage{Type: delancey.ExitMessage, ExitCode: code})
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	ws.WriteMessage(websocket.CloseMessage, msg)
+}
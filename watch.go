@@ -0,0 +1,485 @@
+// Copyright 2014 Bowery, Inc.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// Largest file whose contents are included in a change.
+	maxChangeContents = 1 << 20
+
+	// How long changes to a path are collected before it's published.
+	changeDelay = 100 * time.Millisecond
+
+	// How long a write from a client suppresses changes to the path.
+	suppressExpiration = time.Minute
+)
+
+var watchers = NewWatcherStore()
+
+// suppressed is the state of a path written by a client.
+type suppressed struct {
+	state   string
+	expires time.Time
+}
+
+// ChangeWatcher watches a containers path and publishes the changes made
+// to it on each subscribed clients channel. Changes that match a write made
+// by a client aren't published to that client, so clients don't receive
+// their own changes.
+type ChangeWatcher struct {
+	container  *Container
+	watcher    *fsnotify.Watcher
+	ignores    *delancey.Matcher
+	pending    map[string]*time.Timer
+	suppressed map[string]map[string]*suppressed // By client, then path.
+	clients    map[string]int                    // Streams for each client.
+	done       chan struct{}
+	mutex      sync.Mutex
+}
+
+// NewChangeWatcher starts watching the containers path.
+func NewChangeWatcher(container *Container) (*ChangeWatcher, error) {
+	ignores, err := uploadIgnores(container.RemotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	cw := &ChangeWatcher{
+		container:  container,
+		watcher:    watcher,
+		ignores:    ignores,
+		pending:    make(map[string]*time.Timer),
+		suppressed: make(map[string]map[string]*suppressed),
+		clients:    make(map[string]int),
+		done:       make(chan struct{}),
+	}
+
+	err = cw.watchDir(container.RemotePath, false)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	go cw.run()
+	return cw, nil
+}
+
+// watchDir watches a directory and the directories inside of it. If
+// publishing, the paths found are published since they may have been
+// created before the watch started.
+func (cw *ChangeWatcher) watchDir(dir string, publish bool) error {
+	return filepath.Walk(dir, func(full string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Paths may be removed while walking.
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		rel, ignored := cw.relPath(full, info.IsDir())
+		if ignored {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+		if publish && rel != "" {
+			cw.schedule(rel)
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		return cw.watcher.Add(full)
+	})
+}
+
+// relPath gets the relative path for a full path, and checks if it's
+// ignored. The root has an empty relative path.
+func (cw *ChangeWatcher) relPath(full string, isDir bool) (string, bool) {
+	rel, err := filepath.Rel(cw.container.RemotePath, full)
+	if err != nil || rel == ".." || filepath.IsAbs(rel) {
+		return "", true
+	}
+	if rel == "." {
+		return "", false
+	}
+	if strings.HasPrefix(filepath.Base(rel), delancey.TempPrefix) {
+		return "", true
+	}
+	rel = filepath.ToSlash(rel)
+
+	return rel, cw.ignores.MatchParents(rel, isDir)
+}
+
+// run handles the watchers events until it's closed.
+func (cw *ChangeWatcher) run() {
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+
+			info, err := os.Lstat(event.Name)
+			isDir := err == nil && info.IsDir()
+			rel, ignored := cw.relPath(event.Name, isDir)
+			if ignored || rel == "" {
+				continue
+			}
+
+			// New directories have to be watched too.
+			if event.Op&fsnotify.Create != 0 && isDir {
+				err = cw.watchDir(event.Name, true)
+				if err != nil {
+					log.Println("Failed to watch", event.Name, err)
+				}
+			}
+			cw.schedule(rel)
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.Println("Watcher error for container", cw.container.ID, err)
+		case <-cw.done:
+			return
+		}
+	}
+}
+
+// schedule publishes the path once changes to it settle.
+func (cw *ChangeWatcher) schedule(rel string) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	if timer, ok := cw.pending[rel]; ok {
+		timer.Reset(changeDelay)
+		return
+	}
+
+	cw.pending[rel] = time.AfterFunc(changeDelay, func() {
+		cw.mutex.Lock()
+		delete(cw.pending, rel)
+		cw.mutex.Unlock()
+
+		err := cw.publish(rel)
+		if err != nil {
+			log.Println("Failed to publish change to", rel, err)
+		}
+	})
+}
+
+// publish sends the current version of a path as a change to the clients
+// that didn't write that version. The paths locks are held so a write in
+// progress finishes, and records the client that wrote it, first.
+func (cw *ChangeWatcher) publish(rel string) error {
+	full := filepath.Join(cw.container.RemotePath, filepath.FromSlash(rel))
+	change := &delancey.RemoteChange{Path: rel}
+	cw.container.pathsMutex.RLock()
+	defer cw.container.pathsMutex.RUnlock()
+	cw.container.pathLocks.Lock(full)
+	defer cw.container.pathLocks.Unlock(full)
+
+	info, err := os.Lstat(full)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		change.Deleted = true
+	} else {
+		change.Entry, err = delancey.NewManifestEntry(full, rel, info)
+		if err != nil || change.Entry == nil {
+			return err
+		}
+
+		switch change.Entry.Type {
+		case delancey.SymlinkType:
+			change.Linkname, err = os.Readlink(full)
+		case delancey.FileType:
+			if change.Entry.Size > maxChangeContents {
+				change.Truncated = true
+				break
+			}
+
+			change.Contents, err = ioutil.ReadFile(full)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	event := &delancey.Event{Name: delancey.ChangeEvent, Data: string(data)}
+
+	// Changes include contents so they're only sent to clients streaming
+	// them, not the other publishers.
+	for _, client := range cw.recipients(rel, changeState(change.Entry)) {
+		err = broker.Publish(changesChannel(cw.container.ID, client), event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recipients gets the subscribed clients that didn't write the state of the
+// path.
+func (cw *ChangeWatcher) recipients(rel, state string) []string {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	clients := make([]string, 0, len(cw.clients))
+
+	for client := range cw.clients {
+		if !cw.wrote(client, rel, state) {
+			clients = append(clients, client)
+		}
+	}
+
+	return clients
+}
+
+// Suppress keeps the next changes to the path from being published to the
+// client if they match the state it wrote. Clients without an ID receive
+// every change.
+func (cw *ChangeWatcher) Suppress(client, rel string, entry *delancey.ManifestEntry) {
+	if client == "" {
+		return
+	}
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+
+	now := time.Now()
+	for id, paths := range cw.suppressed {
+		for path, s := range paths {
+			if now.After(s.expires) {
+				delete(paths, path)
+			}
+		}
+
+		if len(paths) <= 0 {
+			delete(cw.suppressed, id)
+		}
+	}
+
+	paths, ok := cw.suppressed[client]
+	if !ok {
+		paths = make(map[string]*suppressed)
+		cw.suppressed[client] = paths
+	}
+	paths[rel] = &suppressed{
+		state:   changeState(entry),
+		expires: now.Add(suppressExpiration),
+	}
+}
+
+// wrote checks if the state of the path was written by the client. Deleted
+// paths were also written if the client deleted a parent. The mutex must be
+// held.
+func (cw *ChangeWatcher) wrote(client, rel, state string) bool {
+	paths := cw.suppressed[client]
+	now := time.Now()
+
+	s, ok := paths[rel]
+	if ok && s.state == state && now.Before(s.expires) {
+		return true
+	}
+	if state != changeState(nil) {
+		return false
+	}
+
+	for i, c := range rel {
+		if c != '/' {
+			continue
+		}
+
+		s, ok := paths[rel[:i]]
+		if ok && s.state == state && now.Before(s.expires) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close stops watching the containers path.
+func (cw *ChangeWatcher) Close() error {
+	close(cw.done)
+
+	cw.mutex.Lock()
+	for _, timer := range cw.pending {
+		timer.Stop()
+	}
+	cw.mutex.Unlock()
+
+	return cw.watcher.Close()
+}
+
+// changeState describes the version of a path, a nil entry is a deleted
+// path.
+func changeState(entry *delancey.ManifestEntry) string {
+	if entry == nil {
+		return "deleted"
+	}
+	if entry.Type == delancey.DirType {
+		return entry.Type
+	}
+
+	return entry.Type + ":" + entry.Hash
+}
+
+// changesChannel gets the channel a containers changes are published on for
+// a client.
+func changesChannel(id, client string) string {
+	return "changes-" + id + "-" + client
+}
+
+// WatcherStore holds the change watchers for containers, a container is
+// only watched while a client is receiving its changes.
+type WatcherStore struct {
+	watchers map[string]*ChangeWatcher
+	mutex    sync.Mutex
+}
+
+// NewWatcherStore creates an empty watcher store.
+func NewWatcherStore() *WatcherStore {
+	return &WatcherStore{watchers: make(map[string]*ChangeWatcher)}
+}
+
+// Acquire gets the watcher for a container, starting it if needed, and
+// subscribes the client to its changes. Release has to be called once the
+// client stops streaming them.
+func (ws *WatcherStore) Acquire(container *Container, client string) (*ChangeWatcher, error) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	cw, ok := ws.watchers[container.ID]
+	if !ok {
+		var err error
+		cw, err = NewChangeWatcher(container)
+		if err != nil {
+			return nil, err
+		}
+
+		ws.watchers[container.ID] = cw
+	}
+
+	cw.mutex.Lock()
+	cw.clients[client]++
+	cw.mutex.Unlock()
+	return cw, nil
+}
+
+// Release unsubscribes the client, and stops the containers watcher if no
+// clients are left.
+func (ws *WatcherStore) Release(id, client string) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+
+	cw, ok := ws.watchers[id]
+	if !ok {
+		return
+	}
+
+	cw.mutex.Lock()
+	cw.clients[client]--
+	if cw.clients[client] <= 0 {
+		delete(cw.clients, client)
+	}
+	remaining := len(cw.clients)
+	cw.mutex.Unlock()
+
+	if remaining <= 0 {
+		delete(ws.watchers, id)
+		cw.Close()
+	}
+}
+
+// Suppress records the paths a client wrote to the containers watcher, if
+// it's being watched. The paths current state is used, and paths inside of
+// directories are included. It has to be called before the paths locks are
+// released, so the changes aren't published first.
+func (ws *WatcherStore) Suppress(container *Container, client string, rels ...string) {
+	if client == "" {
+		return
+	}
+	ws.mutex.Lock()
+	cw, ok := ws.watchers[container.ID]
+	ws.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, rel := range rels {
+		rel = filepath.ToSlash(filepath.Clean(rel))
+		full := filepath.Join(container.RemotePath, filepath.FromSlash(rel))
+
+		err := filepath.Walk(full, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == full && os.IsNotExist(err) {
+					cw.Suppress(client, rel, nil)
+					return nil
+				}
+
+				return err
+			}
+
+			childRel, err := filepath.Rel(container.RemotePath, path)
+			if err != nil {
+				return err
+			}
+
+			entry, err := delancey.NewManifestEntry(path, childRel, info)
+			if err == nil && entry != nil {
+				cw.Suppress(client, entry.Path, entry)
+			}
+			return err
+		})
+		if err != nil {
+			log.Println("Failed to suppress change to", rel, err)
+		}
+	}
+}
+
+// SuppressDeleted records paths a client is about to delete to the
+// containers watcher, if it's being watched. Paths inside of directories are
+// removed before the directory, so they're recorded before the delete
+// starts.
+func (ws *WatcherStore) SuppressDeleted(container *Container, client string, rels ...string) {
+	ws.mutex.Lock()
+	cw, ok := ws.watchers[container.ID]
+	ws.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, rel := range rels {
+		cw.Suppress(client, filepath.ToSlash(filepath.Clean(rel)), nil)
+	}
+}
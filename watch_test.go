@@ -0,0 +1,162 @@
+// Copyright 2014 Bowery, Inc.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Bowery/delancey/delancey"
+	"github.com/Bowery/gopackages/schemas"
+)
+
+// Client streaming the test watchers changes.
+const testClient = "some-client"
+
+func newTestWatcher(t *testing.T) (*Container, chan *delancey.Event, func()) {
+	dir, err := ioutil.TempDir("", "delancey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := &Container{Container: &schemas.Container{ID: "watch-test", RemotePath: dir}}
+
+	events, release, err := subscribeChanges(container, testClient)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return container, events, func() {
+		release()
+		os.RemoveAll(dir)
+	}
+}
+
+// subscribeChanges subscribes a client to the containers changes.
+func subscribeChanges(container *Container, client string) (chan *delancey.Event, func(), error) {
+	_, err := watchers.Acquire(container, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := broker.Subscribe(changesChannel(container.ID, client))
+
+	return events, func() {
+		broker.Unsubscribe(changesChannel(container.ID, client), events)
+		watchers.Release(container.ID, client)
+	}, nil
+}
+
+func nextChange(t *testing.T, events chan *delancey.Event, timeout time.Duration) *delancey.RemoteChange {
+	select {
+	case event := <-events:
+		change := new(delancey.RemoteChange)
+		err := json.Unmarshal([]byte(event.Data), change)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return change
+	case <-time.After(timeout):
+		return nil
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	container, events, cleanup := newTestWatcher(t)
+	defer cleanup()
+
+	err := os.MkdirAll(filepath.Join(container.RemotePath, "build"), os.ModePerm|os.ModeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := nextChange(t, events, 2*time.Second)
+	if change == nil || change.Path != "build" || change.Entry.Type != delancey.DirType {
+		t.Fatal("Expected a change for the new directory", change)
+	}
+
+	// Files in new directories are watched.
+	err = ioutil.WriteFile(filepath.Join(container.RemotePath, "build", "out"), []byte("artifact"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change = nextChange(t, events, 2*time.Second)
+	if change == nil || change.Path != "build/out" || string(change.Contents) != "artifact" {
+		t.Fatal("Expected a change with the files contents", change)
+	}
+
+	err = os.Remove(filepath.Join(container.RemotePath, "build", "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	change = nextChange(t, events, 2*time.Second)
+	if change == nil || change.Path != "build/out" || !change.Deleted {
+		t.Fatal("Expected a change for the deleted file", change)
+	}
+}
+
+func TestWatchSuppressed(t *testing.T) {
+	container, events, cleanup := newTestWatcher(t)
+	defer cleanup()
+
+	// Writes from clients and temporary files aren't sent.
+	err := ioutil.WriteFile(filepath.Join(container.RemotePath, "client"), []byte("client"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchers.Suppress(container, testClient, "client")
+	err = ioutil.WriteFile(filepath.Join(container.RemotePath, delancey.TempPrefix+"tmp"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := nextChange(t, events, 500*time.Millisecond)
+	if change != nil {
+		t.Fatal("Expected no changes", change)
+	}
+
+	// Later changes to the path are sent.
+	err = ioutil.WriteFile(filepath.Join(container.RemotePath, "client"), []byte("agent"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change = nextChange(t, events, 2*time.Second)
+	if change == nil || change.Path != "client" || string(change.Contents) != "agent" {
+		t.Fatal("Expected a change for the path", change)
+	}
+}
+
+func TestWatchSuppressedPerClient(t *testing.T) {
+	container, events, cleanup := newTestWatcher(t)
+	defer cleanup()
+	otherEvents, release, err := subscribeChanges(container, "other-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// The write is recorded while the paths lock is held, like the handlers.
+	full := filepath.Join(container.RemotePath, "client")
+	container.pathLocks.Lock(full)
+	err = ioutil.WriteFile(full, []byte("client"), 0644)
+	if err == nil {
+		time.Sleep(2 * changeDelay)
+		watchers.Suppress(container, testClient, "client")
+	}
+	container.pathLocks.Unlock(full)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := nextChange(t, events, 500*time.Millisecond)
+	if change != nil {
+		t.Error("Client shouldn't receive its own change", change)
+	}
+
+	change = nextChange(t, otherEvents, 2*time.Second)
+	if change == nil || change.Path != "client" || string(change.Contents) != "client" {
+		t.Error("Other clients should receive the change", change)
+	}
+}